@@ -14,7 +14,7 @@ const (
 )
 
 func CmdInit(Cmd *cobra.Command) {
-	Cmd.PersistentFlags().String(OPT_PORT, "8080", "Port to serve API and metrics")
+	Cmd.PersistentFlags().String(OPT_PORT, "8080", "Port to serve the API on")
 	viper.BindPFlag(OPT_PORT, Cmd.PersistentFlags().Lookup(OPT_PORT))
 
 	Cmd.PersistentFlags().String(OPT_LOG_LEVEL, "WARN", "Log level for the whole proc")
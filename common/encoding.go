@@ -0,0 +1,105 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	EncodingBrotli   = "br"
+	EncodingGzip     = "gzip"
+	EncodingIdentity = "identity"
+)
+
+// EncodingExt maps a content encoding to the file extension of precompressed siblings.
+var EncodingExt = map[string]string{
+	EncodingBrotli: ".br",
+	EncodingGzip:   ".gz",
+}
+
+// EncodingNegotiate picks the first of supported (in preference order) that
+// acceptEncoding allows with the highest q-value. It returns EncodingIdentity
+// when nothing else is acceptable.
+func EncodingNegotiate(acceptEncoding string, supported []string) string {
+	qs := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		qs[name] = q
+	}
+
+	best, bestQ := EncodingIdentity, 0.0
+	for _, enc := range supported {
+		q, ok := qs[enc]
+		if !ok {
+			q, ok = qs["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// EncodingCompress compresses data with the named content encoding.
+func EncodingCompress(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch encoding {
+	case EncodingBrotli:
+		w := brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case EncodingGzip:
+		w, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+	return buf.Bytes(), nil
+}
+
+// ContentTypeCompressible reports whether content of this type is worth compressing.
+func ContentTypeCompressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/javascript",
+		"application/json",
+		"application/manifest+json",
+		"application/wasm",
+		"application/xml",
+		"application/x-javascript",
+		"font/otf",
+		"font/ttf",
+		"image/svg+xml",
+		"image/x-icon":
+		return true
+	}
+	return false
+}
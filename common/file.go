@@ -0,0 +1,111 @@
+package common
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TmpFilePrefix marks partially written files. Readers and the sync loop skip them.
+const TmpFilePrefix = ".edgie-tmp-"
+
+// FileIsTmp reports whether path names a partially written file.
+func FileIsTmp(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), TmpFilePrefix)
+}
+
+// FileWriteTmp copies src into a new temp file in dstDir and returns its path.
+// Callers rename the temp file into place when they are ready to publish it.
+func FileWriteTmp(dstDir string, src io.Reader, perm os.FileMode) (tmpPath string, n int64, err error) {
+	if err := os.MkdirAll(dstDir, os.ModePerm); err != nil {
+		return "", 0, fmt.Errorf("failed to create directory %s: %v", dstDir, err)
+	}
+
+	tmp, err := os.CreateTemp(dstDir, TmpFilePrefix+"*")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create temp file in %s: %v", dstDir, err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if n, err = io.Copy(tmp, src); err != nil {
+		return "", 0, fmt.Errorf("failed to write to file %s: %w", tmp.Name(), err)
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return "", 0, err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", 0, err
+	}
+	return tmp.Name(), n, nil
+}
+
+// FileWriteAtomic writes src to dstPath through a temp file and a rename
+// so readers see either the old or the new contents, never a partial write.
+func FileWriteAtomic(dstPath string, src io.Reader, perm os.FileMode) (int64, error) {
+	tmpPath, n, err := FileWriteTmp(filepath.Dir(dstPath), src, perm)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to rename %s to %s: %v", tmpPath, dstPath, err)
+	}
+	return n, nil
+}
+
+// FileMove moves srcPath to dstPath, copying when they are on different
+// volumes. dstPath is replaced atomically and srcPath is removed once the copy is in place.
+func FileMove(srcPath string, dstPath string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", dstPath, err)
+	}
+	if err := os.Rename(srcPath, dstPath); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	_, err = FileWriteAtomic(dstPath, src, perm)
+	src.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(srcPath)
+}
+
+// ETagFromMD5 quotes an MD5 digest the way S3 reports the ETag of a single-part object.
+func ETagFromMD5(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+// ETagOf returns the ETag of data.
+func ETagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return ETagFromMD5(sum[:])
+}
+
+// FileETag returns the ETagOf the file at path.
+func FileETag(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return ETagFromMD5(h.Sum(nil)), nil
+}
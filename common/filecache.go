@@ -1,26 +1,75 @@
 package common
 
 import (
-	"container/list"
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bmatcuk/doublestar/v4"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/puzpuzpuz/xsync"
 	log "github.com/sirupsen/logrus"
 )
 
+// FileCacheTier is a disk volume that holds cache files.
+type FileCacheTier struct {
+	Name     string
+	DirPath  string
+	BytesMax int64 // physical bytes, after compression and encryption
+}
+
 // Configuration struct for FileCache
 type FileCacheConfig struct {
 	EvictionTick time.Duration
 	DirPath      string
-	DiskBytesMax int64
+	DiskBytesMax int64 // physical bytes, after compression and encryption
 	RAMBytesMax  int64
+
+	// Tiers are the disk volumes behind RAM, fastest first. Files are written to
+	// the first, demoted to the next when a tier fills and promoted back to the
+	// first on a hit. Empty means one tier named "disk" at DirPath holding DiskBytesMax.
+	Tiers []FileCacheTier
+
+	// DiskCompression compresses files at rest: FileCompressionNone, FileCompressionGzip or FileCompressionZstd
+	DiskCompression string
+	// DiskKey is an AES-128/192/256 key that encrypts files at rest with AES-GCM, nil for plaintext
+	DiskKey []byte
+	// RAMCompressed holds the DiskCompression form in RAM and inflates it on every read
+	RAMCompressed bool
+	// RAMMmap holds files in RAM by mapping them from disk instead of copying
+	// them into the heap. Mapped bytes count against RAMBytesMax. Only files
+	// stored without compression or encryption are mapped.
+	RAMMmap bool
+	// ScrubInterval is the delay between background scrubs of the tiers, 0 to disable
+	ScrubInterval time.Duration
+	// IndexSnapshotInterval is the delay between snapshots of the index, 0 to
+	// disable them and scan the tiers at every start
+	IndexSnapshotInterval time.Duration
+	// Pinned are doublestar patterns of keys that are never evicted
+	Pinned []string
+	// Quotas cap the disk bytes of keys under a prefix. A key counts against the longest matching prefix.
+	Quotas []FileCacheQuota
+
+	// SendfileBytesMin keeps files of at least this many bytes out of RAM. Disk
+	// hits on them return an open File the caller can stream with sendfile.
+	// Only files stored without compression or encryption qualify. 0 disables.
+	SendfileBytesMin int64
+}
+
+// tiers returns the configured disk tiers, or the single tier at DirPath.
+func (config FileCacheConfig) tiers() []FileCacheTier {
+	if len(config.Tiers) > 0 {
+		return config.Tiers
+	}
+	return []FileCacheTier{{Name: "disk", DirPath: config.DirPath, BytesMax: config.DiskBytesMax}}
 }
 
 var (
@@ -34,10 +83,10 @@ var (
 		Help: "Total number of cache read operations that failed.",
 	})
 
-	cacheReadsDisk = prometheus.NewCounter(prometheus.CounterOpts{
+	cacheReadsDisk = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "filecache_reads_disk_total",
-		Help: "Total number of cache read operations from disk.",
-	})
+		Help: "Total number of cache read operations from disk, by tier.",
+	}, []string{"tier"})
 
 	cacheWrites = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "filecache_writes_total",
@@ -49,170 +98,603 @@ var (
 		Help: "Current number of files in the cache.",
 	})
 
+	cacheFilesDisk = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "filecache_files_disk",
+		Help: "Current number of files in the cache, by tier.",
+	}, []string{"tier"})
+
 	cacheSizeRAM = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "filecache_size_ram_bytes",
 		Help: "Current size of the cache in RAM (bytes).",
 	})
 
-	cacheSizeDisk = prometheus.NewGauge(prometheus.GaugeOpts{
+	cacheSizeDisk = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "filecache_size_disk_bytes",
-		Help: "Current size of the cache on disk (bytes).",
-	})
+		Help: "Current size of the cache on disk (bytes), by tier.",
+	}, []string{"tier"})
+
+	cacheSizeDiskLogical = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "filecache_size_disk_logical_bytes",
+		Help: "Current size of the cache on disk before compression and encryption (bytes), by tier.",
+	}, []string{"tier"})
+
+	cacheSizeDiskMax = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "filecache_size_disk_max_bytes",
+		Help: "Size limit of the cache on disk (bytes), by tier.",
+	}, []string{"tier"})
+
+	cacheDemotions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filecache_demotions_total",
+		Help: "Total number of files moved to a slower tier to make room.",
+	}, []string{"from", "to"})
+
+	cachePromotions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filecache_promotions_total",
+		Help: "Total number of files moved to the fastest tier on a hit.",
+	}, []string{"from", "to"})
 
 	evictionRAMCounter = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "filecache_evictions_ram_total",
 		Help: "Total number of evictions from RAM.",
 	})
 
+	cacheCorruptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "filecache_corruptions_total",
+		Help: "Total number of cache files dropped because they failed verification.",
+	})
+
 	evictionDiskCounter = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "filecache_evictions_disk_total",
-		Help: "Total number of evictions from disk.",
+		Help: "Total number of evictions from the slowest disk tier.",
 	})
 )
 
 func init() {
 	prometheus.MustRegister(
+		cacheCorruptions,
+		cacheDemotions,
 		cacheFiles,
+		cacheFilesDisk,
+		cachePromotions,
 		cacheReadsDisk,
 		cacheReadsMissed,
 		cacheReadsRAM,
 		cacheSizeDisk,
+		cacheSizeDiskLogical,
+		cacheSizeDiskMax,
 		cacheSizeRAM,
 		cacheWrites,
 		evictionDiskCounter,
 		evictionRAMCounter)
 }
 
+// FileCacheMeta is metadata stored alongside an entry. Put verifies a
+// caller-supplied SHA256 and fills it in when it is missing.
+type FileCacheMeta struct {
+	ContentType string
+	SHA256      []byte
+}
+
 type FileCacheEntry struct {
 	Data     []byte
+	ETag     string
 	InMemory bool
+	Meta     FileCacheMeta
 	Mutex    sync.Mutex
+	Size     int64 // logical bytes
+
+	// File is set instead of Data when a disk hit is served without loading
+	// it into RAM. It is positioned at the data and the caller closes it.
+	File *os.File
+
+	diskSize   int64 // physical bytes in the file
+	fileOffset int64 // where the data starts in File
+	mapping    *fileCacheMapping
+	memSize    int64           // bytes held in RAM
+	packed     []byte          // compressed bytes held in RAM when RAMCompressed
+	readers    atomic.Int32    // open handles on an indexed entry
+	src        *FileCacheEntry // the indexed entry of a handle
+	tier       int             // the disk tier holding the file
+}
+
+// FileCacheEntryStat is a snapshot of entry metadata.
+type FileCacheEntryStat struct {
+	ETag     string
+	InMemory bool
+	Meta     FileCacheMeta
 	Size     int64
+	Tier     string // name of the disk tier holding the file
+}
+
+// FileCacheStats is a snapshot of the cache accounting.
+type FileCacheStats struct {
+	Files       int64                 `json:"files"`
+	RAMBytes    int64                 `json:"ramBytes"`
+	RAMBytesMax int64                 `json:"ramBytesMax"`
+	Tiers       []FileCacheTierStats  `json:"tiers"`
+	Quotas      []FileCacheQuotaStats `json:"quotas,omitempty"`
+}
+
+type FileCacheTierStats struct {
+	Name         string `json:"name"`
+	Files        int64  `json:"files"`
+	Bytes        int64  `json:"bytes"`
+	LogicalBytes int64  `json:"logicalBytes"`
+	BytesMax     int64  `json:"bytesMax"`
+}
+
+type FileCacheQuotaStats struct {
+	Name     string `json:"name"`
+	Prefix   string `json:"prefix"`
+	Files    int64  `json:"files"`
+	Bytes    int64  `json:"bytes"`
+	BytesMax int64  `json:"bytesMax"`
+}
+
+// fileCacheTier is a disk tier with its accounting. Its recency order is spread over the shards.
+type fileCacheTier struct {
+	FileCacheTier
+	evictShard       int // next shard to evict from
+	files            atomic.Int64
+	usedBytes        atomic.Int64
+	usedLogicalBytes atomic.Int64
+
+	filesGauge       prometheus.Gauge
+	sizeGauge        prometheus.Gauge
+	sizeLogicalGauge prometheus.Gauge
 }
 
 type FileCache struct {
-	index           *xsync.MapOf[string, *FileCacheEntry]
+	codec           *fileCodec
 	config          FileCacheConfig
+	evictShard      int // next shard to evict RAM from
 	evictionTicker  *time.Ticker
-	mruList         *list.List
-	mruMap          map[string]*list.Element
-	mutex           sync.Mutex
-	usedDiskBytes   int64
-	usedMemoryBytes int64
+	quotas          []*fileCacheQuota
+	scrubReport     atomic.Pointer[FileCacheFsckReport]
+	shards          [fileCacheShardCount]fileCacheShard
+	tiers           []*fileCacheTier
+	usedMemoryBytes atomic.Int64
 }
 
 func NewFileCache(config FileCacheConfig) *FileCache {
 	fc := &FileCache{
-		index:          xsync.NewMapOf[*FileCacheEntry](),
 		config:         config,
 		evictionTicker: time.NewTicker(config.EvictionTick),
-		mruList:        list.New(),
-		mruMap:         make(map[string]*list.Element),
+	}
+	for _, tier := range config.tiers() {
+		fc.tiers = append(fc.tiers, &fileCacheTier{
+			FileCacheTier:    tier,
+			filesGauge:       cacheFilesDisk.WithLabelValues(tier.Name),
+			sizeGauge:        cacheSizeDisk.WithLabelValues(tier.Name),
+			sizeLogicalGauge: cacheSizeDiskLogical.WithLabelValues(tier.Name),
+		})
+		cacheSizeDiskMax.WithLabelValues(tier.Name).Set(float64(tier.BytesMax))
+	}
+	for i := range fc.shards {
+		shard := &fc.shards[i]
+		shard.index = make(map[string]*FileCacheEntry)
+		shard.ram = newFileCacheLRU()
+		for range fc.tiers {
+			shard.tiers = append(shard.tiers, newFileCacheLRU())
+		}
+		shard.account = newFileCacheAccount(len(fc.tiers))
 	}
 
 	return fc
 }
 
+// filePath is where tier t keeps the file for key.
+func (fc *FileCache) filePath(t int, key string) string {
+	return filepath.Join(fc.tiers[t].DirPath, filepath.FromSlash(key))
+}
+
 func (fc *FileCache) init() error {
-	fc.mutex.Lock()
-	defer fc.mutex.Unlock()
+	codec, err := newFileCodec(fc.config.DiskCompression, fc.config.DiskKey)
+	if err != nil {
+		return err
+	}
+	fc.codec = codec
+	if err := fc.policyInit(); err != nil {
+		return err
+	}
 
-	// make disk folder
-	if _, err := os.Stat(fc.config.DirPath); os.IsNotExist(err) {
-		if err := os.MkdirAll(fc.config.DirPath, 0755); err != nil {
+	// make disk folders
+	for _, tier := range fc.tiers {
+		if err := os.MkdirAll(tier.DirPath, 0755); err != nil {
 			return err
 		}
 	}
 
-	// scan files
-	fsys := os.DirFS(fc.config.DirPath)
-	pattern := filepath.Join(fc.config.DirPath, "**/*")
-	files, err := doublestar.Glob(fsys, pattern)
+	// start from the snapshot if we can
+	if fc.config.IndexSnapshotInterval > 0 {
+		if fc.snapshotLoad() {
+			return nil
+		}
+	} else {
+		fc.snapshotRemove()
+	}
+
+	// scan files, fastest tier first
+	for t := range fc.tiers {
+		if err := fc.initTier(t); err != nil {
+			return err
+		}
+	}
+	fc.updateCacheMetrics()
+
+	return nil
+}
+
+// initTier indexes the files of tier t. A key already indexed from a faster
+// tier was left behind by an interrupted move, so the copy here is removed.
+func (fc *FileCache) initTier(t int) error {
+	dirPath := fc.tiers[t].DirPath
+	files, err := doublestar.Glob(os.DirFS(dirPath), "**/*")
 	if err != nil {
 		return err
 	}
 
-	// index files
 	for _, file := range files {
-		info, err := os.Stat(file)
+		fullPath := filepath.Join(dirPath, file)
+		info, err := os.Lstat(fullPath)
 		if err != nil {
 			return err
 		}
+		if !info.Mode().IsRegular() || FileIsTmp(file) || fileCacheSnapshotIs(file) {
+			continue
+		}
 
-		if !info.IsDir() {
-			fileName := filepath.Base(file)
-			entry := &FileCacheEntry{
-				Data:     nil,
-				Size:     info.Size(),
-				InMemory: false,
-			}
+		// a symlinked dir could serve files from outside the tier
+		fileName := filepath.ToSlash(file)
+		if _, err := KeyPath(dirPath, fileName); err != nil {
+			log.Warnf("not indexing cache file %s: %v", fullPath, err)
+			continue
+		}
+		if _, ok := fc.indexLoad(fileName); ok {
+			log.Warnf("removing duplicate cache file %s", fullPath)
+			os.Remove(fullPath)
+			continue
+		}
 
-			fc.index.Store(fileName, entry)
-			fc.usedDiskBytes += entry.Size
+		size, sum, err := fc.fileHeaderRead(fullPath)
+		if errors.Is(err, ErrFileCodec) {
+			// unreadable... it would only fail verification later
+			log.Warnf("removing cache file %s: %v", fullPath, err)
+			cacheCorruptions.Inc()
+			os.Remove(fullPath)
+			continue
+		}
+		if err != nil {
+			return err
 		}
+
+		entry := &FileCacheEntry{
+			Data:     nil,
+			Size:     size,
+			InMemory: false,
+			Meta:     FileCacheMeta{SHA256: sum},
+			diskSize: info.Size(),
+			tier:     t,
+		}
+
+		fc.indexStore(fileName, entry)
+		fc.shard(fileName).tiers[t].touch(fileName)
+		fc.accountDisk(fileName, entry, 1)
+		fc.quotaTouch(fileName)
+	}
+	return nil
+}
+
+// fileHeaderRead reads the logical size and checksum from the header of a cache file.
+func (fc *FileCache) fileHeaderRead(fullPath string) (size int64, sum []byte, err error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return 0, nil, err
 	}
+	defer f.Close()
 
+	head := make([]byte, fileCodecHeaderSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, nil, err
+	}
+	return fc.codec.headerRead(head[:n])
+}
+
+// hold keeps data in RAM in the configured form. Callers hold the entry lock.
+func (fc *FileCache) hold(fce *FileCacheEntry, data []byte, packed []byte) error {
+	fce.InMemory = true
+	if !fc.config.RAMCompressed {
+		fce.Data = data
+		fce.memSize = int64(len(data))
+		return nil
+	}
+
+	if packed == nil {
+		var err error
+		if packed, err = fc.codec.compress(data); err != nil {
+			return err
+		}
+	}
+	fce.Data = nil
+	fce.packed = packed
+	fce.memSize = int64(len(packed))
 	return nil
 }
 
-func (fc *FileCache) Get(filePath string) (fce *FileCacheEntry, err error) {
-	var ok bool
-	fce, ok = fc.index.Load(filePath)
-	if !ok {
-		// it's not in the index, so we don't have it.
-		return nil, os.ErrNotExist
+// handle returns a handle on a locked entry for a caller. It is a copy
+// carrying data, so callers never read the indexed entry without its lock, and
+// it counts as a reader of the entry until it is closed.
+func (fc *FileCache) handle(fce *FileCacheEntry, data []byte) *FileCacheEntry {
+	h := &FileCacheEntry{
+		Data:     data,
+		ETag:     fce.ETag,
+		InMemory: fce.InMemory,
+		Meta:     fce.Meta,
+		Size:     fce.Size,
+		src:      fce,
 	}
+	if fce.mapping != nil {
+		fce.mapping.acquire()
+		h.Data = fce.Data
+		h.mapping = fce.mapping
+	}
+	fce.readers.Add(1)
+	return h
+}
 
+// accountDisk adds the file of fce to its tier and quota group, or takes it away when sign is -1.
+// Callers hold the shard lock of key so a scrub sees the index and the counts agree.
+func (fc *FileCache) accountDisk(key string, fce *FileCacheEntry, sign int64) {
+	tier := fc.tiers[fce.tier]
+	tier.files.Add(sign)
+	tier.usedBytes.Add(sign * fce.diskSize)
+	tier.usedLogicalBytes.Add(sign * fce.Size)
+
+	account := &fc.shard(key).account
+	account.files[fce.tier] += sign
+	account.diskBytes[fce.tier] += sign * fce.diskSize
+	account.logicalBytes[fce.tier] += sign * fce.Size
+	if quota := fc.quotaOf(key); quota != nil {
+		quota.files.Add(sign)
+		quota.usedBytes.Add(sign * fce.diskSize)
+		account.quotaFiles[quota] += sign
+		account.quotaBytes[quota] += sign * fce.diskSize
+	}
+}
+
+// accountMemory adds bytes held in RAM for key, or takes them away when
+// negative. Callers hold the shard lock of key.
+func (fc *FileCache) accountMemory(key string, bytes int64) {
+	fc.usedMemoryBytes.Add(bytes)
+	fc.shard(key).account.memoryBytes += bytes
+}
+
+// Get returns a handle on the entry for filePath, loading its data from disk
+// if it is not in RAM. Close the handle once its data is no longer used...
+// eviction leaves entries with open handles alone.
+func (fc *FileCache) Get(filePath string) (fce *FileCacheEntry, err error) {
 	// lock this while we do the read...
-	fce.Mutex.Lock()
+	for {
+		var ok bool
+		fce, ok = fc.indexLoad(filePath)
+		if !ok {
+			// it's not in the index, so we don't have it.
+			return nil, os.ErrNotExist
+		}
+		fce.Mutex.Lock()
+		if cur, ok := fc.indexLoad(filePath); ok && cur == fce {
+			break
+		}
+		// replaced while we waited for the lock... its file is the new version's
+		fce.Mutex.Unlock()
+	}
 	defer fce.Mutex.Unlock()
 
 	// because if its not in memory, we must modify it...
 	if !fce.InMemory {
-		cacheReadsDisk.Inc()
+		cacheReadsDisk.WithLabelValues(fc.tiers[fce.tier].Name).Inc()
+
+		// big files are streamed from disk rather than loaded into RAM
+		if fc.SendfileUses(fce.Size) {
+			if h, err := fc.getFile(filePath, fce); h != nil || err != nil {
+				return h, err
+			}
+		}
 
-		data, err := os.ReadFile(filepath.Join(fc.config.DirPath, filePath))
+		// with RAMMmap the file is mapped, and plain files are held as the mapping
+		var raw []byte
+		var mapping *fileCacheMapping
+		if fc.config.RAMMmap {
+			if mapping, err = fileCacheMap(fc.filePath(fce.tier, filePath)); err == nil {
+				raw = mapping.data
+				defer func() {
+					if mapping != nil {
+						mapping.release()
+					}
+				}()
+			}
+		}
+		if mapping == nil {
+			raw, err = os.ReadFile(fc.filePath(fce.tier, filePath))
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			// gone since it was indexed... drop it so the caller refetches
+			if err := fc.drop(filePath, fce); err != nil {
+				log.Error(err)
+			}
+			return nil, os.ErrNotExist
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		fce.Data = data
-		fce.InMemory = true
+		data, packed, err := fc.codec.decode(filePath, raw)
+		if err != nil {
+			// corrupt... drop it so the caller refetches
+			log.Errorf("dropping cache file %s: %v", filePath, err)
+			cacheCorruptions.Inc()
+			if err := fc.drop(filePath, fce); err != nil {
+				log.Error(err)
+			}
+			return nil, os.ErrNotExist
+		}
+
+		// replaced since it was indexed... the entry's metadata describes other bytes
+		if _, sum, _ := fc.codec.headerRead(raw); fce.Meta.SHA256 != nil && !bytes.Equal(sum, fce.Meta.SHA256) {
+			log.Errorf("dropping cache file %s: index does not match the file", filePath)
+			if err := fc.drop(filePath, fce); err != nil {
+				log.Error(err)
+			}
+			return nil, os.ErrNotExist
+		}
+		if fce.ETag == "" {
+			fce.ETag = ETagOf(data)
+		}
+
+		if mapping != nil && fc.codec.headerPlain(raw) {
+			fc.holdMapping(fce, mapping)
+			mapping = nil
+		} else if err := fc.hold(fce, data, packed); err != nil {
+			return nil, err
+		}
 
-		fc.mutex.Lock()
-		fc.usedMemoryBytes += int64(len(data))
-		fc.updateMRU(filePath)
+		// a hit on a slower tier moves the file up to the fastest
+		if fce.tier > 0 {
+			if err := fc.promote(filePath, fce, raw); err != nil {
+				log.Errorf("failed to promote cache file %s: %v", filePath, err)
+			}
+		}
+
+		shard := fc.shard(filePath)
+		shard.mutex.Lock()
+		fc.accountMemory(filePath, fce.memSize)
+		shard.touch(filePath, fce)
+		shard.mutex.Unlock()
+		fc.quotaTouch(filePath)
 		fc.updateCacheMetrics()
-		fc.mutex.Unlock()
+		return fc.handle(fce, data), nil
+	}
+
+	cacheReadsRAM.Inc()
+
+	shard := fc.shard(filePath)
+	shard.mutex.Lock()
+	shard.touch(filePath, fce)
+	shard.mutex.Unlock()
+	fc.quotaTouch(filePath)
+
+	data := fce.Data
+	if fc.config.RAMCompressed && fce.mapping == nil {
+		if data, err = fc.codec.decompress(fc.codec.compression, fce.packed); err != nil {
+			return nil, err
+		}
+	}
+	return fc.handle(fce, data), nil
+}
+
+// promote moves the file of a locked entry from a slower tier to the fastest.
+// raw is the content of the file, which is the same on every tier, or nil to move the file.
+func (fc *FileCache) promote(key string, fce *FileCacheEntry, raw []byte) error {
+	from := fce.tier
+	toPath, err := KeyPath(fc.tiers[0].DirPath, key)
+	if err != nil {
+		return err
+	}
+	if raw == nil {
+		if err := FileMove(fc.filePath(from, key), toPath, 0664); err != nil {
+			return err
+		}
 	} else {
-		cacheReadsRAM.Inc()
+		if _, err := FileWriteAtomic(toPath, bytes.NewReader(raw), 0664); err != nil {
+			return err
+		}
+		if err := os.Remove(fc.filePath(from, key)); err != nil && !os.IsNotExist(err) {
+			// the scrubber removes the stray copy
+			log.Errorf("failed to remove promoted cache file %s: %v", fc.filePath(from, key), err)
+		}
+	}
+
+	shard := fc.shard(key)
+	shard.mutex.Lock()
+	shard.tiers[from].remove(key)
+	fc.accountDisk(key, fce, -1)
+	fce.tier = 0
+	fc.accountDisk(key, fce, 1)
+	shard.mutex.Unlock()
+
+	cachePromotions.WithLabelValues(fc.tiers[from].Name, fc.tiers[0].Name).Inc()
+	return nil
+}
 
-		fc.mutex.Lock()
-		fc.updateMRU(filePath)
-		fc.mutex.Unlock()
+// demote moves the file of a locked entry to the next slower tier.
+func (fc *FileCache) demote(key string, fce *FileCacheEntry) error {
+	from, to := fce.tier, fce.tier+1
+	toPath, err := KeyPath(fc.tiers[to].DirPath, key)
+	if err != nil {
+		return err
+	}
+	if err := FileMove(fc.filePath(from, key), toPath, 0664); err != nil {
+		return err
 	}
-	return fce, nil
+
+	shard := fc.shard(key)
+	shard.mutex.Lock()
+	shard.tiers[from].remove(key)
+	fc.accountDisk(key, fce, -1)
+	fce.tier = to
+	fc.accountDisk(key, fce, 1)
+	shard.tiers[to].touch(key)
+	shard.mutex.Unlock()
+	fc.updateCacheMetrics()
+
+	cacheDemotions.WithLabelValues(fc.tiers[from].Name, fc.tiers[to].Name).Inc()
+	return nil
 }
 
-func (fc *FileCache) Put(filePath string, in io.Reader) (fce *FileCacheEntry, err error) {
+// Put stores the contents of in as filePath and returns a handle on the new entry, like Get.
+func (fc *FileCache) Put(filePath string, in io.Reader, meta FileCacheMeta) (fce *FileCacheEntry, err error) {
 	cacheWrites.Inc()
 
-	// get or create the index entry atomically
-	fc.mutex.Lock()
-	var fceSizeStart int64
-	var ok bool
-	fce, ok = fc.index.Load(filePath)
-	if !ok {
-		fce = &FileCacheEntry{}
-		fc.index.Store(filePath, fce)
-	} else {
-		fceSizeStart = fce.Size
+	// refuse keys that could write outside the tier
+	if _, err := KeyPath(fc.tiers[0].DirPath, filePath); err != nil {
+		return nil, err
 	}
 
-	// lock the entry and then release the cache
-	fce.Mutex.Lock()
+	// deferred first so it runs after the entry unlocks
+	defer fc.quotaEnforce(filePath)
+
+	// get or create the index entry and lock it
+	var loaded bool
+	for {
+		fce, loaded = fc.indexLoadOrStore(filePath, &FileCacheEntry{})
+		fce.Mutex.Lock()
+		if cur, ok := fc.indexLoad(filePath); ok && cur == fce {
+			break
+		}
+		// dropped while we waited for the lock... try again
+		fce.Mutex.Unlock()
+	}
 	defer fce.Mutex.Unlock()
-	fc.mutex.Unlock()
+
+	// remember what the old version accounted for
+	var fceStart FileCacheEntry
+	if loaded {
+		fceStart = FileCacheEntry{
+			InMemory: fce.InMemory,
+			Size:     fce.Size,
+			diskSize: fce.diskSize,
+			memSize:  fce.memSize,
+			tier:     fce.tier,
+		}
+	} else {
+		// don't leave an empty entry behind if we fail
+		defer func() {
+			if err != nil {
+				fc.indexDelete(filePath, fce)
+			}
+		}()
+	}
 
 	// read all the data
 	data, err := io.ReadAll(in)
@@ -220,41 +702,203 @@ func (fc *FileCache) Put(filePath string, in io.Reader) (fce *FileCacheEntry, er
 		return nil, err
 	}
 
-	// write out the file
-	fullPath := filepath.Join(fc.config.DirPath, filePath)
-	if err := os.WriteFile(fullPath, data, 0664); err != nil {
+	// verify what the caller expects, or record what we got
+	sum := sha256.Sum256(data)
+	if meta.SHA256 != nil && !bytes.Equal(meta.SHA256, sum[:]) {
+		return nil, ErrChecksumMismatch
+	}
+	meta.SHA256 = sum[:]
+
+	// compress and encrypt
+	packed, raw, err := fc.codec.encode(filePath, data, sum[:])
+	if err != nil {
 		return nil, err
 	}
 
+	// a file bigger than its whole quota group is served but not cached
+	if !fc.quotaFits(filePath, int64(len(raw))) {
+		if loaded {
+			if err := fc.drop(filePath, fce); err != nil {
+				log.Error(err)
+			}
+		} else {
+			fc.indexDelete(filePath, fce)
+		}
+		return &FileCacheEntry{Data: data, ETag: ETagOf(data), InMemory: true, Meta: meta, Size: int64(len(data))}, nil
+	}
+
+	// write out the file to the fastest tier
+	if _, err := FileWriteAtomic(fc.filePath(0, filePath), bytes.NewReader(raw), 0664); err != nil {
+		return nil, err
+	}
+	if loaded && fceStart.tier != 0 {
+		oldPath := fc.filePath(fceStart.tier, filePath)
+		if err := os.Remove(oldPath); err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to remove replaced cache file %s: %v", oldPath, err)
+		}
+	}
+
 	// update the entry (this is safe cause we have the entry locked)
-	fce.Data = data
+	fce.ETag = ETagOf(data)
+	fce.Meta = meta
 	fce.Size = int64(len(data))
-	fce.InMemory = true
+	fce.diskSize = int64(len(raw))
+	fce.tier = 0
+	fc.unmap(fce)
+	if fc.SendfileUses(fce.Size) {
+		// big files stay out of RAM
+		fce.Data, fce.packed, fce.InMemory, fce.memSize = nil, nil, false, 0
+	} else if mapping := fc.mapPut(fc.filePath(0, filePath)); mapping != nil {
+		fc.holdMapping(fce, mapping)
+	} else if err := fc.hold(fce, data, packed); err != nil {
+		return nil, err
+	}
 
-	// lock the cache before updating stats
-	fc.mutex.Lock()
-	fc.usedMemoryBytes += fce.Size
-	fc.usedMemoryBytes -= fceSizeStart
-	fc.updateMRU(filePath)
+	// lock the shard before updating stats
+	shard := fc.shard(filePath)
+	shard.mutex.Lock()
+	if loaded {
+		if fceStart.InMemory {
+			fc.accountMemory(filePath, -fceStart.memSize)
+		}
+		fc.accountDisk(filePath, &fceStart, -1)
+		shard.ram.remove(filePath)
+		shard.tiers[fceStart.tier].remove(filePath)
+	}
+	fc.accountMemory(filePath, fce.memSize)
+	fc.accountDisk(filePath, fce, 1)
+	shard.touch(filePath, fce)
+	shard.mutex.Unlock()
+	fc.quotaTouch(filePath)
 	fc.updateCacheMetrics()
-	fc.mutex.Unlock()
 
-	return fce, nil
+	return fc.handle(fce, data), nil
 }
 
-func (fc *FileCache) updateMRU(fileName string) {
-	if elem, exists := fc.mruMap[fileName]; exists {
-		fc.mruList.MoveToFront(elem)
-		return
+// Has reports whether filePath is in the index without touching recency.
+func (fc *FileCache) Has(filePath string) bool {
+	_, ok := fc.indexLoad(filePath)
+	return ok
+}
+
+// Stat returns the metadata for filePath without loading its data or touching recency.
+func (fc *FileCache) Stat(filePath string) (stat FileCacheEntryStat, err error) {
+	fce, ok := fc.indexLoad(filePath)
+	if !ok {
+		return stat, os.ErrNotExist
 	}
-	elem := fc.mruList.PushFront(fileName)
-	fc.mruMap[fileName] = elem
+
+	fce.Mutex.Lock()
+	defer fce.Mutex.Unlock()
+	return FileCacheEntryStat{
+		ETag:     fce.ETag,
+		InMemory: fce.InMemory,
+		Meta:     fce.Meta,
+		Size:     fce.Size,
+		Tier:     fc.tiers[fce.tier].Name,
+	}, nil
 }
 
+// Keys returns the cached keys that start with prefix, sorted.
+func (fc *FileCache) Keys(prefix string) []string {
+	var keys []string
+	for _, key := range fc.indexKeys() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Stats returns the accounting. The counts are read one at a time, so they
+// can be off by the writes that land in between.
+func (fc *FileCache) Stats() FileCacheStats {
+	stats := FileCacheStats{
+		RAMBytes:    fc.usedMemoryBytes.Load(),
+		RAMBytesMax: fc.config.RAMBytesMax,
+	}
+	for _, tier := range fc.tiers {
+		tierStats := FileCacheTierStats{
+			Name:         tier.Name,
+			Files:        tier.files.Load(),
+			Bytes:        tier.usedBytes.Load(),
+			LogicalBytes: tier.usedLogicalBytes.Load(),
+			BytesMax:     tier.BytesMax,
+		}
+		stats.Files += tierStats.Files
+		stats.Tiers = append(stats.Tiers, tierStats)
+	}
+	for _, quota := range fc.quotas {
+		stats.Quotas = append(stats.Quotas, FileCacheQuotaStats{
+			Name:     quota.Name,
+			Prefix:   quota.Prefix,
+			Files:    quota.files.Load(),
+			Bytes:    quota.usedBytes.Load(),
+			BytesMax: quota.BytesMax,
+		})
+	}
+	return stats
+}
+
+// Delete drops filePath from the index and removes its file from disk.
+// Deleting a path that is not cached is not an error.
+func (fc *FileCache) Delete(filePath string) error {
+	fce, ok := fc.indexLoad(filePath)
+	if !ok {
+		return nil
+	}
+
+	// lock the entry so a concurrent disk read finishes before we account for it
+	fce.Mutex.Lock()
+	defer fce.Mutex.Unlock()
+	return fc.drop(filePath, fce)
+}
+
+// drop removes a locked entry from the index and its file from disk.
+func (fc *FileCache) drop(filePath string, fce *FileCacheEntry) error {
+	// delete under the shard lock so a scrub never sees the index and the counts disagree
+	shard := fc.shard(filePath)
+	shard.mutex.Lock()
+	if shard.index[filePath] != fce {
+		// someone else dropped it first
+		shard.mutex.Unlock()
+		return nil
+	}
+	delete(shard.index, filePath)
+	if fce.InMemory {
+		fc.accountMemory(filePath, -fce.memSize)
+	}
+	fc.accountDisk(filePath, fce, -1)
+	shard.ram.remove(filePath)
+	shard.tiers[fce.tier].remove(filePath)
+	shard.mutex.Unlock()
+	fc.quotaRemove(filePath)
+	fc.updateCacheMetrics()
+
+	// leave heap Data alone... readers that already hold the entry keep their
+	// bytes. Readers of a mapping hold their own references.
+	fc.unmap(fce)
+	fullPath := fc.filePath(fce.tier, filePath)
+	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cache file %s: %v", fullPath, err)
+	}
+	return nil
+}
+
+// updateCacheMetrics publishes the accounting.
 func (fc *FileCache) updateCacheMetrics() {
-	cacheFiles.Set(float64(fc.mruList.Len()))
-	cacheSizeRAM.Set(float64(fc.usedMemoryBytes))
-	cacheSizeDisk.Set(float64(fc.usedDiskBytes))
+	var files int64
+	for _, tier := range fc.tiers {
+		tierFiles := tier.files.Load()
+		files += tierFiles
+		tier.filesGauge.Set(float64(tierFiles))
+		tier.sizeGauge.Set(float64(tier.usedBytes.Load()))
+		tier.sizeLogicalGauge.Set(float64(tier.usedLogicalBytes.Load()))
+	}
+	cacheFiles.Set(float64(files))
+	cacheSizeRAM.Set(float64(fc.usedMemoryBytes.Load()))
+	fc.updateQuotaMetrics()
 }
 
 func (fc *FileCache) Start() error {
@@ -265,81 +909,157 @@ func (fc *FileCache) Start() error {
 	go func() {
 		for range fc.evictionTicker.C {
 			fc.evictMemory()
-			fc.evictDisk()
+			for t := range fc.tiers {
+				fc.evictDisk(t)
+			}
 		}
 	}()
 
+	if fc.config.ScrubInterval > 0 {
+		go fc.scrubForever()
+	}
+
+	if fc.config.IndexSnapshotInterval > 0 {
+		go fc.snapshotForever()
+	}
+
 	return nil
 }
 
+// evictMemory drops the least recently used data from RAM, taking the oldest
+// of each shard in turn. The files stay on disk.
 func (fc *FileCache) evictMemory() {
-	fc.mutex.Lock()
-	defer fc.mutex.Unlock()
-
 	threshold := (fc.config.RAMBytesMax * 90) / 100
-	for fc.usedMemoryBytes > threshold && fc.mruList.Len() > 0 {
-		oldest := fc.mruList.Back()
-		if oldest == nil {
-			return
-		}
-		fileName := oldest.Value.(string)
-		if entry, ok := fc.index.Load(fileName); ok && entry.InMemory {
-			entry.Mutex.Lock()
-
-			// check entry.InMemory again in case we are racing in this loop
-			if entry.InMemory {
-				entry.Data = nil
-				entry.InMemory = false
-				fc.usedMemoryBytes -= entry.Size
-			}
+	idle := 0
+	for idle < fileCacheShardCount && fc.usedMemoryBytes.Load() > threshold {
+		shard := &fc.shards[fc.evictShard]
+		fc.evictShard = (fc.evictShard + 1) % fileCacheShardCount
+		if fc.evictMemoryShard(shard) {
+			idle = 0
+		} else {
+			idle++
+		}
+	}
+	fc.updateCacheMetrics()
+}
 
-			entry.Mutex.Unlock()
+// evictMemoryShard drops the data of the least recently used key of shard
+// from RAM. It returns false if the shard holds nothing in RAM.
+func (fc *FileCache) evictMemoryShard(shard *fileCacheShard) bool {
+	// pick under the shard lock, but take the entry lock without it
+	shard.mutex.Lock()
+	fileName, ok := shard.ram.oldest(fc.evictable())
+	shard.mutex.Unlock()
+	if !ok {
+		return false
+	}
 
-			evictionRAMCounter.Inc()
-		}
+	entry, ok := fc.indexLoad(fileName)
+	if !ok {
+		shard.mutex.Lock()
+		shard.ram.remove(fileName)
+		shard.mutex.Unlock()
+		return true
+	}
 
-		fc.mruList.Remove(oldest)
+	entry.Mutex.Lock()
+	if cur, ok := fc.indexLoad(fileName); !ok || cur != entry {
+		// replaced or dropped while we waited... its RAM is already accounted for
+		entry.Mutex.Unlock()
+		return true
+	}
+	shard.mutex.Lock()
+	if entry.readers.Load() > 0 {
+		// in use... wait for the readers to finish and look at the next shard
+		shard.ram.touch(fileName)
+		shard.mutex.Unlock()
+		entry.Mutex.Unlock()
+		return false
+	}
+	// check entry.InMemory again in case we are racing in this loop
+	if entry.InMemory {
+		fc.unmap(entry)
+		entry.Data = nil
+		entry.packed = nil
+		entry.InMemory = false
+		fc.accountMemory(fileName, -entry.memSize)
+		evictionRAMCounter.Inc()
+	}
+	shard.ram.remove(fileName)
+	shard.mutex.Unlock()
+	entry.Mutex.Unlock()
+	return true
+}
 
-		delete(fc.mruMap, fileName)
+// evictDisk makes room in tier t by demoting the least recently used file of
+// each shard in turn to the next tier, or by removing it from the cache if t is the slowest.
+func (fc *FileCache) evictDisk(t int) {
+	tier := fc.tiers[t]
+	threshold := (tier.BytesMax * 90) / 100
+	idle := 0
+	for idle < fileCacheShardCount && tier.usedBytes.Load() > threshold {
+		shard := &fc.shards[tier.evictShard]
+		tier.evictShard = (tier.evictShard + 1) % fileCacheShardCount
+		if fc.evictDiskShard(t, shard) {
+			idle = 0
+		} else {
+			idle++
+		}
 	}
+	fc.updateCacheMetrics()
 }
 
-func (fc *FileCache) evictDisk() {
-	fc.mutex.Lock()
-	defer fc.mutex.Unlock()
+// evictDiskShard moves the least recently used file of shard in tier t out of
+// the tier. It returns false if the shard has no files in the tier.
+func (fc *FileCache) evictDiskShard(t int, shard *fileCacheShard) bool {
+	shard.mutex.Lock()
+	fileName, ok := shard.tiers[t].oldest(fc.evictable())
+	shard.mutex.Unlock()
+	if !ok {
+		return false
+	}
 
-	threshold := (fc.config.DiskBytesMax * 90) / 100
-	for fc.usedDiskBytes > threshold && fc.mruList.Len() > 0 {
-		// get the oldest file in the mruList
-		oldest := fc.mruList.Back()
-		if oldest == nil {
-			return
-		}
+	entry, ok := fc.indexLoad(fileName)
+	if !ok {
+		shard.mutex.Lock()
+		shard.tiers[t].remove(fileName)
+		shard.mutex.Unlock()
+		return true
+	}
 
-		// delete the file
-		fileName := oldest.Value.(string)
-		fullPath := filepath.Join(fc.config.DirPath, fileName)
-		if _, err := os.Stat(fullPath); err == nil {
-			if err := os.Remove(fullPath); err != nil {
-				log.Printf("Error removing file: %v", err)
-				continue
-			}
-			evictionDiskCounter.Inc()
-		} else {
-			log.Errorf("could not stat %s: %v", fullPath, err)
-		}
+	entry.Mutex.Lock()
+	defer entry.Mutex.Unlock()
+	if cur, ok := fc.indexLoad(fileName); !ok || cur != entry {
+		// replaced or dropped while we waited... look again
+		return true
+	}
+	if entry.tier != t {
+		// moved while we waited
+		shard.mutex.Lock()
+		shard.tiers[t].remove(fileName)
+		shard.mutex.Unlock()
+		return true
+	}
+	if entry.readers.Load() > 0 {
+		// in use... wait for the readers to finish and look at the next shard
+		shard.mutex.Lock()
+		shard.tiers[t].touch(fileName)
+		shard.mutex.Unlock()
+		return false
+	}
 
-		// get the index entry
-		if entry, ok := fc.index.Load(fileName); ok {
-			if entry.InMemory {
-				fc.usedMemoryBytes -= entry.Size
-			}
-			fc.usedDiskBytes -= entry.Size
-			fc.index.Delete(fileName)
+	if t < len(fc.tiers)-1 {
+		err := fc.demote(fileName, entry)
+		if err == nil {
+			return true
 		}
+		log.Errorf("failed to demote cache file %s: %v", fileName, err)
+	}
 
-		// remove from mru
-		fc.mruList.Remove(oldest)
-		delete(fc.mruMap, fileName)
+	// the slowest tier, or the move failed... out of the cache
+	if err := fc.drop(fileName, entry); err != nil {
+		log.Error(err)
 	}
+	evictionDiskCounter.Inc()
+	return true
 }
@@ -0,0 +1,560 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestFileCache starts a cache with two disk tiers in temp dirs. Eviction
+// only runs when a test calls it.
+func newTestFileCache(t testing.TB, config FileCacheConfig) *FileCache {
+	t.Helper()
+	dir := t.TempDir()
+	config.EvictionTick = time.Hour
+	if config.RAMBytesMax == 0 {
+		config.RAMBytesMax = 1 << 30
+	}
+	if len(config.Tiers) == 0 {
+		config.Tiers = []FileCacheTier{
+			{Name: "fast", DirPath: filepath.Join(dir, "fast"), BytesMax: 1 << 30},
+			{Name: "slow", DirPath: filepath.Join(dir, "slow"), BytesMax: 1 << 30},
+		}
+	}
+	fc := NewFileCache(config)
+	if err := fc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return fc
+}
+
+// cacheTestBody is version v of key: its stamp repeated to size bytes, so a
+// torn or mixed read does not check out.
+func cacheTestBody(key string, v int, size int) []byte {
+	stamp := []byte(key + "@" + strconv.Itoa(v) + "|")
+	return bytes.Repeat(stamp, size/len(stamp)+1)[:size]
+}
+
+// cacheTestCheck returns an error unless body is a whole version of key.
+func cacheTestCheck(key string, body []byte) error {
+	stamp, _, ok := bytes.Cut(body, []byte("|"))
+	if !ok {
+		return fmt.Errorf("%s: no stamp in %d bytes", key, len(body))
+	}
+	name, version, ok := bytes.Cut(stamp, []byte("@"))
+	v, err := strconv.Atoi(string(version))
+	if !ok || err != nil || string(name) != key {
+		return fmt.Errorf("%s: bad stamp %q", key, stamp)
+	}
+	if !bytes.Equal(body, cacheTestBody(key, v, len(body))) {
+		return fmt.Errorf("%s: torn read of version %d, %d bytes", key, v, len(body))
+	}
+	return nil
+}
+
+func cacheTestPut(t testing.TB, fc *FileCache, key string, body []byte) {
+	t.Helper()
+	h, err := fc.Put(key, bytes.NewReader(body), FileCacheMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+}
+
+func cacheTestRead(h *FileCacheEntry) ([]byte, error) {
+	if h.File != nil {
+		return io.ReadAll(h.section())
+	}
+	return bytes.Clone(h.Data), nil
+}
+
+func cacheTestExists(fullPath string) bool {
+	_, err := os.Stat(fullPath)
+	return err == nil
+}
+
+// cacheTestFiles counts the files left in the tiers of fc.
+func cacheTestFiles(t testing.TB, fc *FileCache) int {
+	t.Helper()
+	files := 0
+	for _, tier := range fc.tiers {
+		err := filepath.WalkDir(tier.DirPath, func(filePath string, d fs.DirEntry, err error) error {
+			if err == nil && d.Type().IsRegular() && !fileCacheSnapshotIs(d.Name()) {
+				files++
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+// cacheTestTier names the tier holding key.
+func cacheTestTier(t testing.TB, fc *FileCache, key string) string {
+	t.Helper()
+	stat, err := fc.Stat(key)
+	if err != nil {
+		t.Fatalf("%s is not cached: %v", key, err)
+	}
+	return stat.Tier
+}
+
+func TestFileCacheEvictionSkipsOpenHandles(t *testing.T) {
+	fc := newTestFileCache(t, FileCacheConfig{RAMBytesMax: 1})
+	body := cacheTestBody("a", 1, 4096)
+	cacheTestPut(t, fc, "a", body)
+
+	// every tier is over its limit from here on
+	for _, tier := range fc.tiers {
+		tier.BytesMax = 1
+	}
+
+	h, err := fc.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.evictMemory()
+	fc.evictDisk(0)
+	fc.evictDisk(1)
+	if !cacheTestExists(fc.filePath(0, "a")) || cacheTestTier(t, fc, "a") != "fast" {
+		t.Fatal("eviction moved a file with an open handle")
+	}
+	if stat, _ := fc.Stat("a"); !stat.InMemory {
+		t.Fatal("eviction dropped the data of an entry with an open handle from RAM")
+	}
+	if got, _ := cacheTestRead(h); !bytes.Equal(got, body) {
+		t.Fatal("the data of an open handle changed under eviction")
+	}
+	h.Close()
+
+	// closed... now it goes, one tier at a time
+	fc.evictMemory()
+	fc.evictDisk(0)
+	if cacheTestExists(fc.filePath(0, "a")) || !cacheTestExists(fc.filePath(1, "a")) {
+		t.Fatal("eviction did not demote a file once its handle closed")
+	}
+
+	h, err = fc.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := cacheTestRead(h); !bytes.Equal(got, body) {
+		t.Fatal("a demoted file read back wrong")
+	}
+	// the hit promoted it... hold it and try to push it all the way out
+	fc.evictDisk(0)
+	fc.evictDisk(1)
+	if !fc.Has("a") {
+		t.Fatal("eviction dropped a file with an open handle")
+	}
+	h.Close()
+	fc.evictMemory()
+	fc.evictDisk(0)
+	fc.evictDisk(1)
+	if fc.Has("a") || cacheTestFiles(t, fc) != 0 {
+		t.Fatal("eviction did not drop a file once its handle closed")
+	}
+}
+
+func TestFileCacheMappingOutlivesDelete(t *testing.T) {
+	fc := newTestFileCache(t, FileCacheConfig{RAMMmap: true})
+	body := cacheTestBody("a", 1, 4096)
+	cacheTestPut(t, fc, "a", body)
+
+	h, err := fc.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := h.mapping
+	if m == nil {
+		h.Close()
+		t.Skip("cache files are not mapped here")
+	}
+	if refs := m.refs.Load(); refs != 2 {
+		t.Fatalf("mapping has %d references with the entry and one handle, want 2", refs)
+	}
+
+	// memory eviction leaves it alone while the handle is open
+	fc.config.RAMBytesMax = 1
+	fc.evictMemory()
+	if refs := m.refs.Load(); refs != 2 {
+		t.Fatalf("memory eviction released a mapping with an open handle, %d references left", refs)
+	}
+
+	if err := fc.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if cacheTestExists(fc.filePath(0, "a")) {
+		t.Fatal("Delete left the file")
+	}
+	if refs := m.refs.Load(); refs != 1 {
+		t.Fatalf("mapping has %d references after Delete, want the handle's 1", refs)
+	}
+	if !bytes.Equal(h.Data, body) {
+		t.Fatal("the mapping of an open handle changed after Delete")
+	}
+	h.Close()
+	if refs := m.refs.Load(); refs != 0 {
+		t.Fatalf("mapping has %d references after the last handle closed, want 0", refs)
+	}
+}
+
+func TestFileCacheSendfileOutlivesDemoteAndDelete(t *testing.T) {
+	fc := newTestFileCache(t, FileCacheConfig{SendfileBytesMin: 1024})
+	body := cacheTestBody("a", 1, 4096)
+	cacheTestPut(t, fc, "a", body)
+
+	h, err := fc.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if h.File == nil {
+		t.Fatal("a big disk hit did not return a File")
+	}
+
+	// an open file has no reader count... it moves and goes, and stays readable
+	fc.tiers[0].BytesMax = 1
+	fc.evictDisk(0)
+	if !cacheTestExists(fc.filePath(1, "a")) {
+		t.Fatal("eviction did not demote the file")
+	}
+	if got, err := cacheTestRead(h); err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("an open file read back wrong after demotion: %v", err)
+	}
+
+	if err := fc.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if cacheTestFiles(t, fc) != 0 {
+		t.Fatal("Delete left the file")
+	}
+	if got, err := io.ReadAll(h.Reader()); err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("an open file read back wrong after Delete: %v", err)
+	}
+}
+
+// TestFileCacheConcurrentEviction holds handles while eviction, demotion,
+// promotion, Put and Delete run on the same keys. Run it with -race.
+func TestFileCacheConcurrentEviction(t *testing.T) {
+	configs := map[string]FileCacheConfig{
+		"heap":       {},
+		"compressed": {DiskCompression: FileCompressionGzip, RAMCompressed: true},
+		"mmap":       {RAMMmap: true},
+		"sendfile":   {SendfileBytesMin: 2048},
+	}
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			config.RAMBytesMax = 16 << 10
+			config.Tiers = []FileCacheTier{
+				{Name: "fast", DirPath: filepath.Join(dir, "fast"), BytesMax: 16 << 10},
+				{Name: "slow", DirPath: filepath.Join(dir, "slow"), BytesMax: 48 << 10},
+			}
+			fc := newTestFileCache(t, config)
+			cacheTestConcurrent(t, fc)
+		})
+	}
+}
+
+func cacheTestConcurrent(t *testing.T, fc *FileCache) {
+	const keys = 16
+	const readers = 8
+	duration := 2 * time.Second
+	if testing.Short() {
+		duration = 200 * time.Millisecond
+	}
+
+	key := func(i int) string { return "k/" + strconv.Itoa(i%keys) }
+	size := func(v int) int { return 1024 + (v%4)*1024 }
+	for i := 0; i < keys; i++ {
+		cacheTestPut(t, fc, key(i), cacheTestBody(key(i), 0, size(0)))
+	}
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	errs := make(chan error, readers+2)
+	run := func(fn func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; !stop.Load(); i++ {
+				if err := fn(i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	// readers hold a few handles at a time and check them after the others move
+	for r := 0; r < readers; r++ {
+		r := r
+		run(func(i int) error {
+			held := map[string]*FileCacheEntry{}
+			defer func() {
+				for _, h := range held {
+					h.Close()
+				}
+			}()
+			for j := 0; j < 3; j++ {
+				k := key(r*7 + i*3 + j)
+				if held[k] != nil {
+					continue
+				}
+				h, err := fc.Get(k)
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				} else if err != nil {
+					return err
+				}
+				held[k] = h
+			}
+			time.Sleep(time.Duration(r) * 50 * time.Microsecond)
+			for k, h := range held {
+				body, err := cacheTestRead(h)
+				if err != nil {
+					return err
+				}
+				if int64(len(body)) != h.Size {
+					return fmt.Errorf("read %d bytes of a %d byte entry", len(body), h.Size)
+				}
+				if h.ETag != ETagOf(body) {
+					return fmt.Errorf("ETag %s does not match the %d bytes read", h.ETag, len(body))
+				}
+				if err := cacheTestCheck(k, body); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	// writers replace and delete keys under the readers
+	run(func(i int) error {
+		k := key(i * 5)
+		if i%3 == 0 {
+			return fc.Delete(k)
+		}
+		h, err := fc.Put(k, bytes.NewReader(cacheTestBody(k, i, size(i))), FileCacheMeta{})
+		if err != nil {
+			return err
+		}
+		return h.Close()
+	})
+
+	// one evictor, like the ticker
+	run(func(i int) error {
+		fc.evictMemory()
+		for t := range fc.tiers {
+			fc.evictDisk(t)
+		}
+		return nil
+	})
+
+	time.Sleep(duration)
+	stop.Store(true)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// every handle is closed... nothing holds an entry or a mapping
+	for _, k := range fc.Keys("") {
+		fce, ok := fc.indexLoad(k)
+		if !ok {
+			continue
+		}
+		fce.Mutex.Lock()
+		if readers := fce.readers.Load(); readers != 0 {
+			t.Errorf("%s has %d readers with every handle closed", k, readers)
+		}
+		if fce.mapping != nil && fce.mapping.refs.Load() != 1 {
+			t.Errorf("%s has a mapping with %d references, want the entry's 1", k, fce.mapping.refs.Load())
+		}
+		fce.Mutex.Unlock()
+	}
+
+	// and once every key is deleted no file is left behind
+	for i := 0; i < keys; i++ {
+		if err := fc.Delete(key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files := cacheTestFiles(t, fc); files != 0 {
+		t.Errorf("%d cache files left after every key was deleted", files)
+	}
+	if stats := fc.Stats(); stats.Files != 0 || stats.RAMBytes != 0 {
+		t.Errorf("accounting left %d files and %d RAM bytes after every key was deleted", stats.Files, stats.RAMBytes)
+	}
+}
+
+// cacheBenchKeySets are a few hot keys every goroutine hits and a spread of
+// keys that land on every shard.
+var cacheBenchKeySets = []struct {
+	name string
+	keys int
+}{
+	{"hot", 4},
+	{"spread", 4096},
+}
+
+func cacheBenchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "bench/" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+func BenchmarkFileCacheGet(b *testing.B) {
+	for _, set := range cacheBenchKeySets {
+		b.Run(set.name, func(b *testing.B) {
+			fc := newTestFileCache(b, FileCacheConfig{})
+			keys := cacheBenchKeys(set.keys)
+			body := cacheTestBody("bench", 0, 1024)
+			for _, key := range keys {
+				cacheTestPut(b, fc, key, body)
+			}
+			var next atomic.Int64
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// each goroutine walks the keys from its own offset
+				i := int(next.Add(1)) * 7919
+				for pb.Next() {
+					h, err := fc.Get(keys[i%len(keys)])
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					h.Close()
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkFileCachePut(b *testing.B) {
+	for _, set := range cacheBenchKeySets {
+		b.Run(set.name, func(b *testing.B) {
+			fc := newTestFileCache(b, FileCacheConfig{})
+			keys := cacheBenchKeys(set.keys)
+			body := cacheTestBody("bench", 0, 1024)
+			var next atomic.Int64
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(next.Add(1)) * 7919
+				for pb.Next() {
+					h, err := fc.Put(keys[i%len(keys)], bytes.NewReader(body), FileCacheMeta{})
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					h.Close()
+					i++
+				}
+			})
+		})
+	}
+}
+
+// TestFileCacheQuotaEnforce fills a quota group past its limit and checks
+// the least recently used keys go first, except pinned and open ones.
+func TestFileCacheQuotaEnforce(t *testing.T) {
+	const size = 1000
+	fc := newTestFileCache(t, FileCacheConfig{
+		Pinned: []string{"q/pin*"},
+		Quotas: []FileCacheQuota{{Prefix: "q/", BytesMax: 4 * (size + fileCodecHeaderSize)}},
+	})
+	cacheTestPut(t, fc, "q/pin", cacheTestBody("q/pin", 0, size))
+	cacheTestPut(t, fc, "other", cacheTestBody("other", 0, size))
+	for i := 0; i < 4; i++ {
+		key := "q/" + strconv.Itoa(i)
+		cacheTestPut(t, fc, key, cacheTestBody(key, 0, size))
+	}
+	// pinned q/pin is older, so q/0 made room for q/3
+	if fc.Has("q/0") || !fc.Has("q/pin") {
+		t.Fatalf("q/0 cached %v and q/pin cached %v, want false and true", fc.Has("q/0"), fc.Has("q/pin"))
+	}
+
+	h, err := fc.Get("q/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	for _, key := range []string{"q/2", "q/3"} {
+		touched, err := fc.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		touched.Close()
+	}
+	cacheTestPut(t, fc, "q/4", cacheTestBody("q/4", 0, size))
+	// q/1 is the oldest but open, so q/2 went
+	for key, cached := range map[string]bool{"q/pin": true, "q/1": true, "q/2": false, "q/3": true, "q/4": true, "other": true} {
+		if fc.Has(key) != cached {
+			t.Errorf("%s cached is %v, want %v", key, fc.Has(key), cached)
+		}
+	}
+	quota := fc.quotaOf("q/x")
+	if used := quota.usedBytes.Load(); used > quota.BytesMax {
+		t.Errorf("quota group uses %d bytes of %d", used, quota.BytesMax)
+	}
+}
+
+func TestFileCacheScrubAccounting(t *testing.T) {
+	fc := newTestFileCache(t, FileCacheConfig{})
+	for i := 0; i < 8; i++ {
+		key := "s/" + strconv.Itoa(i)
+		cacheTestPut(t, fc, key, cacheTestBody(key, 0, 1000))
+	}
+	tier := fc.tiers[0]
+	usedBytes := tier.usedBytes.Load()
+
+	// a lost decrement
+	shard := fc.shard("s/0")
+	shard.mutex.Lock()
+	tier.usedBytes.Add(100)
+	shard.account.diskBytes[0] += 100
+	shard.mutex.Unlock()
+	report, err := fc.Scrub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Reconciled || report.DiskBytesDrift != 100 || tier.usedBytes.Load() != usedBytes {
+		t.Fatalf("reconciled %v with drift %d to %d bytes, want true with 100 to %d",
+			report.Reconciled, report.DiskBytesDrift, tier.usedBytes.Load(), usedBytes)
+	}
+
+	// a busy entry leaves its shard for the next scrub but not the others
+	fce, _ := fc.indexLoad("s/0")
+	fce.Mutex.Lock()
+	shard.mutex.Lock()
+	tier.usedBytes.Add(100)
+	shard.account.diskBytes[0] += 100
+	shard.mutex.Unlock()
+	report = &FileCacheFsckReport{}
+	fc.scrubAccounting(report)
+	fce.Mutex.Unlock()
+	if report.Reconciled || report.ReconcileSkipped == "" || report.DiskBytesDrift != 0 {
+		t.Fatalf("reconciled %v, skipped %q, drift %d with s/0 locked", report.Reconciled, report.ReconcileSkipped, report.DiskBytesDrift)
+	}
+	if tier.usedBytes.Load() != usedBytes+100 {
+		t.Fatalf("tier uses %d bytes, want %d left for the next scrub", tier.usedBytes.Load(), usedBytes+100)
+	}
+}
@@ -0,0 +1,457 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// fileCacheTmpAge is how old a temp file must be before a scrub of a running
+// cache treats it as abandoned. Younger ones may belong to a write in flight.
+const fileCacheTmpAge = time.Hour
+
+// A scrub retries a shard whose entries are locked this many times, this long
+// apart, before leaving its accounting alone until the next scrub.
+const (
+	scrubAccountingTries = 5
+	scrubAccountingWait  = 10 * time.Millisecond
+)
+
+var (
+	scrubRuns = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "filecache_scrub_runs_total",
+		Help: "Total number of cache directory checks.",
+	})
+
+	scrubFindings = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filecache_scrub_findings_total",
+		Help: "Total number of problems found by cache directory checks, by kind.",
+	}, []string{"kind"})
+
+	scrubLastRun = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "filecache_scrub_last_run_timestamp_seconds",
+		Help: "Unix time the last cache directory check finished.",
+	})
+
+	scrubDiskBytesDrift = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "filecache_scrub_disk_bytes_drift",
+		Help: "Disk bytes the cache accounted for minus the bytes its index holds, as of the last check.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		scrubDiskBytesDrift,
+		scrubFindings,
+		scrubLastRun,
+		scrubRuns)
+}
+
+// FileCacheFsckReport lists what one check of the cache directory found.
+// Paths are cache keys, or paths relative to their tier for temp files.
+type FileCacheFsckReport struct {
+	Started  time.Time `json:"started"`
+	Seconds  float64   `json:"seconds"`
+	Repair   bool      `json:"repair"`
+	Files    int       `json:"files"`
+	Bytes    int64     `json:"bytes"`
+	Corrupt  []string  `json:"corrupt,omitempty"`  // failed to decode or verify
+	Mismatch []string  `json:"mismatch,omitempty"` // indexed metadata disagrees with the file
+	Missing  []string  `json:"missing,omitempty"`  // indexed with no file
+	Orphans  []string  `json:"orphans,omitempty"`  // a file the index does not know
+	Tmp      []string  `json:"tmp,omitempty"`      // abandoned temp files
+
+	// DiskBytesDrift is the disk accounting minus the bytes the index holds.
+	// Reconciled reports whether the accounting was reset to match the index,
+	// and ReconcileSkipped says why not.
+	DiskBytesDrift   int64  `json:"diskBytesDrift"`
+	Reconciled       bool   `json:"reconciled"`
+	ReconcileSkipped string `json:"reconcileSkipped,omitempty"`
+}
+
+// Findings counts the problems in the report.
+func (r *FileCacheFsckReport) Findings() int {
+	return len(r.Corrupt) + len(r.Mismatch) + len(r.Missing) + len(r.Orphans) + len(r.Tmp)
+}
+
+func (r *FileCacheFsckReport) done() {
+	r.Seconds = time.Since(r.Started).Seconds()
+
+	scrubRuns.Inc()
+	scrubFindings.WithLabelValues("corrupt").Add(float64(len(r.Corrupt)))
+	scrubFindings.WithLabelValues("mismatch").Add(float64(len(r.Mismatch)))
+	scrubFindings.WithLabelValues("missing").Add(float64(len(r.Missing)))
+	scrubFindings.WithLabelValues("orphan").Add(float64(len(r.Orphans)))
+	scrubFindings.WithLabelValues("tmp").Add(float64(len(r.Tmp)))
+	scrubDiskBytesDrift.Set(float64(r.DiskBytesDrift))
+	scrubLastRun.Set(float64(time.Now().Unix()))
+}
+
+// fileCacheWalk calls fileFn for every file under dirPath with its cache key.
+// It doesn't stat the files, so it is cheap on big caches.
+func fileCacheWalk(dirPath string, fileFn func(key string, fullPath string, d fs.DirEntry) error) error {
+	return filepath.WalkDir(dirPath, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// only regular files... a symlink could serve something outside the tier
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		key, err := filepath.Rel(dirPath, fullPath)
+		if err != nil {
+			return err
+		}
+		key = filepath.ToSlash(key)
+		if fileCacheSnapshotIs(key) {
+			return nil
+		}
+		return fileFn(key, fullPath, d)
+	})
+}
+
+// verify reads a cache file and decodes it, which checks its size and checksum.
+func (c *fileCodec) verify(name string, fullPath string) (size int64, sum []byte, diskSize int64, err error) {
+	raw, err := os.ReadFile(fullPath)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	if _, _, err := c.decode(name, raw); err != nil {
+		return 0, nil, 0, err
+	}
+	size, sum, err = c.headerRead(raw)
+	return size, sum, int64(len(raw)), err
+}
+
+// FileCacheFsck checks the tiers of a cache that is not running. Every file
+// must decode and match its checksum, and a key may only have one file. With
+// repair, it removes corrupt files, extra copies and leftover temp files.
+func FileCacheFsck(config FileCacheConfig, repair bool) (*FileCacheFsckReport, error) {
+	codec, err := newFileCodec(config.DiskCompression, config.DiskKey)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &FileCacheFsckReport{Started: time.Now(), Repair: repair}
+	remove := func(fullPath string) error {
+		if !repair {
+			return nil
+		}
+		if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", fullPath, err)
+		}
+		return nil
+	}
+
+	// the fastest copy of a key wins, as it does at startup
+	seen := make(map[string]bool)
+	tiers := config.tiers()
+	for _, tier := range tiers {
+		err = fileCacheWalk(tier.DirPath, func(key string, fullPath string, _ fs.DirEntry) error {
+			if FileIsTmp(fullPath) {
+				report.Tmp = append(report.Tmp, key)
+				return remove(fullPath)
+			}
+			if seen[key] {
+				report.Orphans = append(report.Orphans, key)
+				return remove(fullPath)
+			}
+
+			report.Files++
+			_, _, diskSize, err := codec.verify(key, fullPath)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				log.Warnf("cache file %s: %v", fullPath, err)
+				report.Corrupt = append(report.Corrupt, key)
+				return remove(fullPath)
+			}
+			seen[key] = true
+			report.Bytes += diskSize
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to check cache folder %s: %v", tier.DirPath, err)
+		}
+	}
+
+	// the snapshot may list what we removed... make the next start scan
+	if repair && report.Findings() > 0 {
+		if err := os.Remove(filepath.Join(tiers[0].DirPath, fileCacheSnapshotName)); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove the cache index snapshot: %v", err)
+		}
+	}
+
+	report.done()
+	return report, nil
+}
+
+// Scrub checks a running cache against its tiers and repairs what it finds:
+// corrupt files, entries whose metadata disagrees with their file or that have
+// no file, files the index does not know or places on another tier, and
+// abandoned temp files.
+// Bad entries are dropped so the next read refetches them. It then resets the
+// disk accounting to what the index holds.
+func (fc *FileCache) Scrub() (*FileCacheFsckReport, error) {
+	report := &FileCacheFsckReport{Started: time.Now(), Repair: true}
+
+	seen := make(map[string]bool)
+	for t, tier := range fc.tiers {
+		err := fileCacheWalk(tier.DirPath, func(key string, fullPath string, d fs.DirEntry) error {
+			if FileIsTmp(fullPath) {
+				if info, err := d.Info(); err != nil || time.Since(info.ModTime()) < fileCacheTmpAge {
+					return nil
+				}
+				if err := os.Remove(fullPath); err == nil {
+					report.Tmp = append(report.Tmp, key)
+				}
+				return nil
+			}
+
+			seen[key] = true
+			report.Files++
+			return fc.scrubFile(report, t, key, fullPath)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scrub cache folder %s: %v", tier.DirPath, err)
+		}
+	}
+
+	// entries the walk didn't find a file for
+	for _, key := range fc.indexKeys() {
+		if seen[key] {
+			continue
+		}
+		if err := fc.scrubMissing(report, key); err != nil {
+			return nil, err
+		}
+	}
+
+	fc.scrubAccounting(report)
+	report.done()
+	fc.scrubReport.Store(report)
+	return report, nil
+}
+
+// ScrubReport returns the report of the last scrub, or nil before the first one.
+func (fc *FileCache) ScrubReport() *FileCacheFsckReport {
+	return fc.scrubReport.Load()
+}
+
+// scrubFile verifies the file for key on tier t against its entry.
+func (fc *FileCache) scrubFile(report *FileCacheFsckReport, t int, key string, fullPath string) error {
+	// claim unknown files with a locked entry so a Put for the key waits for the removal
+	claim := &FileCacheEntry{}
+	claim.Mutex.Lock()
+	fce, loaded := fc.indexLoadOrStore(key, claim)
+	if !loaded {
+		err := os.Remove(fullPath)
+		fc.indexDelete(key, claim)
+		claim.Mutex.Unlock()
+		if err == nil {
+			report.Orphans = append(report.Orphans, key)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove orphan %s: %v", fullPath, err)
+		}
+		return nil
+	}
+	claim.Mutex.Unlock()
+
+	fce.Mutex.Lock()
+	defer fce.Mutex.Unlock()
+	if cur, ok := fc.indexLoad(key); !ok || cur != fce {
+		// dropped while we waited for the lock
+		return nil
+	}
+	if fce.tier != t {
+		// a copy left behind by an interrupted move
+		err := os.Remove(fullPath)
+		if err == nil {
+			report.Orphans = append(report.Orphans, key)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stray copy %s: %v", fullPath, err)
+		}
+		return nil
+	}
+
+	size, sum, diskSize, err := fc.codec.verify(key, fullPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// evicted while we waited for the lock
+		return nil
+	case err != nil:
+		log.Errorf("dropping cache file %s: %v", key, err)
+		cacheCorruptions.Inc()
+		report.Corrupt = append(report.Corrupt, key)
+		return fc.drop(key, fce)
+	case size != fce.Size || diskSize != fce.diskSize || !bytes.Equal(sum, fce.Meta.SHA256):
+		log.Errorf("dropping cache file %s: index does not match the file", key)
+		report.Mismatch = append(report.Mismatch, key)
+		return fc.drop(key, fce)
+	}
+
+	report.Bytes += diskSize
+	return nil
+}
+
+// scrubMissing drops the entry for key if its file is gone.
+func (fc *FileCache) scrubMissing(report *FileCacheFsckReport, key string) error {
+	fce, ok := fc.indexLoad(key)
+	if !ok {
+		return nil
+	}
+
+	fce.Mutex.Lock()
+	defer fce.Mutex.Unlock()
+	if cur, ok := fc.indexLoad(key); !ok || cur != fce {
+		return nil
+	}
+
+	if _, err := os.Stat(fc.filePath(fce.tier, key)); !errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	log.Errorf("dropping cache entry %s: file is missing", key)
+	report.Missing = append(report.Missing, key)
+	return fc.drop(key, fce)
+}
+
+// scrubAccounting resets the byte counts to the sums over the index, one shard
+// at a time. Writers change an entry and then the counts while holding the entry
+// lock, so a shard's sums are only trusted if none of its entries is locked.
+// Shards that stay busy keep their counts until the next scrub.
+func (fc *FileCache) scrubAccounting(report *FileCacheFsckReport) {
+	drift := newFileCacheAccount(len(fc.tiers))
+	busy := 0
+	for i := range fc.shards {
+		if !fc.scrubAccountingShard(&fc.shards[i], &drift) {
+			busy++
+		}
+	}
+
+	for t, tier := range fc.tiers {
+		report.DiskBytesDrift += drift.diskBytes[t]
+		if drift.files[t] != 0 || drift.diskBytes[t] != 0 || drift.logicalBytes[t] != 0 {
+			log.Warnf("cache accounting for tier %s drifted: files %+d, disk %+d, logical %+d",
+				tier.Name, drift.files[t], drift.diskBytes[t], drift.logicalBytes[t])
+		}
+	}
+	for _, quota := range fc.quotas {
+		if drift.quotaFiles[quota] != 0 || drift.quotaBytes[quota] != 0 {
+			log.Warnf("cache accounting for quota %s drifted: files %+d, bytes %+d",
+				quota.Name, drift.quotaFiles[quota], drift.quotaBytes[quota])
+		}
+	}
+	if drift.memoryBytes != 0 {
+		log.Warnf("cache accounting for RAM drifted: %+d", drift.memoryBytes)
+	}
+	fc.updateCacheMetrics()
+
+	if busy > 0 {
+		report.ReconcileSkipped = fmt.Sprintf("%d of %d shards had entries locked", busy, len(fc.shards))
+		return
+	}
+	report.Reconciled = true
+}
+
+// scrubAccountingShard resets the counts of shard to the sums over its index,
+// adding what they were off by to drift. It returns false if some entry stayed
+// locked through every try.
+func (fc *FileCache) scrubAccountingShard(shard *fileCacheShard, drift *fileCacheAccount) bool {
+	for try := 0; try < scrubAccountingTries; try++ {
+		if try > 0 {
+			time.Sleep(scrubAccountingWait)
+		}
+
+		shard.mutex.Lock()
+		sum, ok := fc.scrubAccountingSum(shard)
+		if ok {
+			fc.scrubAccountingApply(shard, sum, drift)
+		}
+		shard.mutex.Unlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// scrubAccountingSum sums the index of shard, or returns false if one of its
+// entries is locked. Call with the shard lock held.
+func (fc *FileCache) scrubAccountingSum(shard *fileCacheShard) (fileCacheAccount, bool) {
+	sum := newFileCacheAccount(len(fc.tiers))
+	for key, fce := range shard.index {
+		if !fce.Mutex.TryLock() {
+			return sum, false
+		}
+		sum.files[fce.tier]++
+		sum.diskBytes[fce.tier] += fce.diskSize
+		sum.logicalBytes[fce.tier] += fce.Size
+		if quota := fc.quotaOf(key); quota != nil {
+			sum.quotaFiles[quota]++
+			sum.quotaBytes[quota] += fce.diskSize
+		}
+		if fce.InMemory {
+			sum.memoryBytes += fce.memSize
+		}
+		fce.Mutex.Unlock()
+	}
+	return sum, true
+}
+
+// scrubAccountingApply moves the counts of shard, and the cache-wide counts
+// with them, to sum. Call with the shard lock held.
+func (fc *FileCache) scrubAccountingApply(shard *fileCacheShard, sum fileCacheAccount, drift *fileCacheAccount) {
+	account := &shard.account
+	for t, tier := range fc.tiers {
+		files := account.files[t] - sum.files[t]
+		diskBytes := account.diskBytes[t] - sum.diskBytes[t]
+		logicalBytes := account.logicalBytes[t] - sum.logicalBytes[t]
+		tier.files.Add(-files)
+		tier.usedBytes.Add(-diskBytes)
+		tier.usedLogicalBytes.Add(-logicalBytes)
+		drift.files[t] += files
+		drift.diskBytes[t] += diskBytes
+		drift.logicalBytes[t] += logicalBytes
+	}
+	for _, quota := range fc.quotas {
+		files := account.quotaFiles[quota] - sum.quotaFiles[quota]
+		quotaBytes := account.quotaBytes[quota] - sum.quotaBytes[quota]
+		quota.files.Add(-files)
+		quota.usedBytes.Add(-quotaBytes)
+		drift.quotaFiles[quota] += files
+		drift.quotaBytes[quota] += quotaBytes
+	}
+	memoryBytes := account.memoryBytes - sum.memoryBytes
+	fc.usedMemoryBytes.Add(-memoryBytes)
+	drift.memoryBytes += memoryBytes
+
+	shard.account = sum
+}
+
+// scrubForever scrubs the cache every ScrubInterval.
+func (fc *FileCache) scrubForever() {
+	for range time.Tick(fc.config.ScrubInterval) {
+		report, err := fc.Scrub()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		reportJSON, _ := json.Marshal(report)
+		if report.Findings() > 0 {
+			log.Warnf("cache scrub repaired problems: %s", reportJSON)
+		} else {
+			log.Infof("cache scrub: %s", reportJSON)
+		}
+	}
+}
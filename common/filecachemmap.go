@@ -0,0 +1,70 @@
+package common
+
+import (
+	"sync/atomic"
+)
+
+// fileCacheMapping is a cache file mapped into memory. The entry holding it
+// in RAM and every handle on the entry hold a reference, and the last
+// release unmaps it, so eviction never pulls the pages out from under a reader.
+// Files are replaced by rename and removed by unlink, so a mapping stays
+// valid while its file moves between tiers or leaves the cache.
+type fileCacheMapping struct {
+	data []byte
+	refs atomic.Int64
+}
+
+// fileCacheMap maps the file at fullPath with one reference for the caller.
+func fileCacheMap(fullPath string) (*fileCacheMapping, error) {
+	data, err := fileMmap(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	m := &fileCacheMapping{data: data}
+	m.refs.Store(1)
+	return m, nil
+}
+
+func (m *fileCacheMapping) acquire() {
+	m.refs.Add(1)
+}
+
+func (m *fileCacheMapping) release() {
+	if m.refs.Add(-1) == 0 {
+		fileMunmap(m.data)
+	}
+}
+
+// holdMapping keeps a locked entry in RAM as the mapping of its plain file,
+// taking over the caller's reference.
+func (fc *FileCache) holdMapping(fce *FileCacheEntry, m *fileCacheMapping) {
+	fce.Data = m.data[fileCodecHeaderSize:]
+	fce.InMemory = true
+	fce.mapping = m
+	fce.memSize = int64(len(m.data))
+	fce.packed = nil
+}
+
+// unmap drops the reference of a locked entry to its mapping. Handles given
+// out earlier keep the pages until they are closed.
+func (fc *FileCache) unmap(fce *FileCacheEntry) {
+	if fce.mapping == nil {
+		return
+	}
+	fce.mapping.release()
+	fce.mapping = nil
+	fce.Data = nil
+	fce.InMemory = false
+}
+
+// mapPut maps a file Put just wrote when RAMMmap is on and the file is plain.
+func (fc *FileCache) mapPut(fullPath string) *fileCacheMapping {
+	if !fc.config.RAMMmap || !fc.codec.plain() {
+		return nil
+	}
+	m, err := fileCacheMap(fullPath)
+	if err != nil {
+		return nil
+	}
+	return m
+}
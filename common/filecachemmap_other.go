@@ -0,0 +1,16 @@
+//go:build !unix
+
+package common
+
+import (
+	"errors"
+)
+
+// fileMmap is not supported here, so cache files are always read into the heap.
+func fileMmap(fullPath string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func fileMunmap(data []byte) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package common
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileMmap maps the file at fullPath read-only.
+func fileMmap(fullPath string) ([]byte, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func fileMunmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,208 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// FileCacheQuota caps the disk bytes of the keys under Prefix. When a Put
+// takes the group over BytesMax, its least recently used keys leave the cache.
+type FileCacheQuota struct {
+	Name     string // metrics label, Prefix if empty
+	Prefix   string
+	BytesMax int64 // physical bytes, over all tiers
+}
+
+var (
+	quotaFiles = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "filecache_quota_files",
+		Help: "Current number of files in the cache, by quota group.",
+	}, []string{"group"})
+
+	quotaSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "filecache_quota_size_bytes",
+		Help: "Current size of the cache on disk (bytes), by quota group.",
+	}, []string{"group"})
+
+	quotaSizeMax = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "filecache_quota_size_max_bytes",
+		Help: "Size limit of the cache on disk (bytes), by quota group.",
+	}, []string{"group"})
+
+	quotaEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filecache_quota_evictions_total",
+		Help: "Total number of files removed from the cache to keep a quota group under its limit.",
+	}, []string{"group"})
+
+	quotaRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filecache_quota_rejections_total",
+		Help: "Total number of writes not cached because they alone exceed their quota group's limit.",
+	}, []string{"group"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		quotaEvictions,
+		quotaFiles,
+		quotaRejections,
+		quotaSize,
+		quotaSizeMax)
+}
+
+// quotaEnforce reads this many victims per turn of the quota lock
+const quotaEnforceBatch = 64
+
+// fileCacheQuota is a quota group with its accounting and recency order.
+type fileCacheQuota struct {
+	FileCacheQuota
+	files     atomic.Int64
+	usedBytes atomic.Int64
+
+	mutex sync.Mutex // guards lru
+	lru   *fileCacheLRU
+
+	filesGauge prometheus.Gauge
+	sizeGauge  prometheus.Gauge
+}
+
+// policyInit checks the pin patterns and sets up the quota groups.
+func (fc *FileCache) policyInit() error {
+	for _, pattern := range fc.config.Pinned {
+		if !doublestar.ValidatePattern(pattern) {
+			return fmt.Errorf("invalid pinned pattern: %s", pattern)
+		}
+	}
+	for _, quota := range fc.config.Quotas {
+		if quota.Name == "" {
+			quota.Name = quota.Prefix
+		}
+		if quota.BytesMax <= 0 {
+			return fmt.Errorf("quota %s has no byte limit", quota.Name)
+		}
+		fc.quotas = append(fc.quotas, &fileCacheQuota{
+			FileCacheQuota: quota,
+			lru:            newFileCacheLRU(),
+			filesGauge:     quotaFiles.WithLabelValues(quota.Name),
+			sizeGauge:      quotaSize.WithLabelValues(quota.Name),
+		})
+		quotaSizeMax.WithLabelValues(quota.Name).Set(float64(quota.BytesMax))
+	}
+	return nil
+}
+
+// evictable returns the filter eviction passes to fileCacheLRU.oldest, or nil when nothing is pinned.
+func (fc *FileCache) evictable() func(key string) bool {
+	if len(fc.config.Pinned) == 0 {
+		return nil
+	}
+	return func(key string) bool { return !fc.pinned(key) }
+}
+
+// pinned reports whether key matches a Pinned pattern, which keeps it from eviction.
+func (fc *FileCache) pinned(key string) bool {
+	for _, pattern := range fc.config.Pinned {
+		if match, _ := doublestar.Match(pattern, key); match {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaOf returns the quota group of key, the one with the longest matching prefix, or nil.
+func (fc *FileCache) quotaOf(key string) *fileCacheQuota {
+	var found *fileCacheQuota
+	for _, quota := range fc.quotas {
+		if strings.HasPrefix(key, quota.Prefix) && (found == nil || len(quota.Prefix) > len(found.Prefix)) {
+			found = quota
+		}
+	}
+	return found
+}
+
+// quotaTouch marks key as just used in its quota group.
+func (fc *FileCache) quotaTouch(key string) {
+	if quota := fc.quotaOf(key); quota != nil {
+		quota.mutex.Lock()
+		quota.lru.touch(key)
+		quota.mutex.Unlock()
+	}
+}
+
+func (fc *FileCache) quotaRemove(key string) {
+	if quota := fc.quotaOf(key); quota != nil {
+		quota.mutex.Lock()
+		quota.lru.remove(key)
+		quota.mutex.Unlock()
+	}
+}
+
+// quotaFits reports whether a file of diskSize bytes for key fits its quota group at all.
+func (fc *FileCache) quotaFits(key string, diskSize int64) bool {
+	quota := fc.quotaOf(key)
+	if quota == nil || diskSize <= quota.BytesMax {
+		return true
+	}
+	quotaRejections.WithLabelValues(quota.Name).Inc()
+	return false
+}
+
+// quotaEnforce removes the least recently used keys of the quota group of
+// key until the group is under its limit. Pinned keys and keys with open
+// handles stay. Call without entry locks held.
+func (fc *FileCache) quotaEnforce(key string) {
+	quota := fc.quotaOf(key)
+	if quota == nil || quota.usedBytes.Load() <= quota.BytesMax {
+		return
+	}
+
+	// every key gets one look per call... the rest may be pinned or busy.
+	// Victims are read from the tail a batch at a time, since entry locks
+	// can't be taken under the quota lock.
+	kept := map[string]bool{}
+	skip := func(key string) bool { return kept[key] }
+	for quota.usedBytes.Load() > quota.BytesMax {
+		quota.mutex.Lock()
+		victims := quota.lru.oldestN(quotaEnforceBatch, skip)
+		quota.mutex.Unlock()
+		if len(victims) == 0 {
+			break
+		}
+		for _, victim := range victims {
+			if quota.usedBytes.Load() <= quota.BytesMax {
+				break
+			}
+			kept[victim] = true
+			if fc.pinned(victim) {
+				continue
+			}
+			fce, ok := fc.indexLoad(victim)
+			if !ok {
+				continue
+			}
+
+			fce.Mutex.Lock()
+			if fce.readers.Load() == 0 && fce.Meta.SHA256 != nil {
+				if err := fc.drop(victim, fce); err != nil {
+					log.Error(err)
+				}
+				quotaEvictions.WithLabelValues(quota.Name).Inc()
+			}
+			fce.Mutex.Unlock()
+		}
+	}
+	fc.updateCacheMetrics()
+}
+
+// updateQuotaMetrics publishes the accounting of the quota groups.
+func (fc *FileCache) updateQuotaMetrics() {
+	for _, quota := range fc.quotas {
+		quota.filesGauge.Set(float64(quota.files.Load()))
+		quota.sizeGauge.Set(float64(quota.usedBytes.Load()))
+	}
+}
@@ -0,0 +1,144 @@
+package common
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SendfileUses reports whether disk hits of size bytes are streamed from an
+// open file rather than loaded into RAM.
+func (fc *FileCache) SendfileUses(size int64) bool {
+	return fc.config.SendfileBytesMin > 0 && size >= fc.config.SendfileBytesMin
+}
+
+// getFile opens the file of a locked entry for a caller that streams it. It
+// returns nil without an error if the file is compressed or encrypted and must
+// be loaded instead. The header is checked against the entry, but the data is
+// only verified by the scrubber.
+func (fc *FileCache) getFile(key string, fce *FileCacheEntry) (*FileCacheEntry, error) {
+	f, err := os.Open(fc.filePath(fce.tier, key))
+	if errors.Is(err, os.ErrNotExist) {
+		// gone since it was indexed... drop it so the caller refetches
+		if err := fc.drop(key, fce); err != nil {
+			log.Error(err)
+		}
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, fileCodecHeaderSize)
+	_, err = io.ReadFull(f, head)
+	var size int64
+	var sum []byte
+	if err == nil {
+		size, sum, err = fc.codec.headerRead(head)
+	}
+	if err == nil && !fc.codec.headerPlain(head) {
+		f.Close()
+		return nil, nil
+	}
+	if err != nil || size != fce.Size || (fce.Meta.SHA256 != nil && !bytes.Equal(sum, fce.Meta.SHA256)) {
+		f.Close()
+		log.Errorf("dropping cache file %s: index does not match the file", key)
+		if err := fc.drop(key, fce); err != nil {
+			log.Error(err)
+		}
+		return nil, os.ErrNotExist
+	}
+
+	// a hit on a slower tier moves the file up to the fastest... f stays readable
+	if fce.tier > 0 {
+		if err := fc.promote(key, fce, nil); err != nil {
+			log.Errorf("failed to promote cache file %s: %v", key, err)
+		}
+	}
+
+	// no reader count... an open file outlives its eviction until it is closed
+	h := &FileCacheEntry{
+		ETag:       fce.ETag,
+		File:       f,
+		Meta:       fce.Meta,
+		Size:       fce.Size,
+		fileOffset: fileCodecHeaderSize,
+	}
+	if fce.ETag == "" {
+		hash := md5.New()
+		if _, err := io.Copy(hash, h.section()); err != nil {
+			h.Close()
+			return nil, err
+		}
+		fce.ETag = ETagFromMD5(hash.Sum(nil))
+		h.ETag = fce.ETag
+	}
+
+	shard := fc.shard(key)
+	shard.mutex.Lock()
+	shard.touch(key, fce)
+	shard.mutex.Unlock()
+	fc.quotaTouch(key)
+	return h, nil
+}
+
+// section reads the data of a File entry without moving the offset of File.
+func (fce *FileCacheEntry) section() *io.SectionReader {
+	return io.NewSectionReader(fce.File, fce.fileOffset, fce.Size)
+}
+
+// Head returns up to n bytes from the start of the data, for sniffing.
+func (fce *FileCacheEntry) Head(n int) []byte {
+	if fce.File == nil {
+		return fce.Data[:min(len(fce.Data), n)]
+	}
+	head := make([]byte, min(fce.Size, int64(n)))
+	read, _ := fce.section().ReadAt(head, 0)
+	return head[:read]
+}
+
+// Bytes returns the data, reading it from File when the entry has no Data.
+func (fce *FileCacheEntry) Bytes() ([]byte, error) {
+	if fce.File == nil {
+		return fce.Data, nil
+	}
+	return io.ReadAll(fce.section())
+}
+
+// Close releases a handle from Get or Put, closing File or the mapping it holds.
+func (fce *FileCacheEntry) Close() error {
+	if fce.src != nil {
+		fce.src.readers.Add(-1)
+		fce.src = nil
+	}
+	if fce.mapping != nil {
+		fce.mapping.release()
+		fce.mapping = nil
+		fce.Data = nil
+	}
+	if fce.File == nil {
+		return nil
+	}
+	return fce.File.Close()
+}
+
+// Reader returns File, or a reader over Data that closes the entry when it is closed.
+func (fce *FileCacheEntry) Reader() io.ReadCloser {
+	if fce.File != nil {
+		return fce.File
+	}
+	return fileCacheEntryReader{Reader: bytes.NewReader(fce.Data), fce: fce}
+}
+
+type fileCacheEntryReader struct {
+	*bytes.Reader
+	fce *FileCacheEntry
+}
+
+func (r fileCacheEntryReader) Close() error {
+	return r.fce.Close()
+}
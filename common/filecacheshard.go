@@ -0,0 +1,183 @@
+package common
+
+import (
+	"container/list"
+	"sync"
+)
+
+// fileCacheShardCount is the number of shards keys are hashed over. A power of two.
+const fileCacheShardCount = 64
+
+// fileCacheShard holds the index entries and the recency of the keys that
+// hash to it, so hits on different keys rarely wait on each other. Take its
+// lock after the entry lock.
+type fileCacheShard struct {
+	mutex sync.Mutex
+	index map[string]*FileCacheEntry
+	ram   *fileCacheLRU
+	tiers []*fileCacheLRU // by disk tier
+
+	// this shard's share of the cache-wide counts, so a scrub can check
+	// them one shard at a time
+	account fileCacheAccount
+
+	_ [16]byte // keep shards on their own cache lines
+}
+
+// fileCacheAccount holds byte and file counts like the ones of FileCache,
+// its tiers and quota groups, for the keys of one shard.
+type fileCacheAccount struct {
+	files        []int64 // by tier
+	diskBytes    []int64 // by tier
+	logicalBytes []int64 // by tier
+	memoryBytes  int64
+	quotaFiles   map[*fileCacheQuota]int64
+	quotaBytes   map[*fileCacheQuota]int64
+}
+
+func newFileCacheAccount(tiers int) fileCacheAccount {
+	return fileCacheAccount{
+		files:        make([]int64, tiers),
+		diskBytes:    make([]int64, tiers),
+		logicalBytes: make([]int64, tiers),
+		quotaFiles:   make(map[*fileCacheQuota]int64),
+		quotaBytes:   make(map[*fileCacheQuota]int64),
+	}
+}
+
+// shard returns the shard of key, by FNV-1a.
+func (fc *FileCache) shard(key string) *fileCacheShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &fc.shards[h&(fileCacheShardCount-1)]
+}
+
+func (fc *FileCache) indexLoad(key string) (*FileCacheEntry, bool) {
+	shard := fc.shard(key)
+	shard.mutex.Lock()
+	fce, ok := shard.index[key]
+	shard.mutex.Unlock()
+	return fce, ok
+}
+
+// indexLoadOrStore returns the entry for key, or stores fce if there is none.
+// loaded reports whether the entry was already there.
+func (fc *FileCache) indexLoadOrStore(key string, fce *FileCacheEntry) (actual *FileCacheEntry, loaded bool) {
+	shard := fc.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if actual, loaded = shard.index[key]; loaded {
+		return actual, true
+	}
+	shard.index[key] = fce
+	return fce, false
+}
+
+func (fc *FileCache) indexStore(key string, fce *FileCacheEntry) {
+	shard := fc.shard(key)
+	shard.mutex.Lock()
+	shard.index[key] = fce
+	shard.mutex.Unlock()
+}
+
+// indexDelete removes key if it is still indexed as fce. It does no
+// accounting, so it is only for entries that were never filled.
+func (fc *FileCache) indexDelete(key string, fce *FileCacheEntry) {
+	shard := fc.shard(key)
+	shard.mutex.Lock()
+	if shard.index[key] == fce {
+		delete(shard.index, key)
+	}
+	shard.mutex.Unlock()
+}
+
+// indexKeys returns the indexed keys, shard by shard.
+func (fc *FileCache) indexKeys() []string {
+	var keys []string
+	for i := range fc.shards {
+		shard := &fc.shards[i]
+		shard.mutex.Lock()
+		for key := range shard.index {
+			keys = append(keys, key)
+		}
+		shard.mutex.Unlock()
+	}
+	return keys
+}
+
+// touch marks key as just used in RAM, if it is held there, and in its disk tier.
+// Callers hold the shard lock and the entry lock.
+func (shard *fileCacheShard) touch(key string, fce *FileCacheEntry) {
+	if fce.InMemory {
+		shard.ram.touch(key)
+	}
+	shard.tiers[fce.tier].touch(key)
+}
+
+// fileCacheLRU orders keys by recency, most recent first. Callers hold the shard lock.
+type fileCacheLRU struct {
+	list  *list.List
+	elems map[string]*list.Element
+}
+
+func newFileCacheLRU() *fileCacheLRU {
+	return &fileCacheLRU{list: list.New(), elems: make(map[string]*list.Element)}
+}
+
+// touch moves key to the front, adding it if needed.
+func (l *fileCacheLRU) touch(key string) {
+	if elem, exists := l.elems[key]; exists {
+		l.list.MoveToFront(elem)
+		return
+	}
+	l.elems[key] = l.list.PushFront(key)
+}
+
+// append adds key at the back, for loading keys that are already in recency order.
+func (l *fileCacheLRU) append(key string) {
+	if _, exists := l.elems[key]; !exists {
+		l.elems[key] = l.list.PushBack(key)
+	}
+}
+
+func (l *fileCacheLRU) remove(key string) {
+	if elem, exists := l.elems[key]; exists {
+		l.list.Remove(elem)
+		delete(l.elems, key)
+	}
+}
+
+// oldest returns the least recently used key that passes filter, or that is
+// the least recently used key when filter is nil.
+func (l *fileCacheLRU) oldest(filter func(key string) bool) (string, bool) {
+	for elem := l.list.Back(); elem != nil; elem = elem.Prev() {
+		if key := elem.Value.(string); filter == nil || filter(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// oldestN returns up to n of the least recently used keys that skip does
+// not pass over, least recent first.
+func (l *fileCacheLRU) oldestN(n int, skip func(key string) bool) []string {
+	var keys []string
+	for elem := l.list.Back(); elem != nil && len(keys) < n; elem = elem.Prev() {
+		if key := elem.Value.(string); !skip(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// keys returns the keys, most recent first.
+func (l *fileCacheLRU) keys() []string {
+	keys := make([]string, 0, l.list.Len())
+	for elem := l.list.Front(); elem != nil; elem = elem.Next() {
+		keys = append(keys, elem.Value.(string))
+	}
+	return keys
+}
@@ -0,0 +1,318 @@
+package common
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// fileCacheSnapshotName is the index snapshot at the top of the fastest tier. Walks of the tiers skip it.
+const fileCacheSnapshotName = ".edgie-index"
+
+const (
+	fileCacheSnapshotVersion = 2
+
+	// a loaded snapshot is checked against this many files picked at random
+	fileCacheSnapshotSample = 64
+	// and thrown away if more than this share of them are gone
+	fileCacheSnapshotMissingMax = 0.1
+)
+
+// fileCacheSnapshot is the index as it is written to disk, fastest tier
+// first and then shard by shard, most recent entry first within a shard.
+type fileCacheSnapshot struct {
+	Version     int
+	Time        time.Time
+	Compression string
+	Encrypted   bool
+	Tiers       []string
+	Entries     []fileCacheSnapshotEntry
+}
+
+type fileCacheSnapshotEntry struct {
+	Key         string
+	ContentType string
+	DiskSize    int64
+	ETag        string
+	SHA256      []byte
+	Size        int64
+	Tier        int
+}
+
+func (fc *FileCache) snapshotPath() string {
+	return filepath.Join(fc.tiers[0].DirPath, fileCacheSnapshotName)
+}
+
+// snapshotTiers identifies the tier layout a snapshot was taken with.
+func (fc *FileCache) snapshotTiers() []string {
+	var tiers []string
+	for _, tier := range fc.tiers {
+		tiers = append(tiers, tier.Name+"="+tier.DirPath)
+	}
+	return tiers
+}
+
+// SnapshotWrite saves the index and its recency order so the next start can skip the full scan.
+func (fc *FileCache) SnapshotWrite() error {
+	snapshot := fileCacheSnapshot{
+		Version:     fileCacheSnapshotVersion,
+		Time:        time.Now(),
+		Compression: fc.config.DiskCompression,
+		Encrypted:   fc.config.DiskKey != nil,
+		Tiers:       fc.snapshotTiers(),
+	}
+
+	// copy the recency order first... entries are locked one at a time after
+	var keys []string
+	for t := range fc.tiers {
+		for i := range fc.shards {
+			shard := &fc.shards[i]
+			shard.mutex.Lock()
+			keys = append(keys, shard.tiers[t].keys()...)
+			shard.mutex.Unlock()
+		}
+	}
+
+	snapshot.Entries = make([]fileCacheSnapshotEntry, 0, len(keys))
+	for _, key := range keys {
+		fce, ok := fc.indexLoad(key)
+		if !ok {
+			continue
+		}
+		fce.Mutex.Lock()
+		entry := fileCacheSnapshotEntry{
+			Key:         key,
+			ContentType: fce.Meta.ContentType,
+			DiskSize:    fce.diskSize,
+			ETag:        fce.ETag,
+			SHA256:      fce.Meta.SHA256,
+			Size:        fce.Size,
+			Tier:        fce.tier,
+		}
+		fce.Mutex.Unlock()
+
+		// skip entries that were never written
+		if entry.SHA256 != nil {
+			snapshot.Entries = append(snapshot.Entries, entry)
+		}
+	}
+
+	// stream it through zstd, whose frame checksum catches a torn or rotted snapshot
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := zstd.NewWriter(pw)
+		if err == nil {
+			err = gob.NewEncoder(zw).Encode(&snapshot)
+			if closeErr := zw.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	if _, err := FileWriteAtomic(fc.snapshotPath(), pr, 0664); err != nil {
+		pr.CloseWithError(err)
+		return fmt.Errorf("failed to write cache index snapshot: %v", err)
+	}
+	return nil
+}
+
+// snapshotRemove deletes the snapshot so the next start does a full scan.
+func (fc *FileCache) snapshotRemove() {
+	if err := os.Remove(fc.snapshotPath()); err != nil && !os.IsNotExist(err) {
+		log.Errorf("failed to remove cache index snapshot: %v", err)
+	}
+}
+
+// snapshotRead decodes the snapshot and checks it was written with the current settings.
+func (fc *FileCache) snapshotRead() (*fileCacheSnapshot, error) {
+	f, err := os.Open(fc.snapshotPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var snapshot fileCacheSnapshot
+	if err := gob.NewDecoder(zr).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Version != fileCacheSnapshotVersion ||
+		snapshot.Compression != fc.config.DiskCompression ||
+		snapshot.Encrypted != (fc.config.DiskKey != nil) ||
+		strings.Join(snapshot.Tiers, ",") != strings.Join(fc.snapshotTiers(), ",") {
+		return nil, errors.New("snapshot was written with other settings")
+	}
+	return &snapshot, nil
+}
+
+// snapshotCheck stats a random sample of the snapshot. A file whose size
+// changed means the snapshot can't be trusted. A few missing files are
+// expected from evictions since the snapshot was taken.
+func (fc *FileCache) snapshotCheck(snapshot *fileCacheSnapshot) error {
+	sample := len(snapshot.Entries)
+	if sample > fileCacheSnapshotSample {
+		sample = fileCacheSnapshotSample
+	}
+
+	missing := 0
+	for _, i := range rand.Perm(len(snapshot.Entries))[:sample] {
+		entry := snapshot.Entries[i]
+		info, err := os.Stat(fc.filePath(entry.Tier, entry.Key))
+		if errors.Is(err, fs.ErrNotExist) {
+			missing++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Size() != entry.DiskSize {
+			return fmt.Errorf("%s is %d bytes, the snapshot says %d", entry.Key, info.Size(), entry.DiskSize)
+		}
+	}
+	if float64(missing) > float64(sample)*fileCacheSnapshotMissingMax {
+		return fmt.Errorf("%d of %d sampled files are missing", missing, sample)
+	}
+	return nil
+}
+
+// snapshotLoad indexes the cache from the snapshot.
+// It returns false, leaving the index empty, if there is no usable snapshot.
+func (fc *FileCache) snapshotLoad() bool {
+	snapshot, err := fc.snapshotRead()
+	if err == nil {
+		err = fc.snapshotCheck(snapshot)
+	}
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warnf("ignoring cache index snapshot: %v", err)
+		}
+		return false
+	}
+
+	for _, entry := range snapshot.Entries {
+		fce := &FileCacheEntry{
+			ETag:     entry.ETag,
+			Meta:     FileCacheMeta{ContentType: entry.ContentType, SHA256: entry.SHA256},
+			Size:     entry.Size,
+			diskSize: entry.DiskSize,
+			tier:     entry.Tier,
+		}
+		fc.indexStore(entry.Key, fce)
+		fc.shard(entry.Key).tiers[fce.tier].append(entry.Key)
+		fc.accountDisk(entry.Key, fce, 1)
+	}
+	// quota groups span tiers... touching oldest first leaves the fastest tier most recent
+	if len(fc.quotas) > 0 {
+		for i := len(snapshot.Entries) - 1; i >= 0; i-- {
+			fc.quotaTouch(snapshot.Entries[i].Key)
+		}
+	}
+	fc.updateCacheMetrics()
+
+	log.Infof("loaded %d cache entries from the index snapshot of %s", len(snapshot.Entries), snapshot.Time.Format(time.RFC3339))
+	go fc.snapshotCatchUp()
+	return true
+}
+
+// snapshotCatchUp brings an index loaded from a snapshot up to date with the
+// tiers. It indexes files written since the snapshot and drops entries whose
+// file is gone. Only files the index doesn't know are opened.
+func (fc *FileCache) snapshotCatchUp() {
+	added := 0
+	seen := make(map[string]bool)
+	for t, tier := range fc.tiers {
+		err := fileCacheWalk(tier.DirPath, func(key string, fullPath string, d fs.DirEntry) error {
+			if FileIsTmp(fullPath) {
+				return nil
+			}
+			seen[key] = true
+			if fc.Has(key) {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			size, sum, err := fc.fileHeaderRead(fullPath)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				// leave it for the scrubber
+				log.Warnf("not indexing cache file %s: %v", key, err)
+				return nil
+			}
+
+			// store a locked entry so a Put for the key waits until it is accounted for
+			fce := &FileCacheEntry{Meta: FileCacheMeta{SHA256: sum}, Size: size, diskSize: info.Size(), tier: t}
+			fce.Mutex.Lock()
+			defer fce.Mutex.Unlock()
+			if _, loaded := fc.indexLoadOrStore(key, fce); loaded {
+				return nil
+			}
+			shard := fc.shard(key)
+			shard.mutex.Lock()
+			shard.tiers[t].touch(key)
+			fc.accountDisk(key, fce, 1)
+			shard.mutex.Unlock()
+			fc.quotaTouch(key)
+			fc.updateCacheMetrics()
+			added++
+			return nil
+		})
+		if err != nil {
+			log.Errorf("failed to catch up the cache index: %v", err)
+			return
+		}
+	}
+
+	report := &FileCacheFsckReport{}
+	for _, key := range fc.indexKeys() {
+		if seen[key] {
+			continue
+		}
+		if err := fc.scrubMissing(report, key); err != nil {
+			log.Error(err)
+		}
+	}
+
+	log.Infof("caught up the cache index: %d files added, %d entries dropped", added, len(report.Missing))
+}
+
+// snapshotForever saves the index every IndexSnapshotInterval.
+func (fc *FileCache) snapshotForever() {
+	for range time.Tick(fc.config.IndexSnapshotInterval) {
+		if err := fc.SnapshotWrite(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// Close saves a final snapshot of the index when snapshots are on.
+func (fc *FileCache) Close() error {
+	if fc.config.IndexSnapshotInterval <= 0 {
+		return nil
+	}
+	return fc.SnapshotWrite()
+}
+
+// fileCacheSnapshotIs reports whether key names the index snapshot rather than a cache file.
+func fileCacheSnapshotIs(key string) bool {
+	return key == fileCacheSnapshotName
+}
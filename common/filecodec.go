@@ -0,0 +1,226 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	FileCompressionNone = ""
+	FileCompressionGzip = "gzip"
+	FileCompressionZstd = "zstd"
+)
+
+// Cache files start with fileCodecMagic, a version, the compression id, the
+// encryption flag, the logical size and the SHA-256 of the logical bytes.
+var fileCodecMagic = []byte("\x00EDGIE")
+
+const (
+	fileCodecVersion    = 2
+	fileCodecHeaderSize = 6 + 1 + 1 + 1 + 8 + sha256.Size
+)
+
+var fileCompressionIDs = map[string]byte{
+	FileCompressionNone: 0,
+	FileCompressionGzip: 1,
+	FileCompressionZstd: 2,
+}
+
+var fileCompressionNames = map[byte]string{
+	0: FileCompressionNone,
+	1: FileCompressionGzip,
+	2: FileCompressionZstd,
+}
+
+// ErrFileCodec means a cache file could not be decoded.
+var ErrFileCodec = errors.New("cache file is corrupt or was written with other settings")
+
+// ErrChecksumMismatch means bytes did not match the digest recorded for them.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// fileCodec transforms cache files between their logical bytes and the
+// compressed and/or encrypted bytes stored on disk.
+type fileCodec struct {
+	aead        cipher.AEAD
+	compression string
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+}
+
+func newFileCodec(compression string, key []byte) (*fileCodec, error) {
+	c := &fileCodec{compression: compression}
+
+	// always able to decode... files may predate a change of settings
+	var err error
+	if c.zstdDecoder, err = zstd.NewReader(nil); err != nil {
+		return nil, err
+	}
+
+	switch compression {
+	case FileCompressionNone, FileCompressionGzip:
+	case FileCompressionZstd:
+		if c.zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported cache compression: %s", compression)
+	}
+
+	if key != nil {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache encryption key: %v", err)
+		}
+		if c.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// encode returns the compressed form of data (data itself when compression
+// is off) and the bytes to write to disk. sum is the SHA-256 of data and name
+// binds the ciphertext to its path.
+func (c *fileCodec) encode(name string, data []byte, sum []byte) (packed []byte, raw []byte, err error) {
+	if packed, err = c.compress(data); err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, fileCodecHeaderSize)
+	copy(header, fileCodecMagic)
+	header[6] = fileCodecVersion
+	header[7] = fileCompressionIDs[c.compression]
+	binary.BigEndian.PutUint64(header[9:17], uint64(len(data)))
+	copy(header[17:], sum)
+
+	if c.aead == nil {
+		return packed, append(header, packed...), nil
+	}
+
+	header[8] = 1
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	raw = append(header, nonce...)
+	raw = c.aead.Seal(raw, nonce, packed, c.additionalData(name, header))
+	return packed, raw, nil
+}
+
+// decode reverses encode and verifies the checksum. It returns the logical
+// bytes and, when the file was stored with the current compression, the
+// compressed form too.
+func (c *fileCodec) decode(name string, raw []byte) (data []byte, packed []byte, err error) {
+	if !bytes.HasPrefix(raw, fileCodecMagic) || len(raw) < fileCodecHeaderSize {
+		return nil, nil, ErrFileCodec
+	}
+
+	header := raw[:fileCodecHeaderSize]
+	compression, ok := fileCompressionNames[header[7]]
+	if header[6] != fileCodecVersion || !ok {
+		return nil, nil, ErrFileCodec
+	}
+
+	body := raw[fileCodecHeaderSize:]
+	encrypted := header[8] == 1
+	if encrypted != (c.aead != nil) {
+		return nil, nil, ErrFileCodec
+	}
+	if encrypted {
+		nonceSize := c.aead.NonceSize()
+		if len(body) < nonceSize {
+			return nil, nil, ErrFileCodec
+		}
+		if body, err = c.aead.Open(nil, body[:nonceSize], body[nonceSize:], c.additionalData(name, header)); err != nil {
+			return nil, nil, ErrFileCodec
+		}
+	}
+
+	if data, err = c.decompress(compression, body); err != nil {
+		return nil, nil, err
+	}
+	size, sum, _ := c.headerRead(header)
+	if int64(len(data)) != size {
+		return nil, nil, ErrFileCodec
+	}
+	if actual := sha256.Sum256(data); !bytes.Equal(actual[:], sum) {
+		return nil, nil, ErrChecksumMismatch
+	}
+	if compression == c.compression {
+		packed = body
+	}
+	return data, packed, nil
+}
+
+// headerRead returns the logical size and checksum from the start of a cache file.
+func (c *fileCodec) headerRead(head []byte) (size int64, sum []byte, err error) {
+	if !bytes.HasPrefix(head, fileCodecMagic) || len(head) < fileCodecHeaderSize || head[6] != fileCodecVersion {
+		return 0, nil, ErrFileCodec
+	}
+	return int64(binary.BigEndian.Uint64(head[9:17])), append([]byte{}, head[17:fileCodecHeaderSize]...), nil
+}
+
+// plain reports whether files are written without compression or encryption.
+func (c *fileCodec) plain() bool {
+	return c.compression == FileCompressionNone && c.aead == nil
+}
+
+// headerPlain reports whether the file with this header stores the logical
+// bytes as they are, right after the header.
+func (c *fileCodec) headerPlain(head []byte) bool {
+	return head[7] == fileCompressionIDs[FileCompressionNone] && head[8] == 0
+}
+
+func (c *fileCodec) additionalData(name string, header []byte) []byte {
+	return append(append([]byte{}, header...), name...)
+}
+
+func (c *fileCodec) compress(data []byte) ([]byte, error) {
+	switch c.compression {
+	case FileCompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case FileCompressionZstd:
+		return c.zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return data, nil
+}
+
+func (c *fileCodec) decompress(compression string, packed []byte) ([]byte, error) {
+	switch compression {
+	case FileCompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(packed))
+		if err != nil {
+			return nil, ErrFileCodec
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, ErrFileCodec
+		}
+		return data, nil
+	case FileCompressionZstd:
+		data, err := c.zstdDecoder.DecodeAll(packed, nil)
+		if err != nil {
+			return nil, ErrFileCodec
+		}
+		return data, nil
+	}
+	return packed, nil
+}
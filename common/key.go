@@ -0,0 +1,99 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// KeyBytesMax is the longest key edgie takes, the S3 limit
+	KeyBytesMax = 1024
+	// KeyNameBytesMax is the longest segment of a key, the usual file name limit
+	KeyNameBytesMax = 255
+	// KeyReservedPrefix starts the names edgie keeps for itself: temp files,
+	// the index snapshot, upload metadata and compressed variants.
+	KeyReservedPrefix = ".edgie-"
+)
+
+// ErrKeyInvalid means a key can't name a file under a root or is reserved.
+var ErrKeyInvalid = errors.New("invalid key")
+
+// KeyValidate checks that key is a relative slash path with no empty, . or
+// .. segments, no NUL or backslash, and no segment or whole too long for a
+// file system, so joining it onto a root stays under that root.
+func KeyValidate(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: empty", ErrKeyInvalid)
+	}
+	if len(key) > KeyBytesMax {
+		return fmt.Errorf("%w: longer than %d bytes", ErrKeyInvalid, KeyBytesMax)
+	}
+	if !utf8.ValidString(key) {
+		return fmt.Errorf("%w: not UTF-8", ErrKeyInvalid)
+	}
+	if strings.ContainsAny(key, "\x00\\") {
+		return fmt.Errorf("%w: has a NUL or backslash", ErrKeyInvalid)
+	}
+	for _, name := range strings.Split(key, "/") {
+		switch {
+		case name == "":
+			return fmt.Errorf("%w: has an empty segment", ErrKeyInvalid)
+		case name == "." || name == "..":
+			return fmt.Errorf("%w: has a %s segment", ErrKeyInvalid, name)
+		case len(name) > KeyNameBytesMax:
+			return fmt.Errorf("%w: has a segment longer than %d bytes", ErrKeyInvalid, KeyNameBytesMax)
+		}
+	}
+	return nil
+}
+
+// KeyReserved reports whether a segment of key is a name edgie keeps for itself.
+func KeyReserved(key string) bool {
+	for _, name := range strings.Split(key, "/") {
+		if strings.HasPrefix(name, KeyReservedPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyPath joins a valid key onto root. It resolves the symlinks along the
+// part of the path that exists and fails if they lead out of root or
+// nowhere. Parts that don't exist yet can't lead anywhere.
+func KeyPath(root string, key string) (string, error) {
+	if err := KeyValidate(key); err != nil {
+		return "", err
+	}
+	root = filepath.Clean(root)
+	fullPath := filepath.Join(root, filepath.FromSlash(key))
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fullPath, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	for existing := fullPath; existing != root; existing = filepath.Dir(existing) {
+		realPath, err := filepath.EvalSymlinks(existing)
+		if errors.Is(err, fs.ErrNotExist) {
+			// a dangling symlink would create its target wherever that is
+			if info, err := os.Lstat(existing); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+				return "", fmt.Errorf("%w: %s leads through a dangling symlink in %s", ErrKeyInvalid, key, root)
+			}
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if rel, err := filepath.Rel(realRoot, realPath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("%w: %s leads out of %s", ErrKeyInvalid, key, root)
+		}
+		break
+	}
+	return fullPath, nil
+}
@@ -0,0 +1,242 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// keyTestRoot makes a root dir next to an outside dir, with symlinks that
+// stay in the root and symlinks that lead out of it.
+func keyTestRoot(t testing.TB) string {
+	t.Helper()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, dirPath := range []string{filepath.Join(root, "in", "sub"), outside} {
+		if err := os.MkdirAll(dirPath, 0775); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, filePath := range []string{filepath.Join(root, "in", "file"), filepath.Join(outside, "secret")} {
+		if err := os.WriteFile(filePath, []byte("x"), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"inlink":   "in",
+		"in/up":    "../..",
+		"out":      outside,
+		"outrel":   "../outside",
+		"dangling": filepath.Join(outside, "missing"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(link))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// keyPathEscapes walks fullPath down from root the way a write would and
+// reports whether any part that exists resolves out of root or nowhere.
+func keyPathEscapes(root string, fullPath string) bool {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return true
+	}
+	rel, err := filepath.Rel(root, fullPath)
+	if err != nil || !filepath.IsLocal(rel) {
+		return true
+	}
+	part := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		part = filepath.Join(part, name)
+		if _, err := os.Lstat(part); errors.Is(err, os.ErrNotExist) {
+			// nothing below here exists to lead anywhere
+			return false
+		}
+		realPart, err := filepath.EvalSymlinks(part)
+		if errors.Is(err, os.ErrNotExist) {
+			return true
+		} else if err != nil {
+			// not a dir... nothing can be created under it
+			return false
+		}
+		if realRel, err := filepath.Rel(realRoot, realPart); err != nil || !filepath.IsLocal(realRel) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestKeyValidate(t *testing.T) {
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"a", true},
+		{"a/b/c.txt", true},
+		{"a%2Fb", true},
+		{"a%2F..%2F..%2Fb", true},
+		{".edgie-tmp-x", true},
+		{"", false},
+		{"/a", false},
+		{"a/", false},
+		{"a//b", false},
+		{".", false},
+		{"..", false},
+		{"../a", false},
+		{"a/../../b", false},
+		{"a/./b", false},
+		{"a\x00b", false},
+		{"a\\..\\b", false},
+		{"a/\xff", false},
+		{strings.Repeat("a", KeyNameBytesMax), true},
+		{strings.Repeat("a", KeyNameBytesMax+1), false},
+		{strings.Repeat("a/", KeyBytesMax/2) + "a", false},
+	}
+	for _, test := range tests {
+		err := KeyValidate(test.key)
+		if test.ok && err != nil {
+			t.Errorf("KeyValidate(%q) = %v, want nil", test.key, err)
+		}
+		if !test.ok && !errors.Is(err, ErrKeyInvalid) {
+			t.Errorf("KeyValidate(%q) = %v, want ErrKeyInvalid", test.key, err)
+		}
+	}
+}
+
+func TestKeyReserved(t *testing.T) {
+	tests := map[string]bool{
+		"a/b":                 false,
+		"a/edgie-b":           false,
+		"a/.edgiex":           false,
+		".edgie-tmp-1":        true,
+		"a/.edgie-meta":       true,
+		"a/.edgie-variant/b":  true,
+		"a/b.edgie-suffix":    false,
+		".edgie-index/nested": true,
+	}
+	for key, reserved := range tests {
+		if got := KeyReserved(key); got != reserved {
+			t.Errorf("KeyReserved(%q) = %v, want %v", key, got, reserved)
+		}
+	}
+}
+
+func TestKeyPath(t *testing.T) {
+	root := keyTestRoot(t)
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"new", true},
+		{"in/file", true},
+		{"in/sub/new", true},
+		{"in/new/deeper/file", true},
+		{"inlink/file", true},
+		{"inlink/new/file", true},
+		{"a%2F..%2F..%2Foutside", true},
+		{"out", false},
+		{"out/secret", false},
+		{"out/new/file", false},
+		{"outrel/secret", false},
+		{"in/up", false},
+		{"in/up/outside/secret", false},
+		{"inlink/up/outside/secret", false},
+		{"dangling", false},
+		{"dangling/file", false},
+		{"../outside/secret", false},
+		{"in/../../outside/secret", false},
+		{"a\x00b", false},
+		{"in\\..\\..\\outside", false},
+	}
+	for _, test := range tests {
+		fullPath, err := KeyPath(root, test.key)
+		if !test.ok {
+			if !errors.Is(err, ErrKeyInvalid) {
+				t.Errorf("KeyPath(%q) = %q, %v, want ErrKeyInvalid", test.key, fullPath, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("KeyPath(%q) = %v, want nil", test.key, err)
+			continue
+		}
+		if want := filepath.Join(root, filepath.FromSlash(test.key)); fullPath != want {
+			t.Errorf("KeyPath(%q) = %q, want %q", test.key, fullPath, want)
+		}
+		if keyPathEscapes(root, fullPath) {
+			t.Errorf("KeyPath(%q) = %q, which leads out of the root", test.key, fullPath)
+		}
+	}
+}
+
+func TestKeyPathRootMissing(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "missing")
+	fullPath, err := KeyPath(root, "a/b")
+	if err != nil || fullPath != filepath.Join(root, "a", "b") {
+		t.Errorf("KeyPath under a missing root = %q, %v", fullPath, err)
+	}
+}
+
+var keyFuzzSeeds = []string{
+	"a",
+	"a/b/c.txt",
+	"in/file",
+	"inlink/new",
+	"out/secret",
+	"outrel/x",
+	"in/up/outside",
+	"dangling/x",
+	"../outside",
+	"a/../..",
+	"a%2F..%2Fb",
+	"a\x00b",
+	"a\\b",
+	".edgie-tmp-x",
+	"/abs",
+}
+
+func FuzzKeyValidate(f *testing.F) {
+	for _, key := range keyFuzzSeeds {
+		f.Add(key)
+	}
+	f.Fuzz(func(t *testing.T, key string) {
+		if KeyValidate(key) != nil {
+			return
+		}
+		local := filepath.FromSlash(key)
+		if !filepath.IsLocal(local) {
+			t.Fatalf("KeyValidate accepted %q, which is not a local path", key)
+		}
+		if filepath.Clean(local) != local {
+			t.Fatalf("KeyValidate accepted %q, which cleans to %q", key, filepath.Clean(local))
+		}
+		if strings.ContainsRune(key, 0) {
+			t.Fatalf("KeyValidate accepted %q, which has a NUL", key)
+		}
+	})
+}
+
+func FuzzKeyPath(f *testing.F) {
+	for _, key := range keyFuzzSeeds {
+		f.Add(key)
+	}
+	root := keyTestRoot(f)
+	f.Fuzz(func(t *testing.T, key string) {
+		fullPath, err := KeyPath(root, key)
+		if err != nil {
+			return
+		}
+		if want := filepath.Join(root, filepath.FromSlash(key)); fullPath != want {
+			t.Fatalf("KeyPath(%q) = %q, want %q", key, fullPath, want)
+		}
+		if keyPathEscapes(root, fullPath) {
+			t.Fatalf("KeyPath(%q) = %q, which leads out of the root", key, fullPath)
+		}
+	})
+}
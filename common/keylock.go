@@ -0,0 +1,45 @@
+package common
+
+import (
+	"sync"
+)
+
+// KeyLock serializes work on the same key while letting different keys
+// proceed in parallel. The zero value is ready to use.
+type KeyLock struct {
+	mutex sync.Mutex
+	locks map[string]*keyLockEntry
+}
+
+type keyLockEntry struct {
+	mutex sync.Mutex
+	refs  int
+}
+
+func (kl *KeyLock) Lock(key string) {
+	kl.mutex.Lock()
+	if kl.locks == nil {
+		kl.locks = make(map[string]*keyLockEntry)
+	}
+	entry, ok := kl.locks[key]
+	if !ok {
+		entry = &keyLockEntry{}
+		kl.locks[key] = entry
+	}
+	entry.refs++
+	kl.mutex.Unlock()
+
+	entry.mutex.Lock()
+}
+
+func (kl *KeyLock) Unlock(key string) {
+	kl.mutex.Lock()
+	entry := kl.locks[key]
+	entry.refs--
+	if entry.refs == 0 {
+		delete(kl.locks, key)
+	}
+	kl.mutex.Unlock()
+
+	entry.mutex.Unlock()
+}
@@ -0,0 +1,120 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	OPT_MIME_TYPES_FILE = "MIME_TYPES_FILE"
+)
+
+// MimeTypes resolves content types for keys. Operator overrides take
+// precedence over the standard library's extension table.
+type MimeTypes struct {
+	overrides map[string]string
+}
+
+func MimeCmdInit(Cmd *cobra.Command) {
+	Cmd.PersistentFlags().String(OPT_MIME_TYPES_FILE, "", "mime.types style file of content type overrides (\"type ext1 ext2 ...\" per line)")
+	viper.BindPFlag(OPT_MIME_TYPES_FILE, Cmd.PersistentFlags().Lookup(OPT_MIME_TYPES_FILE))
+}
+
+func MimeCmdExecute(cmd *cobra.Command, args []string) *MimeTypes {
+	mimeTypesFile := viper.GetString(OPT_MIME_TYPES_FILE)
+	if mimeTypesFile == "" {
+		return &MimeTypes{}
+	}
+
+	mt, err := MimeTypesLoad(mimeTypesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return mt
+}
+
+// MimeTypesLoad reads overrides from a mime.types style file.
+func MimeTypesLoad(filePath string) (*MimeTypes, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mime types file: %v", err)
+	}
+	defer f.Close()
+
+	mt := &MimeTypes{overrides: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			mt.overrides["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mime types file: %v", err)
+	}
+	return mt, nil
+}
+
+// ByExtension returns the content type for key's extension, or "" if unknown.
+func (mt *MimeTypes) ByExtension(key string) string {
+	ext := strings.ToLower(path.Ext(key))
+	if ext == "" {
+		return ""
+	}
+	if mt != nil {
+		if contentType, ok := mt.overrides[ext]; ok {
+			return contentType
+		}
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// Detect picks a content type from origin metadata, then the extension of
+// key, then by sniffing head (up to the first 512 bytes of the content).
+func (mt *MimeTypes) Detect(key string, origin string, head []byte) string {
+	// S3 stamps objects uploaded without a type as octet-stream... that tells us nothing
+	if origin != "" && origin != "binary/octet-stream" && origin != "application/octet-stream" {
+		return origin
+	}
+	if contentType := mt.ByExtension(key); contentType != "" {
+		return contentType
+	}
+	return http.DetectContentType(head)
+}
+
+// FileContentType runs Detect on the file at filePath.
+func (mt *MimeTypes) FileContentType(key string, filePath string) (string, error) {
+	if contentType := mt.ByExtension(key); contentType != "" {
+		return contentType, nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return mt.Detect(key, "", head[:n]), nil
+}
@@ -1,12 +1,14 @@
 package common
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
-	"io"
 	"log"
 	"os"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -44,12 +46,15 @@ func S3CmdExecute(cmd *cobra.Command, args []string) *S3Conf {
 	}
 }
 
-// S3FileUpload uploads a file to an S3 bucket.
+// S3FileUpload uploads a file to an S3 bucket with the given content type.
+// A non-nil checksumSHA256 is sent as the object checksum so S3 rejects a body that doesn't match.
 func S3FileUpload(
 	s3Client *s3.S3,
 	srcPath string,
 	dstBucket string,
-	dstPath string) error {
+	dstPath string,
+	contentType string,
+	checksumSHA256 []byte) error {
 
 	file, err := os.Open(srcPath)
 	if err != nil {
@@ -57,28 +62,116 @@ func S3FileUpload(
 	}
 	defer file.Close()
 
-	_, err = s3Client.PutObject(
-		&s3.PutObjectInput{
-			Bucket: aws.String(dstBucket),
-			Key:    aws.String(dstPath),
-			Body:   file,
-		})
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(dstBucket),
+		Key:         aws.String(dstPath),
+		Body:        file,
+		ContentType: aws.String(contentType),
+	}
+	if checksumSHA256 != nil {
+		input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(checksumSHA256))
+	}
+	_, err = s3Client.PutObject(input)
 
 	return err
 }
 
+// S3FileDownload opens an object for reading. The caller closes the body.
+// Checksum mode is on, so the output carries the object's checksum when it has one.
 func S3FileDownload(
 	path string,
 	bucketName string,
-	s3Client *s3.S3) (rc io.ReadCloser, err error) {
+	s3Client *s3.S3) (*s3.GetObjectOutput, error) {
 
 	resp, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(path),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, os.ErrNotExist
+		}
+		return nil, fmt.Errorf(S3ErrorPrefix+": failed to get object from S3:%v", err)
+	}
+
+	return resp, nil
+}
+
+// S3ChecksumSHA256 decodes a whole-object SHA-256 checksum. It returns nil for
+// a missing checksum or a composite one from a multipart upload.
+func S3ChecksumSHA256(checksum *string) []byte {
+	sum, err := base64.StdEncoding.DecodeString(aws.StringValue(checksum))
+	if err != nil || len(sum) != sha256.Size {
+		return nil
+	}
+	return sum
+}
+
+// S3FileDelete deletes an object from an S3 bucket. Deleting a missing key is not an error.
+func S3FileDelete(
+	s3Client *s3.S3,
+	bucketName string,
+	path string) error {
+
+	_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(path),
 	})
 	if err != nil {
-		return nil, fmt.Errorf(S3ErrorPrefix+": failed to get object from S3:%v", err)
+		return fmt.Errorf(S3ErrorPrefix+": failed to delete object from S3:%v", err)
+	}
+
+	return nil
+}
+
+// S3FileHead fetches object metadata without the body.
+func S3FileHead(
+	path string,
+	bucketName string,
+	s3Client *s3.S3) (*s3.HeadObjectOutput, error) {
+
+	resp, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(path),
+	})
+	if err != nil {
+		// HEAD responses have no body, so S3 reports a bare NotFound
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey) {
+			return nil, os.ErrNotExist
+		}
+		return nil, fmt.Errorf(S3ErrorPrefix+": failed to head object in S3:%v", err)
+	}
+
+	return resp, nil
+}
+
+// S3FileList lists one page of objects under prefix that sort after startAfter.
+// A non-empty delimiter rolls deeper keys up into CommonPrefixes.
+func S3FileList(
+	s3Client *s3.S3,
+	bucketName string,
+	prefix string,
+	delimiter string,
+	startAfter string,
+	maxKeys int64) (*s3.ListObjectsV2Output, error) {
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucketName),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(maxKeys),
+	}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+
+	resp, err := s3Client.ListObjectsV2(input)
+	if err != nil {
+		return nil, fmt.Errorf(S3ErrorPrefix+": failed to list objects in S3:%v", err)
 	}
 
-	return resp.Body, nil
+	return resp, nil
 }
@@ -0,0 +1,254 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	OPT_TLS_CA_FILE     = "TLS_CA_FILE"
+	OPT_TLS_CERT_FILE   = "TLS_CERT_FILE"
+	OPT_TLS_CLIENT_AUTH = "TLS_CLIENT_AUTH"
+	OPT_TLS_KEY_FILE    = "TLS_KEY_FILE"
+	OPT_TLS_RELOAD_TICK = "TLS_RELOAD_TICK"
+)
+
+// TLS_CLIENT_AUTH values. Verify checks the certs clients choose to send, so
+// an auth scheme can demand one for some routes. Require refuses handshakes
+// without one.
+const (
+	TLSClientAuthRequire = "require"
+	TLSClientAuthVerify  = "verify"
+)
+
+var (
+	tlsReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgie_tls_reloads_total",
+		Help: "Total number of certificate reloads, by result: ok or failed.",
+	}, []string{"result"})
+
+	tlsCertExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "edgie_tls_cert_expiry_timestamp_seconds",
+		Help: "Unix time the serving certificate expires.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		tlsCertExpiry,
+		tlsReloads)
+}
+
+func TLSCmdInit(Cmd *cobra.Command) {
+	Cmd.PersistentFlags().String(OPT_TLS_CERT_FILE, "", "PEM certificate chain to serve HTTPS and HTTP/2 with (empty serves plain HTTP)")
+	viper.BindPFlag(OPT_TLS_CERT_FILE, Cmd.PersistentFlags().Lookup(OPT_TLS_CERT_FILE))
+
+	Cmd.PersistentFlags().String(OPT_TLS_KEY_FILE, "", "PEM private key of TLS_CERT_FILE")
+	viper.BindPFlag(OPT_TLS_KEY_FILE, Cmd.PersistentFlags().Lookup(OPT_TLS_KEY_FILE))
+
+	Cmd.PersistentFlags().String(OPT_TLS_CA_FILE, "", "PEM CAs that sign peer certs: client certs are verified against them and edgie warm trusts them")
+	viper.BindPFlag(OPT_TLS_CA_FILE, Cmd.PersistentFlags().Lookup(OPT_TLS_CA_FILE))
+
+	Cmd.PersistentFlags().String(OPT_TLS_CLIENT_AUTH, TLSClientAuthVerify, "with TLS_CA_FILE, verify client certs when sent or require them")
+	viper.BindPFlag(OPT_TLS_CLIENT_AUTH, Cmd.PersistentFlags().Lookup(OPT_TLS_CLIENT_AUTH))
+
+	Cmd.PersistentFlags().Duration(OPT_TLS_RELOAD_TICK, 10*time.Second, "delay between checks of the TLS files for changes (SIGHUP reloads at once)")
+	viper.BindPFlag(OPT_TLS_RELOAD_TICK, Cmd.PersistentFlags().Lookup(OPT_TLS_RELOAD_TICK))
+}
+
+// TLSCmdExecute reads the TLS options. It returns nil when TLS_CERT_FILE is empty.
+func TLSCmdExecute(cmd *cobra.Command, args []string) (*TLSReloader, error) {
+	certPath := viper.GetString(OPT_TLS_CERT_FILE)
+	keyPath := viper.GetString(OPT_TLS_KEY_FILE)
+	caPath := viper.GetString(OPT_TLS_CA_FILE)
+	if certPath == "" {
+		if keyPath != "" || caPath != "" {
+			return nil, errors.New("TLS_KEY_FILE and TLS_CA_FILE need TLS_CERT_FILE")
+		}
+		return nil, nil
+	}
+	if keyPath == "" {
+		return nil, errors.New("TLS_KEY_FILE not specified")
+	}
+
+	r := &TLSReloader{
+		caPath:     caPath,
+		certPath:   certPath,
+		keyPath:    keyPath,
+		reloadTick: viper.GetDuration(OPT_TLS_RELOAD_TICK),
+	}
+	if caPath != "" {
+		switch viper.GetString(OPT_TLS_CLIENT_AUTH) {
+		case TLSClientAuthVerify:
+			r.clientAuth = tls.VerifyClientCertIfGiven
+		case TLSClientAuthRequire:
+			r.clientAuth = tls.RequireAndVerifyClientCert
+		default:
+			return nil, fmt.Errorf("TLS_CLIENT_AUTH must be %s or %s", TLSClientAuthVerify, TLSClientAuthRequire)
+		}
+	}
+	if r.reloadTick <= 0 {
+		return nil, errors.New("TLS_RELOAD_TICK must be positive")
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSClientConfig is the TLS config edgie uses to call a peer. It trusts
+// TLS_CA_FILE as well as the system roots, and presents TLS_CERT_FILE when
+// there is one so the peer can check it.
+func TLSClientConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caPath := viper.GetString(OPT_TLS_CA_FILE); caPath != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if err := tlsCAAppend(pool, caPath); err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certPath := viper.GetString(OPT_TLS_CERT_FILE); certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, viper.GetString(OPT_TLS_KEY_FILE))
+		if err != nil {
+			return nil, fmt.Errorf("could not load TLS_CERT_FILE: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// TLSReloader serves the current certificate and client CAs. Handshakes pick
+// up new files as soon as they load. Connections already open keep the ones
+// they started with.
+type TLSReloader struct {
+	caPath     string
+	certPath   string
+	clientAuth tls.ClientAuthType
+	config     atomic.Pointer[tls.Config]
+	keyPath    string
+	reloadTick time.Duration
+	stamp      string
+}
+
+// ServerConfig is the config to hand http.Server. It offers HTTP/2.
+func (r *TLSReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.config.Load(), nil
+		},
+	}
+}
+
+// Start reloads the files when they change and on SIGHUP.
+func (r *TLSReloader) Start() {
+	go r.reloadForever()
+}
+
+func (r *TLSReloader) reloadForever() {
+	sighups := make(chan os.Signal, 1)
+	signal.Notify(sighups, syscall.SIGHUP)
+	ticker := time.NewTicker(r.reloadTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sighups:
+			log.Warn("reloading TLS files on SIGHUP")
+		case <-ticker.C:
+			if stamp := r.filesStamp(); stamp == r.stamp {
+				continue
+			}
+		}
+		if err := r.reload(); err != nil {
+			log.Errorf("kept the old certificate: %v", err)
+		}
+	}
+}
+
+// filesStamp changes when any of the TLS files does.
+func (r *TLSReloader) filesStamp() string {
+	stamp := ""
+	for _, filePath := range []string{r.certPath, r.keyPath, r.caPath} {
+		if filePath == "" {
+			continue
+		}
+		if info, err := os.Stat(filePath); err == nil {
+			stamp += fmt.Sprintf("%s:%d:%d;", filePath, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return stamp
+}
+
+// reload swaps in the files if they all load. A half-written pair fails to
+// load and leaves the old config serving until the next try.
+func (r *TLSReloader) reload() error {
+	stamp := r.filesStamp()
+	config, err := r.load()
+	if err != nil {
+		tlsReloads.WithLabelValues("failed").Inc()
+		// retry on SIGHUP or once the files change again
+		r.stamp = stamp
+		return err
+	}
+	r.config.Store(config)
+	r.stamp = stamp
+	tlsReloads.WithLabelValues("ok").Inc()
+	tlsCertExpiry.Set(float64(config.Certificates[0].Leaf.NotAfter.Unix()))
+	log.Infof("loaded certificate %s, expires %s", r.certPath, config.Certificates[0].Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func (r *TLSReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS_CERT_FILE and TLS_KEY_FILE: %v", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("could not parse TLS_CERT_FILE: %v", err)
+		}
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   r.clientAuth,
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if r.caPath != "" {
+		config.ClientCAs = x509.NewCertPool()
+		if err := tlsCAAppend(config.ClientCAs, r.caPath); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+func tlsCAAppend(pool *x509.CertPool, caPath string) error {
+	pem, err := os.ReadFile(caPath)
+	if err != nil {
+		return fmt.Errorf("could not read TLS_CA_FILE: %v", err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("TLS_CA_FILE %s has no PEM certificates", caPath)
+	}
+	return nil
+}
@@ -3,10 +3,11 @@ module github.com/jkassis/edgie
 go 1.21
 
 require (
-	github.com/aws/aws-sdk-go v1.40.19
+	github.com/andybalholm/brotli v1.1.0
+	github.com/aws/aws-sdk-go v1.55.5
 	github.com/bmatcuk/doublestar/v4 v4.6.1
+	github.com/klauspost/compress v1.17.4
 	github.com/prometheus/client_golang v1.17.0
-	github.com/puzpuzpuz/xsync v1.5.2
 	github.com/sirupsen/logrus v1.9.3
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/viper v1.3.2
@@ -1,15 +1,17 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
-	"path/filepath"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/jkassis/edgie/common"
 	"github.com/jkassis/edgie/service"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var cmd *cobra.Command
@@ -22,6 +24,32 @@ func main() {
 	}
 
 	service.CmdInit(cmd)
+
+	fsckCmd := &cobra.Command{
+		Use:   "fsck",
+		Short: "check the cache dir of a stopped edgie and print a JSON report",
+		Run:   fsckCmdExecute,
+	}
+	service.FsckCmdInit(fsckCmd)
+	cmd.AddCommand(fsckCmd)
+
+	warmCmd := &cobra.Command{
+		Use:   "warm",
+		Short: "prefetch a manifest, S3 prefixes or key patterns into the cache of a running edgie",
+		Run:   warmCmdExecute,
+	}
+	service.WarmCmdInit(warmCmd)
+	cmd.AddCommand(warmCmd)
+
+	signCmd := &cobra.Command{
+		Use:   "sign PATH",
+		Short: "print a signed, expiring URL for an object",
+		Args:  cobra.ExactArgs(1),
+		Run:   signCmdExecute,
+	}
+	service.SignCmdInit(signCmd)
+	cmd.AddCommand(signCmd)
+
 	cmd.Execute()
 }
 
@@ -31,22 +59,87 @@ func cmdExecute(cmd *cobra.Command, args []string) {
 		log.Fatal(err)
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "GET" {
-			path := filepath.Clean(r.URL.Path)
-			s.Download(path)
-		} else if r.Method == "POST" {
-			path := filepath.Clean(r.URL.Path)
-			s.Download(path)
-			s.Upload(path, r.Body)
-		} else {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+	// save the cache index on the way out
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+		if err := s.Close(); err != nil {
+			log.Error(err)
 		}
+		os.Exit(0)
+	}()
+
+	tlsReloader, err := common.TLSCmdExecute(cmd, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsReloader != nil {
+		// new handshakes get reloaded certs, open connections keep theirs
+		tlsReloader.Start()
+	}
+
+	// each listener has its own mux, so no key is shadowed by a route
+	if s.Conf.AdminAddr != "" {
+		go serve("admin", s.Conf.AdminAddr, s.AdminHandler(), tlsReloader)
+	}
+	if s.Conf.MetricsAddr != "" {
+		go serve("metrics", s.Conf.MetricsAddr, s.MetricsHandler(), tlsReloader)
+	}
+	serve("files", s.Conf.PublicAddr, s, tlsReloader)
+}
+
+// serve runs a listener until it fails, which ends the process.
+func serve(name string, addr string, handler http.Handler, tlsReloader *common.TLSReloader) {
+	server := &http.Server{Addr: addr, Handler: handler}
+	if tlsReloader == nil {
+		log.Warnf("Serving %s over HTTP on %s", name, addr)
+		log.Fatal(server.ListenAndServe())
+	}
+	server.TLSConfig = tlsReloader.ServerConfig()
+	log.Warnf("Serving %s over HTTPS on %s", name, addr)
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+// fsckCmdExecute exits 0 when the cache is clean, 1 when problems were
+// repaired and 4 when problems were left in place, like fsck(8).
+func fsckCmdExecute(cmd *cobra.Command, args []string) {
+	report, err := service.FsckCmdExecute(cmd, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+
+	if report.Findings() > 0 {
+		if report.Repair {
+			os.Exit(1)
+		}
+		os.Exit(4)
+	}
+}
+
+// warmCmdExecute prints each progress report as a JSON line. It exits 1 when
+// some objects failed to warm.
+func warmCmdExecute(cmd *cobra.Command, args []string) {
+	enc := json.NewEncoder(os.Stdout)
+	progress, err := service.WarmCmdExecute(cmd, args, func(p service.WarmProgress) {
+		enc.Encode(p)
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if progress.Failed > 0 {
+		os.Exit(1)
+	}
+}
 
-	port := viper.GetString(common.OPT_PORT)
-	http.Handle("/metrics", promhttp.Handler())
-	log.Warnf("Serving metrics on HTTP port: %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+func signCmdExecute(cmd *cobra.Command, args []string) {
+	signedURL, err := service.SignCmdExecute(cmd, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(signedURL)
 }
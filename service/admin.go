@@ -0,0 +1,219 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/jkassis/edgie/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Admin listener paths. WarmPath is there too.
+const (
+	AdminPprofPath = "/debug/pprof/"
+	AdminPurgePath = "/admin/purge"
+	AdminStatsPath = "/admin/stats"
+
+	// admin request bodies, like warm manifests, are refused past this
+	adminBodyBytesMax = 64 << 20
+)
+
+var purgeCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "edgie_purged_total",
+	Help: "Total number of keys dropped from the cache by purges.",
+})
+
+// PurgeRequest names the keys to drop from the cache. Their next download
+// comes from a pending upload or S3.
+type PurgeRequest struct {
+	Keys     []string `json:"keys,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+type PurgeResult struct {
+	Purged int `json:"purged"`
+}
+
+// AdminStats is what the stats endpoint serves.
+type AdminStats struct {
+	Cache common.FileCacheStats       `json:"cache"`
+	Scrub *common.FileCacheFsckReport `json:"scrub,omitempty"` // the last scrub
+}
+
+// AdminHandler serves the admin listener: purge, warm, stats and pprof. Every
+// route takes AUTH_ADMIN.
+func (s *Service) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminPurgePath, s.ServePurge)
+	mux.HandleFunc(AdminStatsPath, s.ServeStats)
+	mux.HandleFunc(WarmPath, s.ServeWarm)
+
+	mux.Handle(AdminPprofPath, s.adminOnly(http.HandlerFunc(pprof.Index)))
+	mux.Handle(AdminPprofPath+"cmdline", s.adminOnly(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle(AdminPprofPath+"profile", s.adminOnly(http.HandlerFunc(pprof.Profile)))
+	mux.Handle(AdminPprofPath+"symbol", s.adminOnly(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle(AdminPprofPath+"trace", s.adminOnly(http.HandlerFunc(pprof.Trace)))
+	return mux
+}
+
+// MetricsHandler serves the metrics listener. It takes AUTH_METRICS.
+func (s *Service) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	metrics := promhttp.Handler()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if s.authorize(w, r, AuthClassMetrics) {
+			metrics.ServeHTTP(w, r)
+		}
+	})
+	return mux
+}
+
+func (s *Service) adminOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.authorize(w, r, AuthClassAdmin) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Purge drops keys and everything under prefixes from the cache, with their
+// compressed variants. It leaves pending uploads and S3 alone.
+func (s *Service) Purge(req PurgeRequest) (PurgeResult, error) {
+	var result PurgeResult
+	var keys []string
+	for _, filePath := range req.Keys {
+		key, err := s.keyParse(filePath)
+		if err != nil {
+			return result, err
+		}
+		keys = append(keys, key)
+	}
+	for _, prefix := range req.Prefixes {
+		for _, key := range s.Cache.Keys(keyClean(prefix)) {
+			// variants go with their key
+			if !common.KeyReserved(key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		purged, err := s.purgeKey(key)
+		if err != nil {
+			return result, err
+		}
+		if purged {
+			result.Purged++
+			purgeCounter.Inc()
+		}
+	}
+	return result, nil
+}
+
+func (s *Service) purgeKey(key string) (bool, error) {
+	s.keyLock.Lock(key)
+	defer s.keyLock.Unlock(key)
+
+	purged := s.Cache.Has(key)
+	if err := s.Cache.Delete(key); err != nil {
+		return false, fmt.Errorf("failed to purge %s: %v", key, err)
+	}
+	if err := s.variantsDelete(key); err != nil {
+		return false, err
+	}
+	return purged, nil
+}
+
+// ServePurge runs the PurgeRequest in a POST body and answers with a PurgeResult.
+func (s *Service) ServePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, r, AuthClassAdmin) {
+		return
+	}
+
+	var req PurgeRequest
+	if err := adminBodyDecode(r, &req); err != nil {
+		http.Error(w, "Invalid purge request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := s.Purge(req)
+	if errors.Is(err, common.ErrKeyInvalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Errorf("purge failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// adminBodyDecode decodes the JSON body of an admin request into v. When the
+// request carries x-amz-checksum-sha256 the body must match it, which is what
+// binds the body of an HMAC-signed request to its signature.
+func adminBodyDecode(r *http.Request, v any) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, adminBodyBytesMax+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > adminBodyBytesMax {
+		return fmt.Errorf("body is over %d bytes", adminBodyBytesMax)
+	}
+	sums, err := uploadChecksumsParse(r.Header)
+	if err != nil {
+		return err
+	}
+	if sums.SHA256 != nil {
+		if sum := sha256.Sum256(body); !bytes.Equal(sum[:], sums.SHA256) {
+			return fmt.Errorf("body does not match %s", HeaderChecksumSHA256)
+		}
+	}
+	return json.Unmarshal(body, v)
+}
+
+// ServeStats serves the cache accounting and the last scrub report as JSON.
+func (s *Service) ServeStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, r, AuthClassAdmin) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(AdminStats{Cache: s.Cache.Stats(), Scrub: s.Cache.ScrubReport()})
+}
+
+// adminURL is the base URL of the admin listener of a local edgie.
+func adminURL() string {
+	host, port, err := net.SplitHostPort(viper.GetString(OPT_ADMIN_ADDR))
+	if err != nil || host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	scheme := "http"
+	if viper.GetString(common.OPT_TLS_CERT_FILE) != "" {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
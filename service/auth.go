@@ -0,0 +1,752 @@
+package service
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jkassis/edgie/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Route classes. Each has its own authentication.
+const (
+	AuthClassAdmin   = "admin"
+	AuthClassMetrics = "metrics"
+	AuthClassRead    = "read"
+	AuthClassWrite   = "write"
+)
+
+// Authentication schemes for AUTH_READ, AUTH_WRITE, AUTH_ADMIN and AUTH_METRICS.
+const (
+	AuthSchemeBearer = "bearer"
+	AuthSchemeHMAC   = "hmac"
+	AuthSchemeJWT    = "jwt"
+	AuthSchemeMTLS   = "mtls"
+	AuthSchemeURL    = "url"
+)
+
+const (
+	HeaderDate = "X-Edgie-Date"
+
+	// HMAC-signed requests are refused when their date is further than this from ours
+	authHMACSkewMax = 5 * time.Minute
+	// leeway for the exp and nbf claims of a JWT
+	authJWTLeeway = time.Minute
+)
+
+var (
+	// ErrAuthMissing means the request carries no credentials a scheme understands. It maps to 401.
+	ErrAuthMissing = errors.New("no credentials")
+	// ErrAuthInvalid means the credentials are malformed, unknown, expired or badly signed. It maps to 401.
+	ErrAuthInvalid = errors.New("invalid credentials")
+	// ErrAuthForbidden means the credentials are good but not for this class of route. It maps to 403.
+	ErrAuthForbidden = errors.New("credentials not allowed here")
+)
+
+var authFailureCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "edgie_auth_failures_total",
+	Help: "Total number of requests refused by authentication, by route class and reason: missing, invalid or forbidden.",
+}, []string{"class", "reason"})
+
+// Authenticator checks the credentials of a request for a class of route.
+type Authenticator interface {
+	Authenticate(r *http.Request, class string) error
+}
+
+// AuthConf holds the Authenticator of each class of route. A nil one lets every request through.
+type AuthConf struct {
+	Admin   Authenticator
+	Metrics Authenticator
+	Read    Authenticator
+	Write   Authenticator
+}
+
+func (c AuthConf) of(class string) Authenticator {
+	switch class {
+	case AuthClassAdmin:
+		return c.Admin
+	case AuthClassMetrics:
+		return c.Metrics
+	case AuthClassRead:
+		return c.Read
+	case AuthClassWrite:
+		return c.Write
+	}
+	return nil
+}
+
+// authorize authenticates r for class and writes the 401 or 403 response when that fails.
+func (s *Service) authorize(w http.ResponseWriter, r *http.Request, class string) bool {
+	_, err := s.authCheck(r, class)
+	if err != nil {
+		s.authRefuse(w, r, class, err)
+		return false
+	}
+	return true
+}
+
+// authCheck authenticates r for class and names the credential it verified,
+// or returns "" when class is open.
+func (s *Service) authCheck(r *http.Request, class string) (string, error) {
+	auth := s.Conf.Auth.of(class)
+	if auth == nil {
+		return "", nil
+	}
+	accepted, err := authenticate(auth, r, class)
+	if err != nil {
+		return "", err
+	}
+	return authIdentity(accepted, r), nil
+}
+
+// authRefuse writes the 401 or 403 response for an authCheck error.
+func (s *Service) authRefuse(w http.ResponseWriter, r *http.Request, class string, err error) {
+	auth := s.Conf.Auth.of(class)
+	switch {
+	case errors.Is(err, ErrAuthForbidden):
+		authFailureCounter.WithLabelValues(class, "forbidden").Inc()
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	case errors.Is(err, ErrAuthMissing):
+		authFailureCounter.WithLabelValues(class, "missing").Inc()
+		authChallenge(w, auth)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	default:
+		log.Infof("refused %s %s: %v", r.Method, r.URL.Path, err)
+		authFailureCounter.WithLabelValues(class, "invalid").Inc()
+		authChallenge(w, auth)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// authenticate runs auth and returns the Authenticator that accepted r,
+// which is auth itself unless it is an authAny.
+func authenticate(auth Authenticator, r *http.Request, class string) (Authenticator, error) {
+	auths, ok := auth.(authAny)
+	if !ok {
+		return auth, auth.Authenticate(r, class)
+	}
+	var worst error
+	for _, auth := range auths {
+		accepted, err := authenticate(auth, r, class)
+		if err == nil {
+			return accepted, nil
+		}
+		if worst == nil || authRank(err) > authRank(worst) {
+			worst = err
+		}
+	}
+	if worst == nil {
+		return nil, ErrAuthMissing
+	}
+	return nil, worst
+}
+
+// authIdentity names the credential in r that auth accepted. Bearer tokens
+// and client certs are named by digest. Signed URLs are named by signature,
+// so each URL minted with a key gets its own bucket.
+func authIdentity(auth Authenticator, r *http.Request) string {
+	switch auth.(type) {
+	case *authBearer, *authJWT:
+		token, _ := authBearerToken(r)
+		sum := sha256.Sum256([]byte(token))
+		return "bearer:" + string(sum[:])
+	case *authHMAC:
+		_, credential, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		keyID, _, _ := strings.Cut(strings.TrimSpace(credential), ":")
+		return "hmac:" + keyID
+	case *authURL:
+		return "url:" + r.URL.Query().Get(SignedURLSignature)
+	case authMTLS:
+		sum := sha256.Sum256(r.TLS.VerifiedChains[0][0].Raw)
+		return "mtls:" + string(sum[:])
+	}
+	return ""
+}
+
+// authChallenge names the schemes auth takes in WWW-Authenticate.
+func authChallenge(w http.ResponseWriter, auth Authenticator) {
+	challenges := map[string]bool{}
+	var add func(auth Authenticator)
+	add = func(auth Authenticator) {
+		switch a := auth.(type) {
+		case authAny:
+			for _, auth := range a {
+				add(auth)
+			}
+		case *authHMAC:
+			challenges[`HMAC realm="edgie"`] = true
+		case *authURL:
+			// signed URLs are handed out, not asked for
+		case authMTLS:
+			// client certs are sent in the handshake, not asked for
+		default:
+			challenges[`Bearer realm="edgie"`] = true
+		}
+	}
+	add(auth)
+	for challenge := range challenges {
+		w.Header().Add("WWW-Authenticate", challenge)
+	}
+}
+
+// authAny accepts a request that any of its authenticators accepts. When
+// none does, it reports the most telling failure: forbidden, then invalid,
+// then missing.
+type authAny []Authenticator
+
+func (a authAny) Authenticate(r *http.Request, class string) error {
+	_, err := authenticate(a, r, class)
+	return err
+}
+
+func authRank(err error) int {
+	switch {
+	case errors.Is(err, ErrAuthForbidden):
+		return 2
+	case errors.Is(err, ErrAuthMissing):
+		return 0
+	}
+	return 1
+}
+
+// authScopes are the route classes a credential is good for. Nil allows all of them.
+type authScopes map[string]bool
+
+func authScopesParse(fields []string) authScopes {
+	if len(fields) == 0 {
+		return nil
+	}
+	scopes := authScopes{}
+	for _, field := range fields {
+		for _, scope := range strings.Split(field, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				scopes[scope] = true
+			}
+		}
+	}
+	return scopes
+}
+
+func (scopes authScopes) allow(class string) error {
+	if scopes != nil && !scopes[class] {
+		return ErrAuthForbidden
+	}
+	return nil
+}
+
+// authBearerToken returns the token of an Authorization: Bearer header.
+func authBearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// authBearer takes static bearer tokens. It keeps their digests, so lookups
+// don't leak the tokens through timing.
+type authBearer struct {
+	tokens map[[sha256.Size]byte]authScopes
+}
+
+func (a *authBearer) Authenticate(r *http.Request, class string) error {
+	token, ok := authBearerToken(r)
+	if !ok {
+		return ErrAuthMissing
+	}
+	scopes, ok := a.tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return fmt.Errorf("%w: unknown bearer token", ErrAuthInvalid)
+	}
+	return scopes.allow(class)
+}
+
+// authBearerLoad reads a tokens file with one token per line, optionally
+// followed by the classes it is good for.
+func authBearerLoad(tokensPath string) (*authBearer, error) {
+	a := &authBearer{tokens: make(map[[sha256.Size]byte]authScopes)}
+	err := authFileScan(tokensPath, func(fields []string) error {
+		a.tokens[sha256.Sum256([]byte(fields[0]))] = authScopesParse(fields[1:])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// authMTLS takes requests whose TLS client cert was verified against
+// TLS_CA_FILE. Any such cert is good for every class that names mtls.
+type authMTLS struct{}
+
+func (authMTLS) Authenticate(r *http.Request, class string) error {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ErrAuthMissing
+	}
+	return nil
+}
+
+// authHMAC takes requests signed with a shared key. See AuthHMACSign.
+type authHMAC struct {
+	keys map[string]authHMACKey
+}
+
+type authHMACKey struct {
+	secret []byte
+	scopes authScopes
+}
+
+// authHMACPayload is what an HMAC-signed request signs. The checksum header
+// binds the body, which Upload checks against it.
+func authHMACPayload(r *http.Request, date string) []byte {
+	return []byte(strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		date,
+		r.Header.Get(HeaderChecksumSHA256),
+	}, "\n"))
+}
+
+// AuthHMACSign signs r with the key keyID for HMAC authentication. It sets
+// X-Edgie-Date and an Authorization header of the form "HMAC keyID:signature".
+// Uploads must set x-amz-checksum-sha256 before signing so the body is covered.
+func AuthHMACSign(r *http.Request, keyID string, secret []byte, now time.Time) {
+	date := now.UTC().Format(time.RFC3339)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(authHMACPayload(r, date))
+	r.Header.Set(HeaderDate, date)
+	r.Header.Set("Authorization", "HMAC "+keyID+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func (a *authHMAC) Authenticate(r *http.Request, class string) error {
+	scheme, credential, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "HMAC") {
+		return ErrAuthMissing
+	}
+	if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.Header.Get(HeaderChecksumSHA256) == "" {
+		return fmt.Errorf("%w: HMAC-signed uploads need %s", ErrAuthInvalid, HeaderChecksumSHA256)
+	}
+	keyID, sigB64, ok := strings.Cut(strings.TrimSpace(credential), ":")
+	if !ok {
+		return fmt.Errorf("%w: malformed HMAC credential", ErrAuthInvalid)
+	}
+	key, ok := a.keys[keyID]
+	if !ok {
+		return fmt.Errorf("%w: unknown HMAC key %s", ErrAuthInvalid, keyID)
+	}
+	sig, err := base64.StdEncoding.DecodeString(sigB64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed HMAC signature", ErrAuthInvalid)
+	}
+
+	date := r.Header.Get(HeaderDate)
+	signedAt, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return fmt.Errorf("%w: bad %s", ErrAuthInvalid, HeaderDate)
+	}
+	if skew := time.Since(signedAt); skew > authHMACSkewMax || skew < -authHMACSkewMax {
+		return fmt.Errorf("%w: %s is %v off", ErrAuthInvalid, HeaderDate, skew.Round(time.Second))
+	}
+
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write(authHMACPayload(r, date))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return fmt.Errorf("%w: bad HMAC signature for key %s", ErrAuthInvalid, keyID)
+	}
+	return key.scopes.allow(class)
+}
+
+// authHMACLoad reads a keys file with one "keyID base64secret" per line,
+// optionally followed by the classes the key is good for.
+func authHMACLoad(keysPath string) (*authHMAC, error) {
+	a := &authHMAC{keys: make(map[string]authHMACKey)}
+	err := authFileScan(keysPath, func(fields []string) error {
+		if len(fields) < 2 {
+			return fmt.Errorf("HMAC key %s has no secret", fields[0])
+		}
+		secret, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(secret) < 16 {
+			return fmt.Errorf("HMAC key %s needs a base64 secret of at least 16 bytes", fields[0])
+		}
+		a.keys[fields[0]] = authHMACKey{secret: secret, scopes: authScopesParse(fields[2:])}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// authJWT takes JWT bearer tokens signed by a key of a local JWKS. Tokens
+// need an exp claim and a scope (or scp) claim naming the route class.
+type authJWT struct {
+	audience string
+	issuer   string
+	keys     map[string]crypto.PublicKey
+}
+
+type authJWTClaims struct {
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	Issuer    string          `json:"iss"`
+	NotBefore *int64          `json:"nbf"`
+	Scope     string          `json:"scope"`
+	Scp       json.RawMessage `json:"scp"`
+}
+
+func (a *authJWT) Authenticate(r *http.Request, class string) error {
+	token, ok := authBearerToken(r)
+	if !ok {
+		return ErrAuthMissing
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: not a JWT", ErrAuthInvalid)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := authJWTDecode(parts[0], &header); err != nil {
+		return err
+	}
+	key, ok := a.keys[header.Kid]
+	if !ok && header.Kid == "" && len(a.keys) == 1 {
+		for _, only := range a.keys {
+			key, ok = only, true
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%w: unknown JWT key %q", ErrAuthInvalid, header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: malformed JWT signature", ErrAuthInvalid)
+	}
+	if err := authJWTVerify(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return err
+	}
+
+	var claims authJWTClaims
+	if err := authJWTDecode(parts[1], &claims); err != nil {
+		return err
+	}
+	now := time.Now()
+	if claims.ExpiresAt == nil || now.After(time.Unix(*claims.ExpiresAt, 0).Add(authJWTLeeway)) {
+		return fmt.Errorf("%w: JWT expired or has no exp", ErrAuthInvalid)
+	}
+	if claims.NotBefore != nil && now.Add(authJWTLeeway).Before(time.Unix(*claims.NotBefore, 0)) {
+		return fmt.Errorf("%w: JWT not valid yet", ErrAuthInvalid)
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return fmt.Errorf("%w: JWT issuer %q", ErrAuthInvalid, claims.Issuer)
+	}
+	if a.audience != "" && !authJWTStrings(claims.Audience)[a.audience] {
+		return fmt.Errorf("%w: JWT is not for audience %s", ErrAuthInvalid, a.audience)
+	}
+
+	scopes := authJWTStrings(claims.Scp)
+	for _, scope := range strings.Fields(claims.Scope) {
+		scopes[scope] = true
+	}
+	if !scopes[class] {
+		return ErrAuthForbidden
+	}
+	return nil
+}
+
+// authJWTDecode decodes a base64url JSON part of a JWT.
+func authJWTDecode(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: malformed JWT: %v", ErrAuthInvalid, err)
+	}
+	return nil
+}
+
+// authJWTStrings reads a claim that is a string or a list of strings, or a space separated string.
+func authJWTStrings(raw json.RawMessage) map[string]bool {
+	values := map[string]bool{}
+	var one string
+	var many []string
+	if json.Unmarshal(raw, &one) == nil {
+		many = strings.Fields(one)
+	} else {
+		json.Unmarshal(raw, &many)
+	}
+	for _, value := range many {
+		values[value] = true
+	}
+	return values
+}
+
+// authJWTVerify checks the JWS signature sig of signed. The alg must suit
+// the key, so a token can't pick a weaker check than the key was made for.
+func authJWTVerify(alg string, key crypto.PublicKey, signed []byte, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+	default:
+		return fmt.Errorf("%w: JWT alg %q is not supported", ErrAuthInvalid, alg)
+	}
+
+	ok := false
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			digest := hash.New()
+			digest.Write(signed)
+			ok = rsa.VerifyPKCS1v15(key, hash, digest.Sum(nil), sig) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if authJWTCurves[alg] == key.Curve && len(sig) == 2*size {
+			digest := hash.New()
+			digest.Write(signed)
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			ok = ecdsa.Verify(key, digest.Sum(nil), r, s)
+		}
+	case ed25519.PublicKey:
+		ok = alg == "EdDSA" && ed25519.Verify(key, signed, sig)
+	}
+	if !ok {
+		return fmt.Errorf("%w: bad JWT signature", ErrAuthInvalid)
+	}
+	return nil
+}
+
+// authJWTCurves is the curve each ECDSA alg is defined for.
+var authJWTCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// authJWKSLoad reads the public keys of a JWKS file by kid.
+func authJWKSLoad(jwksPath string) (map[string]crypto.PublicKey, error) {
+	data, err := os.ReadFile(jwksPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read AUTH_JWKS_FILE: %v", err)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("AUTH_JWKS_FILE is not a JWKS: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		b64 := func(field string) *big.Int {
+			data, err := base64.RawURLEncoding.DecodeString(field)
+			if err != nil || len(data) == 0 {
+				return nil
+			}
+			return new(big.Int).SetBytes(data)
+		}
+		switch jwk.Kty {
+		case "RSA":
+			n, e := b64(jwk.N), b64(jwk.E)
+			if n == nil || e == nil || !e.IsInt64() {
+				return nil, fmt.Errorf("JWKS key %q is not a valid RSA key", jwk.Kid)
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("JWKS key %q has unsupported curve %s", jwk.Kid, jwk.Crv)
+			}
+			x, y := b64(jwk.X), b64(jwk.Y)
+			if x == nil || y == nil || !curve.IsOnCurve(x, y) {
+				return nil, fmt.Errorf("JWKS key %q is not a valid EC key", jwk.Kid)
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if jwk.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("JWKS key %q is not a valid Ed25519 key", jwk.Kid)
+			}
+			keys[jwk.Kid] = ed25519.PublicKey(x)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("AUTH_JWKS_FILE has no signing keys")
+	}
+	return keys, nil
+}
+
+// authFileScan calls fn with the fields of each line of a credentials file,
+// skipping blank lines and # comments.
+func authFileScan(filePath string, fn func(fields []string) error) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if err := fn(fields); err != nil {
+			return fmt.Errorf("%s: %v", filePath, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// AuthCmdExecute reads the auth options. Each scheme's credentials are
+// loaded once and shared by the classes that name it.
+func AuthCmdExecute() (AuthConf, error) {
+	schemes := map[string]Authenticator{}
+	scheme := func(name string) (Authenticator, error) {
+		if auth, ok := schemes[name]; ok {
+			return auth, nil
+		}
+		var auth Authenticator
+		switch name {
+		case AuthSchemeBearer:
+			tokensPath := viper.GetString(OPT_AUTH_BEARER_FILE)
+			if tokensPath == "" {
+				return nil, errors.New("AUTH_BEARER_FILE not specified")
+			}
+			bearer, err := authBearerLoad(tokensPath)
+			if err != nil {
+				return nil, fmt.Errorf("could not load AUTH_BEARER_FILE: %v", err)
+			}
+			auth = bearer
+		case AuthSchemeHMAC:
+			keysPath := viper.GetString(OPT_AUTH_HMAC_FILE)
+			if keysPath == "" {
+				return nil, errors.New("AUTH_HMAC_FILE not specified")
+			}
+			hmacAuth, err := authHMACLoad(keysPath)
+			if err != nil {
+				return nil, fmt.Errorf("could not load AUTH_HMAC_FILE: %v", err)
+			}
+			auth = hmacAuth
+		case AuthSchemeJWT:
+			jwksPath := viper.GetString(OPT_AUTH_JWKS_FILE)
+			if jwksPath == "" {
+				return nil, errors.New("AUTH_JWKS_FILE not specified")
+			}
+			keys, err := authJWKSLoad(jwksPath)
+			if err != nil {
+				return nil, err
+			}
+			auth = &authJWT{
+				audience: viper.GetString(OPT_AUTH_JWT_AUDIENCE),
+				issuer:   viper.GetString(OPT_AUTH_JWT_ISSUER),
+				keys:     keys,
+			}
+		case AuthSchemeMTLS:
+			if viper.GetString(common.OPT_TLS_CA_FILE) == "" {
+				return nil, errors.New("TLS_CA_FILE not specified")
+			}
+			auth = authMTLS{}
+		case AuthSchemeURL:
+			keysPath := viper.GetString(OPT_AUTH_URL_KEYS_FILE)
+			if keysPath == "" {
+				return nil, errors.New("AUTH_URL_KEYS_FILE not specified")
+			}
+			_, keys, err := signKeysLoad(keysPath)
+			if err != nil {
+				return nil, fmt.Errorf("could not load AUTH_URL_KEYS_FILE: %v", err)
+			}
+			auth = &authURL{keys: keys}
+		default:
+			return nil, fmt.Errorf("unknown auth scheme %s", name)
+		}
+		schemes[name] = auth
+		return auth, nil
+	}
+
+	class := func(opt string) (Authenticator, error) {
+		var auths authAny
+		for _, name := range strings.Split(viper.GetString(opt), ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			auth, err := scheme(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", opt, err)
+			}
+			auths = append(auths, auth)
+		}
+		switch len(auths) {
+		case 0:
+			return nil, nil
+		case 1:
+			return auths[0], nil
+		}
+		return auths, nil
+	}
+
+	var conf AuthConf
+	var err error
+	if conf.Admin, err = class(OPT_AUTH_ADMIN); err != nil {
+		return conf, err
+	}
+	if conf.Metrics, err = class(OPT_AUTH_METRICS); err != nil {
+		return conf, err
+	}
+	if conf.Read, err = class(OPT_AUTH_READ); err != nil {
+		return conf, err
+	}
+	if conf.Write, err = class(OPT_AUTH_WRITE); err != nil {
+		return conf, err
+	}
+	return conf, nil
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jkassis/edgie/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// variantKeyPrefix namespaces compressed variants in the cache away from object keys.
+const variantKeyPrefix = ".edgie-enc/"
+
+const (
+	variantSourceCompressed = "compressed"
+	variantSourceSibling    = "sibling"
+)
+
+var variantFillCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "edgie_variant_fills_total",
+	Help: "Total number of compressed variants cached, by encoding and source.",
+}, []string{"encoding", "source"})
+
+// variantKey names the cache entry holding key compressed with encoding.
+func variantKey(key string, encoding string) string {
+	return variantKeyPrefix + encoding + "/" + key
+}
+
+// variantGet returns the cached variant of fce to serve for acceptEncoding,
+// filling it on first use. It returns nil to serve the identity content, as
+// it does for entries over CompressBytesMax or served with sendfile, which
+// would have to be read into RAM to compress.
+func (s *Service) variantGet(key string, fce *common.FileCacheEntry, contentType string, acceptEncoding string) (*common.FileCacheEntry, string) {
+	if fce.Size < s.Conf.CompressBytesMin || !common.ContentTypeCompressible(contentType) {
+		return nil, ""
+	}
+	if fce.Size > s.Conf.CompressBytesMax || s.Cache.SendfileUses(fce.Size) {
+		return nil, ""
+	}
+
+	encoding := common.EncodingNegotiate(acceptEncoding, s.Conf.CompressEncodings)
+	if encoding == common.EncodingIdentity {
+		return nil, ""
+	}
+
+	vce, err := s.Cache.Get(variantKey(key, encoding))
+	if errors.Is(err, os.ErrNotExist) {
+		vce, err = s.variantFill(key, encoding, fce, contentType)
+	}
+	if err != nil {
+		log.Warnf("could not get %s variant of %s: %v", encoding, key, err)
+		return nil, ""
+	}
+	if vce == nil {
+		return nil, ""
+	}
+	return vce, encoding
+}
+
+// variantFill caches the encoding variant of fce, preferring a precompressed
+// sibling (key.br, key.gz) over compressing fce ourselves.
+func (s *Service) variantFill(key string, encoding string, fce *common.FileCacheEntry, contentType string) (*common.FileCacheEntry, error) {
+	s.keyLock.Lock(key)
+	defer s.keyLock.Unlock(key)
+
+	// another fill may have won the race for the lock
+	vkey := variantKey(key, encoding)
+	vce, err := s.Cache.Get(vkey)
+	if !errors.Is(err, os.ErrNotExist) {
+		return vce, err
+	}
+
+	// the identity changed while we waited... don't cache a variant of stale bytes
+	if stat, err := s.Cache.Stat(key); err != nil || stat.ETag != fce.ETag {
+		return nil, nil
+	}
+
+	meta := common.FileCacheMeta{ContentType: contentType}
+
+	// a sibling only matches an identity that came from the same place
+	if _, err := os.Stat(s.uploadPath(key)); os.IsNotExist(err) {
+		sibling, err := s.siblingOpen(key + common.EncodingExt[encoding])
+		if err == nil {
+			defer sibling.Close()
+			variantFillCounter.WithLabelValues(encoding, variantSourceSibling).Inc()
+			return s.Cache.Put(vkey, sibling, meta)
+		}
+		// with no origin slot free, compressing it here is the better deal anyway
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrBusy) {
+			log.Warnf("could not open %s sibling of %s: %v", encoding, key, err)
+		}
+	}
+
+	identity, err := fce.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	data, err := common.EncodingCompress(encoding, identity)
+	if err != nil {
+		return nil, err
+	}
+	variantFillCounter.WithLabelValues(encoding, variantSourceCompressed).Inc()
+	return s.Cache.Put(vkey, bytes.NewReader(data), meta)
+}
+
+// siblingOpen opens a precompressed sibling with the same source ranking as Download,
+// but without caching it as an object of its own. A sibling from S3 holds an
+// origin slot until it is closed, and fails with ErrBusy when there is none.
+func (s *Service) siblingOpen(siblingKey string) (io.ReadCloser, error) {
+	uploadFile, err := os.Open(s.uploadPath(siblingKey))
+	if err == nil {
+		return uploadFile, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if _, err := os.Stat(s.deletePath(siblingKey)); err == nil {
+		return nil, os.ErrNotExist
+	}
+
+	if err := slotAcquire(s.originSlots, "origin", false); err != nil {
+		return nil, err
+	}
+	sess, _ := common.AWSSessionGet(s.Conf.S3.Region)
+	s3Client := s3.New(sess, aws.NewConfig().WithRegion(s.Conf.S3.Region))
+	s3Resp, err := common.S3FileDownload(siblingKey, s.Conf.S3.Bucket, s3Client)
+	if err != nil {
+		slotRelease(s.originSlots)
+		return nil, err
+	}
+	return &slotReadCloser{ReadCloser: s3Resp.Body, slots: s.originSlots}, nil
+}
+
+// variantsDelete drops every compressed variant of key. Callers hold the key lock.
+func (s *Service) variantsDelete(key string) error {
+	for encoding := range common.EncodingExt {
+		if err := s.Cache.Delete(variantKey(key, encoding)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// variantsDeleteForSibling drops the variant that key supplies when key is a
+// precompressed sibling (e.g. app.js.br for app.js). Callers must not hold a key lock.
+func (s *Service) variantsDeleteForSibling(key string) {
+	for encoding, ext := range common.EncodingExt {
+		if baseKey, ok := strings.CutSuffix(key, ext); ok && baseKey != "" {
+			s.keyLock.Lock(baseKey)
+			if err := s.Cache.Delete(variantKey(baseKey, encoding)); err != nil {
+				log.Errorf("could not invalidate %s variant of %s: %v", encoding, baseKey, err)
+			}
+			s.keyLock.Unlock(baseKey)
+		}
+	}
+}
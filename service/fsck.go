@@ -0,0 +1,23 @@
+package service
+
+import (
+	"github.com/jkassis/edgie/common"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	OPT_FSCK_REPAIR = "FSCK_REPAIR"
+)
+
+// FsckCmdInit adds the options for the fsck subcommand. The cache options come from the parent.
+func FsckCmdInit(cmd *cobra.Command) {
+	cmd.Flags().Bool(OPT_FSCK_REPAIR, false, "remove the corrupt and temp files that fsck finds")
+	viper.BindPFlag(OPT_FSCK_REPAIR, cmd.Flags().Lookup(OPT_FSCK_REPAIR))
+}
+
+// FsckCmdExecute checks the cache dir of a stopped edgie.
+func FsckCmdExecute(cmd *cobra.Command, args []string) (*common.FileCacheFsckReport, error) {
+	common.CmdExecute(cmd, args)
+	return common.FileCacheFsck(CacheCmdExecute(cmd, args), viper.GetBool(OPT_FSCK_REPAIR))
+}
@@ -0,0 +1,350 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jkassis/edgie/common"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HeaderContentMD5     = "Content-MD5"
+	HeaderChecksumSHA256 = "x-amz-checksum-sha256"
+	HeaderTier           = "X-Edgie-Tier"
+)
+
+// ServeHTTP serves file traffic: GET reads through the cache, HEAD and GET ?stat
+// describe an object, GET ?list lists a prefix, PUT and POST upload, DELETE deletes.
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// address and prefix limits come before auth, so floods of bad credentials are limited too
+	if !s.limit(w, r, "", false) {
+		return
+	}
+
+	class := ""
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		class = AuthClassRead
+	case http.MethodPut, http.MethodPost, http.MethodDelete:
+		class = AuthClassWrite
+	}
+	var identity string
+	if class != "" {
+		var err error
+		if identity, err = s.authCheck(r, class); err != nil {
+			// a refused credential names no one, so its client address pays
+			if s.limit(w, r, "", true) {
+				s.authRefuse(w, r, class, err)
+			}
+			return
+		}
+	}
+	if !s.limit(w, r, identity, true) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Has("list") {
+			s.serveList(w, r)
+		} else if r.URL.Query().Has("stat") {
+			s.serveStat(w, r)
+		} else {
+			s.serveGet(w, r)
+		}
+	case http.MethodHead:
+		s.serveHead(w, r)
+	case http.MethodPut, http.MethodPost:
+		s.servePut(w, r)
+	case http.MethodDelete:
+		s.serveDelete(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Service) serveGet(w http.ResponseWriter, r *http.Request) {
+	path := filepath.Clean(r.URL.Path)
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	fileReader, info, err := s.DownloadEncoded(path, r.Header.Get("Accept-Encoding"), client)
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if errors.Is(err, common.ErrKeyInvalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, ErrBusy) {
+		limitRetryAfter(w, limitBusyRetryAfter)
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		log.Errorf("download of %s failed: %v", path, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer fileReader.Close()
+
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Vary", "Accept-Encoding")
+	if info.ContentEncoding != "" {
+		w.Header().Set("Content-Encoding", info.ContentEncoding)
+	}
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+	io.Copy(w, fileReader)
+}
+
+func (s *Service) serveHead(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.statOrError(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Content-Type", info.ContentType)
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+	w.Header().Set(HeaderTier, info.Tier)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) serveStat(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.statOrError(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// statOrError stats the request path and writes the error response when it fails.
+func (s *Service) statOrError(w http.ResponseWriter, r *http.Request) (*ObjectInfo, bool) {
+	path := filepath.Clean(r.URL.Path)
+	info, err := s.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return nil, false
+	} else if errors.Is(err, common.ErrKeyInvalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	} else if err != nil {
+		log.Errorf("stat of %s failed: %v", path, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return info, true
+}
+
+var listHTML = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html>
+<head><title>/{{.Prefix}}</title></head>
+<body>
+<h1>/{{.Prefix}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Last Modified</th></tr>
+{{- range .Entries}}
+<tr><td><a href="{{if .Dir}}{{$.DirURL .Key}}{{else}}/{{.Key}}{{end}}">{{.Key}}</a></td><td>{{if not .Dir}}{{.Size}}{{end}}</td><td>{{with .LastModified}}{{.Format "2006-01-02 15:04:05Z07:00"}}{{end}}</td></tr>
+{{- end}}
+</table>
+{{- with .NextToken}}
+<p><a href="{{$.NextURL .}}">Next page</a></p>
+{{- end}}
+</body>
+</html>
+`))
+
+// listPage is a listing rendered as HTML. Its links keep the format,
+// delimiter and limit of the request that made it.
+type listPage struct {
+	*Listing
+	query url.Values
+}
+
+// DirURL lists the directory key with the same params.
+func (p listPage) DirURL(key string) string {
+	query := p.listQuery()
+	return (&url.URL{Path: "/" + key, RawQuery: query.Encode()}).String()
+}
+
+// NextURL is the next page of this listing.
+func (p listPage) NextURL(token string) string {
+	query := p.listQuery()
+	query.Set("token", token)
+	return (&url.URL{Path: "/" + p.Prefix, RawQuery: query.Encode()}).String()
+}
+
+func (p listPage) listQuery() url.Values {
+	query := url.Values{"list": {""}}
+	for _, param := range []string{"delimiter", "format", "limit"} {
+		if p.query.Has(param) {
+			query.Set(param, p.query.Get(param))
+		}
+	}
+	return query
+}
+
+// serveList lists the request path as a prefix. Query params: delimiter
+// (default "/", empty for a recursive listing), limit, token and format=html.
+func (s *Service) serveList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	prefix := keyClean(r.URL.Path)
+	if prefix != "" && strings.HasSuffix(r.URL.Path, "/") {
+		prefix += "/"
+	}
+
+	delimiter := "/"
+	if query.Has("delimiter") {
+		delimiter = query.Get("delimiter")
+	}
+
+	limit := ListLimitMax
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	listing, err := s.List(prefix, delimiter, query.Get("token"), limit)
+	if errors.Is(err, ErrListToken) {
+		http.Error(w, "Invalid continuation token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Errorf("list of %s failed: %v", prefix, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if query.Get("format") == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		listHTML.Execute(w, listPage{Listing: listing, query: query})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+func (s *Service) servePut(w http.ResponseWriter, r *http.Request) {
+	path := filepath.Clean(r.URL.Path)
+	if path == "/" {
+		http.Error(w, "Missing object path", http.StatusBadRequest)
+		return
+	}
+
+	if r.ContentLength > s.Conf.UploadBytesMax {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	sums, err := uploadChecksumsParse(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentType, err := uploadContentTypeParse(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, s.Conf.UploadBytesMax)
+	result, err := s.Upload(path, body, sums, contentType)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		} else if errors.Is(err, common.ErrChecksumMismatch) {
+			http.Error(w, "Body does not match checksum", http.StatusBadRequest)
+		} else if errors.Is(err, common.ErrKeyInvalid) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, ErrBusy) {
+			limitRetryAfter(w, limitBusyRetryAfter)
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		} else {
+			log.Errorf("upload of %s failed: %v", path, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("ETag", result.ETag)
+	if result.Created {
+		w.Header().Set("Location", r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Service) serveDelete(w http.ResponseWriter, r *http.Request) {
+	path := filepath.Clean(r.URL.Path)
+	if path == "/" {
+		http.Error(w, "Missing object path", http.StatusBadRequest)
+		return
+	}
+
+	err := s.Delete(path)
+	if errors.Is(err, common.ErrKeyInvalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Errorf("delete of %s failed: %v", path, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadChecksumsParse decodes the base64 digests a client may send with an upload.
+func uploadChecksumsParse(header http.Header) (sums UploadChecksums, err error) {
+	if v := header.Get(HeaderContentMD5); v != "" {
+		if sums.MD5, err = base64.StdEncoding.DecodeString(v); err != nil || len(sums.MD5) != 16 {
+			return sums, fmt.Errorf("invalid %s header", HeaderContentMD5)
+		}
+	}
+	if v := header.Get(HeaderChecksumSHA256); v != "" {
+		if sums.SHA256, err = base64.StdEncoding.DecodeString(v); err != nil || len(sums.SHA256) != 32 {
+			return sums, fmt.Errorf("invalid %s header", HeaderChecksumSHA256)
+		}
+	}
+	return sums, nil
+}
+
+// uploadContentTypeParse returns the Content-Type of an upload, or "" when
+// the client sent none and it should be detected.
+func uploadContentTypeParse(header http.Header) (string, error) {
+	v := header.Get("Content-Type")
+	if v == "" {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return "", errors.New("invalid Content-Type header")
+	}
+	// curl -d sends this whatever the body is
+	if mediaType == "application/x-www-form-urlencoded" {
+		return "", nil
+	}
+	return mime.FormatMediaType(mediaType, params), nil
+}
@@ -1,13 +1,20 @@
 package service
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -23,12 +30,46 @@ import (
 
 // CLI Options and Arg Parsing
 const (
-	OPT_CACHE_DIR            = "CACHE_DIR"
-	OPT_CACHE_DISK_BYTES_MAX = "CACHE_DISK_BYTES_MAX"
-	OPT_CACHE_EVICTION_TICK  = "CACHE_EVICTION_TICK"
-	OPT_CACHE_RAM_BYTES_MAX  = "CACHE_RAM_BYTES_MAX"
-	OPT_SYNC_DELAY           = "SYNC_DELAY"
-	OPT_UPLOAD_DIR           = "UPLOAD_DIR"
+	OPT_ADMIN_ADDR               = "ADMIN_ADDR"
+	OPT_AUTH_ADMIN               = "AUTH_ADMIN"
+	OPT_AUTH_BEARER_FILE         = "AUTH_BEARER_FILE"
+	OPT_AUTH_HMAC_FILE           = "AUTH_HMAC_FILE"
+	OPT_AUTH_JWKS_FILE           = "AUTH_JWKS_FILE"
+	OPT_AUTH_JWT_AUDIENCE        = "AUTH_JWT_AUDIENCE"
+	OPT_AUTH_JWT_ISSUER          = "AUTH_JWT_ISSUER"
+	OPT_AUTH_METRICS             = "AUTH_METRICS"
+	OPT_AUTH_READ                = "AUTH_READ"
+	OPT_AUTH_URL_KEYS_FILE       = "AUTH_URL_KEYS_FILE"
+	OPT_AUTH_WRITE               = "AUTH_WRITE"
+	OPT_CACHE_DIR                = "CACHE_DIR"
+	OPT_CACHE_DISK_BYTES_MAX     = "CACHE_DISK_BYTES_MAX"
+	OPT_CACHE_DISK_COMPRESSION   = "CACHE_DISK_COMPRESSION"
+	OPT_CACHE_EVICTION_TICK      = "CACHE_EVICTION_TICK"
+	OPT_CACHE_INDEX_SNAPSHOT     = "CACHE_INDEX_SNAPSHOT"
+	OPT_CACHE_KEY                = "CACHE_KEY"
+	OPT_CACHE_KEY_FILE           = "CACHE_KEY_FILE"
+	OPT_CACHE_PINNED             = "CACHE_PINNED"
+	OPT_CACHE_QUOTAS             = "CACHE_QUOTAS"
+	OPT_CACHE_RAM_BYTES_MAX      = "CACHE_RAM_BYTES_MAX"
+	OPT_CACHE_RAM_COMPRESSED     = "CACHE_RAM_COMPRESSED"
+	OPT_CACHE_RAM_MMAP           = "CACHE_RAM_MMAP"
+	OPT_CACHE_SCRUB_INTERVAL     = "CACHE_SCRUB_INTERVAL"
+	OPT_CACHE_SENDFILE_BYTES_MIN = "CACHE_SENDFILE_BYTES_MIN"
+	OPT_CACHE_TIERS              = "CACHE_TIERS"
+	OPT_COMPRESS_BYTES_MAX       = "COMPRESS_BYTES_MAX"
+	OPT_COMPRESS_BYTES_MIN       = "COMPRESS_BYTES_MIN"
+	OPT_COMPRESS_ENCODINGS       = "COMPRESS_ENCODINGS"
+	OPT_DELETE_DIR               = "DELETE_DIR"
+	OPT_METRICS_ADDR             = "METRICS_ADDR"
+	OPT_ORIGIN_FETCHES_MAX       = "ORIGIN_FETCHES_MAX"
+	OPT_PREFETCH_RULES           = "PREFETCH_RULES"
+	OPT_PREFETCH_WORKERS         = "PREFETCH_WORKERS"
+	OPT_PUBLIC_ADDR              = "PUBLIC_ADDR"
+	OPT_RATE_LIMITS              = "RATE_LIMITS"
+	OPT_SYNC_DELAY               = "SYNC_DELAY"
+	OPT_UPLOAD_BYTES_MAX         = "UPLOAD_BYTES_MAX"
+	OPT_UPLOAD_DIR               = "UPLOAD_DIR"
+	OPT_UPLOADS_MAX              = "UPLOADS_MAX"
 )
 
 // Prometheus Metrics
@@ -42,6 +83,10 @@ var (
 		Help:    "Histogram of file sizes for uploads.",
 		Buckets: prometheus.LinearBuckets(1024, 1024*1024, 10), // Buckets from 1KB to 10MB
 	})
+	deleteCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "edgie_file_deletes_total",
+		Help: "Total number of file deletes.",
+	})
 	downloadCounter = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "edgie_file_downloads_total",
 		Help: "Total number of file downloads.",
@@ -57,6 +102,17 @@ func CmdInit(cmd *cobra.Command) {
 	common.CmdInit(cmd)
 	common.AWSCmdInit(cmd)
 	common.S3CmdInit(cmd)
+	common.MimeCmdInit(cmd)
+	common.TLSCmdInit(cmd)
+
+	cmd.PersistentFlags().String(OPT_PUBLIC_ADDR, "", "address to serve files on (default :PORT)")
+	viper.BindPFlag(OPT_PUBLIC_ADDR, cmd.PersistentFlags().Lookup(OPT_PUBLIC_ADDR))
+
+	cmd.PersistentFlags().String(OPT_ADMIN_ADDR, "localhost:8081", "address to serve purge, warm, stats and pprof on (empty disables them)")
+	viper.BindPFlag(OPT_ADMIN_ADDR, cmd.PersistentFlags().Lookup(OPT_ADMIN_ADDR))
+
+	cmd.PersistentFlags().String(OPT_METRICS_ADDR, "127.0.0.1:9090", "address to serve /metrics on (empty disables it); anyone who can reach it reads the metrics unless AUTH_METRICS is set")
+	viper.BindPFlag(OPT_METRICS_ADDR, cmd.PersistentFlags().Lookup(OPT_METRICS_ADDR))
 
 	cmd.PersistentFlags().String(OPT_CACHE_DIR, "/var/edgie/cache/download", "the directory to download files from")
 	viper.BindPFlag(OPT_CACHE_DIR, cmd.PersistentFlags().Lookup(OPT_CACHE_DIR))
@@ -64,9 +120,60 @@ func CmdInit(cmd *cobra.Command) {
 	cmd.PersistentFlags().String(OPT_UPLOAD_DIR, "/var/edgie/cache/upload", "the directory to upload files to")
 	viper.BindPFlag(OPT_UPLOAD_DIR, cmd.PersistentFlags().Lookup(OPT_UPLOAD_DIR))
 
+	cmd.PersistentFlags().String(OPT_DELETE_DIR, "/var/edgie/cache/delete", "the directory to queue s3 deletes in")
+	viper.BindPFlag(OPT_DELETE_DIR, cmd.PersistentFlags().Lookup(OPT_DELETE_DIR))
+
+	cmd.PersistentFlags().Int64(OPT_UPLOAD_BYTES_MAX, int64(math.Pow(2, 30)), "max bytes for a single upload body")
+	viper.BindPFlag(OPT_UPLOAD_BYTES_MAX, cmd.PersistentFlags().Lookup(OPT_UPLOAD_BYTES_MAX))
+
 	cmd.PersistentFlags().Duration(OPT_SYNC_DELAY, 10*time.Second, "delay between s3 sync attempts")
 	viper.BindPFlag(OPT_SYNC_DELAY, cmd.PersistentFlags().Lookup(OPT_SYNC_DELAY))
 
+	cmd.PersistentFlags().String(OPT_RATE_LIMITS, "", "token buckets for public requests as by:rate:burst[:prefix],... where by is ip, token or prefix")
+	viper.BindPFlag(OPT_RATE_LIMITS, cmd.PersistentFlags().Lookup(OPT_RATE_LIMITS))
+
+	cmd.PersistentFlags().Int(OPT_ORIGIN_FETCHES_MAX, 0, "max downloads from S3 at once... client downloads past it get a 429 (0 is unlimited)")
+	viper.BindPFlag(OPT_ORIGIN_FETCHES_MAX, cmd.PersistentFlags().Lookup(OPT_ORIGIN_FETCHES_MAX))
+
+	cmd.PersistentFlags().Int(OPT_UPLOADS_MAX, 0, "max uploads at once... uploads past it get a 429 (0 is unlimited)")
+	viper.BindPFlag(OPT_UPLOADS_MAX, cmd.PersistentFlags().Lookup(OPT_UPLOADS_MAX))
+
+	cmd.PersistentFlags().String(OPT_AUTH_READ, "", "comma separated auth schemes that may GET and HEAD: bearer, hmac, jwt, mtls or url (empty is open)")
+	viper.BindPFlag(OPT_AUTH_READ, cmd.PersistentFlags().Lookup(OPT_AUTH_READ))
+
+	cmd.PersistentFlags().String(OPT_AUTH_WRITE, "", "comma separated auth schemes that may PUT, POST and DELETE: bearer, hmac, jwt, mtls or url (empty is open)")
+	viper.BindPFlag(OPT_AUTH_WRITE, cmd.PersistentFlags().Lookup(OPT_AUTH_WRITE))
+
+	cmd.PersistentFlags().String(OPT_AUTH_ADMIN, "", "comma separated auth schemes that may use the admin endpoints: bearer, hmac, jwt or mtls (empty is open)")
+	viper.BindPFlag(OPT_AUTH_ADMIN, cmd.PersistentFlags().Lookup(OPT_AUTH_ADMIN))
+
+	cmd.PersistentFlags().String(OPT_AUTH_METRICS, "", "comma separated auth schemes that may read /metrics: bearer, hmac, jwt or mtls (empty is open)")
+	viper.BindPFlag(OPT_AUTH_METRICS, cmd.PersistentFlags().Lookup(OPT_AUTH_METRICS))
+
+	cmd.PersistentFlags().String(OPT_AUTH_BEARER_FILE, "", "file of bearer tokens, one per line, each optionally followed by the classes it may use (read,write,admin,metrics)")
+	viper.BindPFlag(OPT_AUTH_BEARER_FILE, cmd.PersistentFlags().Lookup(OPT_AUTH_BEARER_FILE))
+
+	cmd.PersistentFlags().String(OPT_AUTH_HMAC_FILE, "", "file of HMAC keys as keyID base64secret per line, each optionally followed by the classes it may use")
+	viper.BindPFlag(OPT_AUTH_HMAC_FILE, cmd.PersistentFlags().Lookup(OPT_AUTH_HMAC_FILE))
+
+	cmd.PersistentFlags().String(OPT_AUTH_URL_KEYS_FILE, "", "file of keys that sign URLs as keyID base64secret per line... edgie sign uses the first")
+	viper.BindPFlag(OPT_AUTH_URL_KEYS_FILE, cmd.PersistentFlags().Lookup(OPT_AUTH_URL_KEYS_FILE))
+
+	cmd.PersistentFlags().String(OPT_AUTH_JWKS_FILE, "", "JWKS file with the public keys that sign JWTs")
+	viper.BindPFlag(OPT_AUTH_JWKS_FILE, cmd.PersistentFlags().Lookup(OPT_AUTH_JWKS_FILE))
+
+	cmd.PersistentFlags().String(OPT_AUTH_JWT_AUDIENCE, "", "aud a JWT must have (empty accepts any)")
+	viper.BindPFlag(OPT_AUTH_JWT_AUDIENCE, cmd.PersistentFlags().Lookup(OPT_AUTH_JWT_AUDIENCE))
+
+	cmd.PersistentFlags().String(OPT_AUTH_JWT_ISSUER, "", "iss a JWT must have (empty accepts any)")
+	viper.BindPFlag(OPT_AUTH_JWT_ISSUER, cmd.PersistentFlags().Lookup(OPT_AUTH_JWT_ISSUER))
+
+	cmd.PersistentFlags().String(OPT_PREFETCH_RULES, "", "prefetch related objects after downloads as kind:count:prefix,... where kind is m3u8, html or learn")
+	viper.BindPFlag(OPT_PREFETCH_RULES, cmd.PersistentFlags().Lookup(OPT_PREFETCH_RULES))
+
+	cmd.PersistentFlags().Int(OPT_PREFETCH_WORKERS, PrefetchWorkersDefault, "max prefetches fetched at once")
+	viper.BindPFlag(OPT_PREFETCH_WORKERS, cmd.PersistentFlags().Lookup(OPT_PREFETCH_WORKERS))
+
 	cmd.PersistentFlags().Duration(OPT_CACHE_EVICTION_TICK, 10*time.Second, "delay between attempts at cache eviction")
 	viper.BindPFlag(OPT_CACHE_EVICTION_TICK, cmd.PersistentFlags().Lookup(OPT_CACHE_EVICTION_TICK))
 
@@ -75,13 +182,153 @@ func CmdInit(cmd *cobra.Command) {
 
 	cmd.PersistentFlags().Int64(OPT_CACHE_DISK_BYTES_MAX, int64(math.Pow(2, 9)), "max bytest for the cache disk")
 	viper.BindPFlag(OPT_CACHE_DISK_BYTES_MAX, cmd.PersistentFlags().Lookup(OPT_CACHE_DISK_BYTES_MAX))
+
+	cmd.PersistentFlags().String(OPT_CACHE_DISK_COMPRESSION, "", "compression for cache files at rest: gzip, zstd or empty for none")
+	viper.BindPFlag(OPT_CACHE_DISK_COMPRESSION, cmd.PersistentFlags().Lookup(OPT_CACHE_DISK_COMPRESSION))
+
+	cmd.PersistentFlags().String(OPT_CACHE_KEY, "", "base64 AES key (16, 24 or 32 bytes) to encrypt cache files at rest... prefer the env var or CACHE_KEY_FILE")
+	viper.BindPFlag(OPT_CACHE_KEY, cmd.PersistentFlags().Lookup(OPT_CACHE_KEY))
+
+	cmd.PersistentFlags().String(OPT_CACHE_KEY_FILE, "", "file holding the base64 CACHE_KEY")
+	viper.BindPFlag(OPT_CACHE_KEY_FILE, cmd.PersistentFlags().Lookup(OPT_CACHE_KEY_FILE))
+
+	cmd.PersistentFlags().Bool(OPT_CACHE_RAM_COMPRESSED, false, "hold CACHE_DISK_COMPRESSION compressed bytes in the cache ram")
+	viper.BindPFlag(OPT_CACHE_RAM_COMPRESSED, cmd.PersistentFlags().Lookup(OPT_CACHE_RAM_COMPRESSED))
+
+	cmd.PersistentFlags().Bool(OPT_CACHE_RAM_MMAP, false, "hold cached files in RAM by mapping them from disk instead of copying them into the heap (needs no CACHE_DISK_COMPRESSION or CACHE_KEY)")
+	viper.BindPFlag(OPT_CACHE_RAM_MMAP, cmd.PersistentFlags().Lookup(OPT_CACHE_RAM_MMAP))
+
+	cmd.PersistentFlags().Duration(OPT_CACHE_SCRUB_INTERVAL, 0, "delay between background checks of the cache dir (0 disables)")
+	viper.BindPFlag(OPT_CACHE_SCRUB_INTERVAL, cmd.PersistentFlags().Lookup(OPT_CACHE_SCRUB_INTERVAL))
+
+	cmd.PersistentFlags().Duration(OPT_CACHE_INDEX_SNAPSHOT, 5*time.Minute, "delay between snapshots of the cache index that speed up restarts (0 disables)")
+	viper.BindPFlag(OPT_CACHE_INDEX_SNAPSHOT, cmd.PersistentFlags().Lookup(OPT_CACHE_INDEX_SNAPSHOT))
+
+	cmd.PersistentFlags().Int64(OPT_CACHE_SENDFILE_BYTES_MIN, 0, "serve cached files of at least this many bytes from disk with sendfile instead of RAM (0 disables, needs no CACHE_DISK_COMPRESSION or CACHE_KEY)")
+	viper.BindPFlag(OPT_CACHE_SENDFILE_BYTES_MIN, cmd.PersistentFlags().Lookup(OPT_CACHE_SENDFILE_BYTES_MIN))
+
+	cmd.PersistentFlags().String(OPT_CACHE_TIERS, "", "disk tiers fastest first as name:bytesMax:dir,... (replaces CACHE_DIR and CACHE_DISK_BYTES_MAX)")
+	viper.BindPFlag(OPT_CACHE_TIERS, cmd.PersistentFlags().Lookup(OPT_CACHE_TIERS))
+
+	cmd.PersistentFlags().String(OPT_CACHE_PINNED, "", "comma separated doublestar patterns of keys the cache never evicts")
+	viper.BindPFlag(OPT_CACHE_PINNED, cmd.PersistentFlags().Lookup(OPT_CACHE_PINNED))
+
+	cmd.PersistentFlags().String(OPT_CACHE_QUOTAS, "", "disk byte quotas for key prefixes as name:bytesMax:prefix,... (the longest matching prefix applies)")
+	viper.BindPFlag(OPT_CACHE_QUOTAS, cmd.PersistentFlags().Lookup(OPT_CACHE_QUOTAS))
+
+	cmd.PersistentFlags().String(OPT_COMPRESS_ENCODINGS, "br,gzip", "content encodings to compress responses with, in preference order (empty disables)")
+	viper.BindPFlag(OPT_COMPRESS_ENCODINGS, cmd.PersistentFlags().Lookup(OPT_COMPRESS_ENCODINGS))
+
+	cmd.PersistentFlags().Int64(OPT_COMPRESS_BYTES_MIN, 1024, "min bytes for a response to be compressed")
+	viper.BindPFlag(OPT_COMPRESS_BYTES_MIN, cmd.PersistentFlags().Lookup(OPT_COMPRESS_BYTES_MIN))
+
+	cmd.PersistentFlags().Int64(OPT_COMPRESS_BYTES_MAX, 8<<20, "max bytes for a response to be compressed... bigger ones and sendfile hits are sent uncompressed")
+	viper.BindPFlag(OPT_COMPRESS_BYTES_MAX, cmd.PersistentFlags().Lookup(OPT_COMPRESS_BYTES_MAX))
 }
 
 func CmdExecute(cmd *cobra.Command, args []string) (*Service, error) {
 	common.CmdExecute(cmd, args)
 	common.AWSCmdExecute(cmd, args)
 	s3Conf := common.S3CmdExecute(cmd, args)
+	mimeTypes := common.MimeCmdExecute(cmd, args)
+
+	uploadDir := viper.GetString(OPT_UPLOAD_DIR)
+	if uploadDir == "" {
+		log.Fatal("CACHE_UPLOAD_DIR not specified")
+	}
+
+	var compressEncodings []string
+	for _, encoding := range strings.Split(viper.GetString(OPT_COMPRESS_ENCODINGS), ",") {
+		encoding = strings.TrimSpace(encoding)
+		if encoding == "" {
+			continue
+		}
+		if _, ok := common.EncodingExt[encoding]; !ok {
+			log.Fatalf("COMPRESS_ENCODINGS has unsupported encoding %s", encoding)
+		}
+		compressEncodings = append(compressEncodings, encoding)
+	}
+
+	compressBytesMin := viper.GetInt64(OPT_COMPRESS_BYTES_MIN)
+	compressBytesMax := viper.GetInt64(OPT_COMPRESS_BYTES_MAX)
+	if compressBytesMax <= 0 {
+		log.Fatal("COMPRESS_BYTES_MAX must be positive")
+	}
+
+	deleteDir := viper.GetString(OPT_DELETE_DIR)
+	if deleteDir == "" {
+		log.Fatal("DELETE_DIR not specified")
+	}
+
+	uploadBytesMax := viper.GetInt64(OPT_UPLOAD_BYTES_MAX)
+	if uploadBytesMax == 0 {
+		log.Fatal("UPLOAD_BYTES_MAX not specified")
+	}
+
+	syncDelay := viper.GetDuration(OPT_SYNC_DELAY)
+	if syncDelay == 0 {
+		log.Fatal("SYNC_DELAY not specified")
+	}
+
+	prefetchRules, err := prefetchRulesParse(viper.GetString(OPT_PREFETCH_RULES))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	prefetchWorkers := viper.GetInt(OPT_PREFETCH_WORKERS)
+
+	limitRules, err := limitRulesParse(viper.GetString(OPT_RATE_LIMITS))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	publicAddr := viper.GetString(OPT_PUBLIC_ADDR)
+	if publicAddr == "" {
+		publicAddr = ":" + viper.GetString(common.OPT_PORT)
+	}
+
+	auth, err := AuthCmdExecute()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cacheConfig := CacheCmdExecute(cmd, args)
+	cache := common.NewFileCache(cacheConfig)
 
+	s := &Service{
+		Cache: cache,
+		Mime:  mimeTypes,
+		Conf: Conf{
+			AdminAddr:         viper.GetString(OPT_ADMIN_ADDR),
+			Auth:              auth,
+			CacheDir:          cacheConfig.DirPath,
+			CompressBytesMax:  compressBytesMax,
+			CompressBytesMin:  compressBytesMin,
+			CompressEncodings: compressEncodings,
+			DeleteDir:         deleteDir,
+			LimitRules:        limitRules,
+			MetricsAddr:       viper.GetString(OPT_METRICS_ADDR),
+			OriginFetchesMax:  viper.GetInt(OPT_ORIGIN_FETCHES_MAX),
+			PrefetchRules:     prefetchRules,
+			PrefetchWorkers:   prefetchWorkers,
+			PublicAddr:        publicAddr,
+			UploadDir:         uploadDir,
+			UploadBytesMax:    uploadBytesMax,
+			UploadsMax:        viper.GetInt(OPT_UPLOADS_MAX),
+			S3:                s3Conf,
+			SyncDelay:         syncDelay,
+		},
+	}
+
+	err = s.Start()
+	if err != nil {
+		return nil, fmt.Errorf("could not start the edgie service: %v", err)
+	}
+	return s, nil
+}
+
+// CacheCmdExecute reads the cache options.
+func CacheCmdExecute(cmd *cobra.Command, args []string) common.FileCacheConfig {
 	cacheEvictionTick := viper.GetDuration(OPT_CACHE_EVICTION_TICK)
 	if cacheEvictionTick == 0 {
 		log.Fatal("CACHE_EVICTION_TICK not specified")
@@ -102,49 +349,264 @@ func CmdExecute(cmd *cobra.Command, args []string) (*Service, error) {
 		log.Fatal("CACHE_RAM_BYTES_MAX not specified")
 	}
 
-	uploadDir := viper.GetString(OPT_UPLOAD_DIR)
-	if uploadDir == "" {
-		log.Fatal("CACHE_UPLOAD_DIR not specified")
+	cacheDiskCompression := viper.GetString(OPT_CACHE_DISK_COMPRESSION)
+
+	cacheKey, err := cacheKeyLoad(viper.GetString(OPT_CACHE_KEY), viper.GetString(OPT_CACHE_KEY_FILE))
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	syncDelay := viper.GetDuration(OPT_SYNC_DELAY)
-	if syncDelay == 0 {
-		log.Fatal("SYNC_DELAY not specified")
+	cacheRAMCompressed := viper.GetBool(OPT_CACHE_RAM_COMPRESSED)
+
+	cacheRAMMmap := viper.GetBool(OPT_CACHE_RAM_MMAP)
+
+	cacheScrubInterval := viper.GetDuration(OPT_CACHE_SCRUB_INTERVAL)
+
+	cacheIndexSnapshot := viper.GetDuration(OPT_CACHE_INDEX_SNAPSHOT)
+
+	cacheSendfileBytesMin := viper.GetInt64(OPT_CACHE_SENDFILE_BYTES_MIN)
+
+	cacheTiers, err := cacheTiersParse(viper.GetString(OPT_CACHE_TIERS))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(cacheTiers) > 0 {
+		// the fastest tier stands in for CACHE_DIR
+		cacheDir = cacheTiers[0].DirPath
 	}
 
-	cache := common.NewFileCache(common.FileCacheConfig{
-		EvictionTick: cacheEvictionTick,
-		DirPath:      cacheDir,
-		DiskBytesMax: cacheDiskBytesMax,
-		RAMBytesMax:  cacheRAMBytesMax,
-	})
+	cachePinned := patternsSplit(viper.GetString(OPT_CACHE_PINNED))
 
-	s := &Service{
-		Cache: cache,
-		Conf: Conf{
-			UploadDir: uploadDir,
-			S3:        s3Conf,
-			SyncDelay: syncDelay,
-		},
+	cacheQuotas, err := cacheQuotasParse(viper.GetString(OPT_CACHE_QUOTAS))
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	err := s.Start()
+	return common.FileCacheConfig{
+		EvictionTick:          cacheEvictionTick,
+		DirPath:               cacheDir,
+		DiskBytesMax:          cacheDiskBytesMax,
+		RAMBytesMax:           cacheRAMBytesMax,
+		DiskCompression:       cacheDiskCompression,
+		DiskKey:               cacheKey,
+		RAMCompressed:         cacheRAMCompressed,
+		RAMMmap:               cacheRAMMmap,
+		ScrubInterval:         cacheScrubInterval,
+		IndexSnapshotInterval: cacheIndexSnapshot,
+		SendfileBytesMin:      cacheSendfileBytesMin,
+		Tiers:                 cacheTiers,
+		Pinned:                cachePinned,
+		Quotas:                cacheQuotas,
+	}
+}
+
+// patternsSplit splits a list of doublestar patterns on the commas outside of {a,b} alternatives.
+func patternsSplit(pinnedOpt string) []string {
+	var patterns []string
+	depth, start := 0, 0
+	for i := 0; i <= len(pinnedOpt); i++ {
+		if i < len(pinnedOpt) {
+			switch pinnedOpt[i] {
+			case '{':
+				depth++
+				continue
+			case '}':
+				depth--
+				continue
+			case ',':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		if pattern := strings.TrimSpace(pinnedOpt[start:i]); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+		start = i + 1
+	}
+	return patterns
+}
+
+// cacheQuotasParse parses CACHE_QUOTAS. It returns nil when the option is empty.
+func cacheQuotasParse(quotasOpt string) ([]common.FileCacheQuota, error) {
+	var quotas []common.FileCacheQuota
+	for _, quotaOpt := range strings.Split(quotasOpt, ",") {
+		quotaOpt = strings.TrimSpace(quotaOpt)
+		if quotaOpt == "" {
+			continue
+		}
+		parts := strings.SplitN(quotaOpt, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("CACHE_QUOTAS entry %q is not name:bytesMax:prefix", quotaOpt)
+		}
+		bytesMax, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || bytesMax <= 0 {
+			return nil, fmt.Errorf("CACHE_QUOTAS entry %q has a bad bytesMax", quotaOpt)
+		}
+		for _, quota := range quotas {
+			if quota.Name == parts[0] || quota.Prefix == parts[2] {
+				return nil, fmt.Errorf("CACHE_QUOTAS entry %q repeats a name or prefix", quotaOpt)
+			}
+		}
+		quotas = append(quotas, common.FileCacheQuota{Name: parts[0], Prefix: parts[2], BytesMax: bytesMax})
+	}
+	return quotas, nil
+}
+
+// cacheTiersParse parses CACHE_TIERS. It returns nil when the option is empty.
+func cacheTiersParse(tiersOpt string) ([]common.FileCacheTier, error) {
+	var tiers []common.FileCacheTier
+	for _, tierOpt := range strings.Split(tiersOpt, ",") {
+		tierOpt = strings.TrimSpace(tierOpt)
+		if tierOpt == "" {
+			continue
+		}
+		parts := strings.SplitN(tierOpt, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("CACHE_TIERS entry %q is not name:bytesMax:dir", tierOpt)
+		}
+		bytesMax, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || bytesMax <= 0 {
+			return nil, fmt.Errorf("CACHE_TIERS entry %q has a bad bytesMax", tierOpt)
+		}
+		for _, tier := range tiers {
+			if tier.Name == parts[0] || tier.DirPath == parts[2] {
+				return nil, fmt.Errorf("CACHE_TIERS entry %q repeats a name or dir", tierOpt)
+			}
+		}
+		tiers = append(tiers, common.FileCacheTier{Name: parts[0], DirPath: parts[2], BytesMax: bytesMax})
+	}
+	return tiers, nil
+}
+
+// cacheKeyLoad decodes the cache encryption key from the option or the key file.
+// It returns nil when neither is set.
+func cacheKeyLoad(key string, keyFile string) ([]byte, error) {
+	if key == "" && keyFile != "" {
+		keyBytes, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CACHE_KEY_FILE: %v", err)
+		}
+		key = strings.TrimSpace(string(keyBytes))
+	}
+	if key == "" {
+		return nil, nil
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
 	if err != nil {
-		return nil, fmt.Errorf("could not start the edgie service: %v", err)
+		return nil, fmt.Errorf("CACHE_KEY is not valid base64: %v", err)
 	}
-	return s, nil
+	switch len(keyBytes) {
+	case 16, 24, 32:
+		return keyBytes, nil
+	}
+	return nil, fmt.Errorf("CACHE_KEY must be 16, 24 or 32 bytes, got %d", len(keyBytes))
 }
 
 type Conf struct {
-	CacheDir  string
-	UploadDir string
-	S3        *common.S3Conf
-	SyncDelay time.Duration
+	AdminAddr         string
+	Auth              AuthConf
+	CacheDir          string
+	CompressBytesMax  int64
+	CompressBytesMin  int64
+	CompressEncodings []string
+	DeleteDir         string
+	LimitRules        []LimitRule
+	MetricsAddr       string
+	OriginFetchesMax  int
+	PrefetchRules     []PrefetchRule
+	PrefetchWorkers   int
+	PublicAddr        string
+	UploadDir         string
+	UploadBytesMax    int64
+	UploadsMax        int
+	S3                *common.S3Conf
+	SyncDelay         time.Duration
+}
+
+// UploadChecksums are digests the client claims for an upload body. Nil fields are not checked.
+type UploadChecksums struct {
+	MD5    []byte
+	SHA256 []byte
+}
+
+// UploadResult describes a published upload. Created is false when the upload
+// replaced a pending upload or a cached copy. Objects known only to S3 count as created.
+type UploadResult struct {
+	Created bool
+	ETag    string
+	Size    int64
+}
+
+// Tiers report where an object was found. Cache hits on disk report the name
+// of the cache tier, TierDisk unless CACHE_TIERS names them.
+const (
+	TierRAM    = "ram"
+	TierDisk   = "disk"
+	TierUpload = "upload"
+	TierOrigin = "origin"
+)
+
+// ObjectInfo describes an object without its contents.
+type ObjectInfo struct {
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	ContentType     string `json:"contentType"`
+	ETag            string `json:"etag,omitempty"`
+	Size            int64  `json:"size"`
+	Tier            string `json:"tier"`
 }
 
 type Service struct {
 	Conf  Conf
 	Cache *common.FileCache
+	Mime  *common.MimeTypes
+
+	// keyLock orders uploads, deletes, cache fills and sync removals of the same key
+	keyLock common.KeyLock
+
+	// prefetch is nil without PrefetchRules
+	prefetch *prefetcher
+
+	limiters []*limiter
+	// originSlots and uploadSlots are nil when unlimited
+	originSlots chan struct{}
+	uploadSlots chan struct{}
+}
+
+// keyClean turns a request path into the key used by the cache, the upload dir and S3.
+func keyClean(filePath string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(filePath)), "/")
+}
+
+// keyParse cleans a request path into a key and checks it is valid, not
+// reserved, and can't reach out of the upload or delete dir through a
+// symlink. Errors wrap common.ErrKeyInvalid.
+func (s *Service) keyParse(filePath string) (string, error) {
+	key := keyClean(filePath)
+	if err := common.KeyValidate(key); err != nil {
+		return "", err
+	}
+	if common.KeyReserved(key) {
+		return "", fmt.Errorf("%w: %s is reserved", common.ErrKeyInvalid, key)
+	}
+	for _, root := range []string{s.Conf.UploadDir, s.Conf.DeleteDir} {
+		if _, err := common.KeyPath(root, key); err != nil {
+			return "", err
+		}
+	}
+	return key, nil
+}
+
+func (s *Service) uploadPath(key string) string {
+	return filepath.Join(s.Conf.UploadDir, filepath.FromSlash(key))
+}
+
+// deletePath names the tombstone that queues an S3 delete of key.
+func (s *Service) deletePath(key string) string {
+	return filepath.Join(s.Conf.DeleteDir, filepath.FromSlash(key))
 }
 
 // Start synchronizes files from the upload directory to S3 and moves them to the serving directory.
@@ -157,123 +619,353 @@ func (s *Service) Start() error {
 		return fmt.Errorf("failed to create directory: %v", err)
 	}
 
+	if err := os.MkdirAll(s.Conf.DeleteDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
 	go s.S3SyncForever()
+	s.limitStart()
+	s.prefetchStart()
 
 	return nil
 }
 
-func (s *Service) S3SyncForever() error {
-	for {
-		time.Sleep(s.Conf.SyncDelay)
-		err := s.S3SyncOnce()
-		if err != nil {
-			log.Error(err)
-		}
-	}
+// Close saves what the service needs for a fast restart. Pending uploads and
+// deletes are already durable on disk.
+func (s *Service) Close() error {
+	return s.Cache.Close()
+}
+
+// Download returns the current contents of srcPath.
+//
+// Sources rank pending upload > pending delete > cache > S3. Upload and Delete
+// invalidate the cache entry under the same key lock that guards cache fills,
+// so a cache hit is never older than a pending change and a fill always
+// prefers the upload and delete dirs over S3.
+func (s *Service) Download(srcPath string) (fileReader io.ReadCloser, info *ObjectInfo, err error) {
+	return s.DownloadEncoded(srcPath, "", "")
 }
 
-func (s *Service) S3SyncOnce() error {
-	srcPaths, err := filepath.Glob(filepath.Join(s.Conf.UploadDir, "**"))
+// DownloadEncoded is Download with content negotiation. It returns a
+// compressed variant when acceptEncoding allows one and the content is worth
+// compressing, and reports the chosen encoding in info.ContentEncoding.
+// Big cached files come back as an *os.File, so copying fileReader to a
+// connection uses sendfile. The caller closes fileReader, which releases the entry.
+// client identifies the caller to the prefetch rules that learn from access
+// sequences, and may be empty.
+func (s *Service) DownloadEncoded(srcPath string, acceptEncoding string, client string) (fileReader io.ReadCloser, info *ObjectInfo, err error) {
+	key, err := s.keyParse(srcPath)
 	if err != nil {
-		err = fmt.Errorf("could not read upload directory: %v", err)
-		return err
+		return nil, nil, err
 	}
 
-	if len(srcPaths) == 0 {
-		return nil
+	// check the cache first...
+	fce, err := s.Cache.Get(key)
+
+	// not in cache... fill it
+	if errors.Is(err, os.ErrNotExist) {
+		fce, err = s.cacheFill(key, false)
 	}
 
-	sess, _ := common.AWSSessionGet(s.Conf.S3.Region)
-	s3Client := s3.New(sess, aws.NewConfig().WithRegion(s.Conf.S3.Region))
+	// still have a problem?
+	if err != nil {
+		return nil, nil, err
+	}
 
-	for _, srcPath := range srcPaths {
-		dstPath, err := filepath.Rel(s.Conf.CacheDir, srcPath)
-		if err != nil {
-			return fmt.Errorf("could not get relative path for cachefile: %s", srcPath)
-		}
+	// entries indexed from disk at startup have no metadata... sniff them
+	contentType := fce.Meta.ContentType
+	if contentType == "" {
+		contentType = s.Mime.Detect(key, "", fce.Head(512))
+	}
+	info = &ObjectInfo{ContentType: contentType, ETag: fce.ETag, Size: fce.Size}
 
-		// Upload file to S3
-		if err = common.S3FileUpload(s3Client, srcPath, s.Conf.S3.Bucket, dstPath); err != nil {
-			return fmt.Errorf("s3 upload failed: %v", err)
+	// swap in a compressed variant if the client wants one
+	if vce, encoding := s.variantGet(key, fce, contentType, acceptEncoding); vce != nil {
+		fce.Close()
+		fce = vce
+		info = &ObjectInfo{ContentEncoding: encoding, ContentType: contentType, ETag: vce.ETag, Size: vce.Size}
+	}
+
+	s.prefetchObserve(client, key)
+
+	// Increment download counter and record file size
+	downloadCounter.Inc()
+	downloadSizeHistogram.Observe(float64(fce.Size))
+	return fce.Reader(), info, nil
+}
+
+// Stat describes srcPath using the same source ranking as Download but
+// without loading the object into the cache.
+func (s *Service) Stat(srcPath string) (*ObjectInfo, error) {
+	key, err := s.keyParse(srcPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// check the cache first...
+	if stat, err := s.Cache.Stat(key); err == nil {
+		tier := stat.Tier
+		if stat.InMemory {
+			tier = TierRAM
 		}
+		contentType := stat.Meta.ContentType
+		if contentType == "" {
+			contentType = s.contentTypeGuess(key)
+		}
+		return &ObjectInfo{ContentType: contentType, ETag: stat.ETag, Size: stat.Size, Tier: tier}, nil
+	}
 
-		// remove from uploads
-		err = os.Remove(srcPath)
+	// check the upload folder
+	uploadPath := s.uploadPath(key)
+	if info, err := os.Stat(uploadPath); err == nil {
+		etag, err := s.uploadETag(key, uploadPath, info)
+		if err != nil {
+			return nil, err
+		}
+		contentType, err := s.uploadContentType(key, uploadPath, info)
 		if err != nil {
-			return fmt.Errorf("failed to remove file from uploads: %v", err)
+			return nil, err
 		}
+		return &ObjectInfo{ContentType: contentType, ETag: etag, Size: info.Size(), Tier: TierUpload}, nil
 	}
 
-	return nil
+	// deleted but not yet synced
+	if _, err := os.Stat(s.deletePath(key)); err == nil {
+		return nil, os.ErrNotExist
+	}
+
+	// ask aws
+	sess, _ := common.AWSSessionGet(s.Conf.S3.Region)
+	s3Client := s3.New(sess, aws.NewConfig().WithRegion(s.Conf.S3.Region))
+	head, err := common.S3FileHead(key, s.Conf.S3.Bucket, s3Client)
+	if err != nil {
+		return nil, err
+	}
+	contentType := aws.StringValue(head.ContentType)
+	if contentType == "" || contentType == "binary/octet-stream" {
+		contentType = s.contentTypeGuess(key)
+	}
+	return &ObjectInfo{
+		ContentType: contentType,
+		ETag:        aws.StringValue(head.ETag),
+		Size:        aws.Int64Value(head.ContentLength),
+		Tier:        TierOrigin,
+	}, nil
 }
 
-func (s *Service) Download(srcPath string) (fileReader io.Reader, err error) {
-	srcPath = filepath.Clean(srcPath)
+// contentTypeGuess types key by extension alone, for when there are no bytes to sniff.
+func (s *Service) contentTypeGuess(key string) string {
+	if contentType := s.Mime.ByExtension(key); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
 
-	var fce *common.FileCacheEntry
+// cacheFillPut sniffs the content type of src and stores it in the cache.
+// A non-nil sha256Sum must match the bytes or the fill fails with common.ErrChecksumMismatch.
+func (s *Service) cacheFillPut(key string, src io.Reader, originContentType string, sha256Sum []byte) (*common.FileCacheEntry, error) {
+	srcBuf := bufio.NewReader(src)
+	head, _ := srcBuf.Peek(512)
+	contentType := s.Mime.Detect(key, originContentType, head)
+	return s.Cache.Put(key, srcBuf, common.FileCacheMeta{ContentType: contentType, SHA256: sha256Sum})
+}
 
-	// check the cache first...
-	fce, err = s.Cache.Get(srcPath)
-
-	// not in cache... check the upload folder
-	if err == os.ErrNotExist {
-		uploadFilePath := filepath.Clean(s.Conf.UploadDir + "/" + srcPath)
-		if _, err = os.Stat(uploadFilePath); err == nil {
-			var data []byte
-			if data, err = os.ReadFile(uploadFilePath); err == nil {
-				// found it... cache it
-				fce, err = s.Cache.Put(srcPath, bytes.NewReader(data))
-			}
+// cacheFill loads key into the cache from the upload dir or S3. When every
+// origin slot is taken it waits for one if wait is set and fails with ErrBusy if not.
+func (s *Service) cacheFill(key string, wait bool) (*common.FileCacheEntry, error) {
+	// background fills wait for a slot before the key lock, so a client
+	// reading the same key never queues behind them
+	if wait {
+		if err := slotAcquire(s.originSlots, "origin", true); err != nil {
+			return nil, err
 		}
+		defer slotRelease(s.originSlots)
+	}
+
+	s.keyLock.Lock(key)
+	defer s.keyLock.Unlock(key)
+
+	// another fill may have won the race for the lock
+	fce, err := s.Cache.Get(key)
+	if !errors.Is(err, os.ErrNotExist) {
+		return fce, err
+	}
+
+	// check the upload folder
+	fce, err = s.cacheFillUpload(key)
+	if !errors.Is(err, os.ErrNotExist) {
+		return fce, err
+	}
+
+	// deleted but not yet synced... don't resurrect it from aws
+	if _, err := os.Stat(s.deletePath(key)); err == nil {
+		return nil, os.ErrNotExist
 	}
 
 	// not in upload folder... check aws...
-	if err == os.ErrNotExist {
-		sess, _ := common.AWSSessionGet(s.Conf.S3.Region)
-		s3Client := s3.New(sess, aws.NewConfig().WithRegion(s.Conf.S3.Region))
-		var s3Reader io.ReadCloser
-		if s3Reader, err = common.S3FileDownload(srcPath, s.Conf.S3.Bucket, s3Client); err == nil {
-			// found it... cache it
-			fce, err = s.Cache.Put(srcPath, s3Reader)
-			s3Reader.Close()
+	if !wait {
+		if err := slotAcquire(s.originSlots, "origin", false); err != nil {
+			return nil, err
 		}
+		defer slotRelease(s.originSlots)
+	}
+	sess, _ := common.AWSSessionGet(s.Conf.S3.Region)
+	s3Client := s3.New(sess, aws.NewConfig().WithRegion(s.Conf.S3.Region))
+	s3Resp, err := common.S3FileDownload(key, s.Conf.S3.Bucket, s3Client)
+	if err != nil {
+		return nil, err
 	}
+	defer s3Resp.Body.Close()
 
-	// still have a problem?
+	// found it... cache it
+	return s.cacheFillPut(key, s3Resp.Body, aws.StringValue(s3Resp.ContentType), common.S3ChecksumSHA256(s3Resp.ChecksumSHA256))
+}
+
+// cacheFillUpload loads key into the cache from the upload dir. A pending
+// upload that fails its recorded checksum is dropped and reported as missing,
+// so the fill falls through to S3. Call with the key lock held.
+func (s *Service) cacheFillUpload(key string) (*common.FileCacheEntry, error) {
+	uploadFile, err := os.Open(s.uploadPath(key))
 	if err != nil {
 		return nil, err
 	}
+	defer uploadFile.Close()
 
-	// Increment download counter and record file size
-	downloadCounter.Inc()
-	downloadSizeHistogram.Observe(float64(fce.Size))
-	return bytes.NewReader(fce.Data), nil
+	info, err := uploadFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var contentType string
+	var sum []byte
+	if meta := s.uploadMetaLoad(key, info); meta != nil {
+		contentType = meta.ContentType
+		if len(meta.SHA256) == sha256.Size {
+			sum = meta.SHA256
+		}
+	}
+	fce, err := s.cacheFillPut(key, uploadFile, contentType, sum)
+	if errors.Is(err, common.ErrChecksumMismatch) {
+		if err := s.uploadDrop(key, info); err != nil {
+			return nil, err
+		}
+		return nil, os.ErrNotExist
+	}
+	return fce, err
 }
 
-func (s *Service) Upload(filePath string, srcR io.Reader) error {
-	dstPath := filepath.Clean(s.Conf.UploadDir + "/" + filePath)
-	dstDir := path.Dir(dstPath)
+// Upload stores srcR as the pending version of filePath and invalidates the
+// cached copy so later reads see the new bytes. The body is verified against
+// sums before it is published. A non-empty contentType is served and sent to
+// S3 instead of the detected one.
+func (s *Service) Upload(filePath string, srcR io.Reader, sums UploadChecksums, contentType string) (*UploadResult, error) {
+	key, err := s.keyParse(filePath)
+	if err != nil {
+		return nil, err
+	}
+	dstPath := s.uploadPath(key)
 
-	// make the uploadFileDir
-	if err := os.MkdirAll(dstDir, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create directory %s: %v", dstDir, err)
+	if err := slotAcquire(s.uploadSlots, "upload", false); err != nil {
+		return nil, err
 	}
+	defer slotRelease(s.uploadSlots)
+
+	// registered before the key lock, so this runs after it is released
+	defer s.variantsDeleteForSibling(key)
 
-	// make the dstPath
-	dstW, err := os.Create(dstPath)
+	// stream the body outside the key lock so slow clients don't block readers
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	hashR := io.TeeReader(srcR, io.MultiWriter(md5Hash, sha256Hash))
+	tmpPath, dstSize, err := common.FileWriteTmp(filepath.Dir(dstPath), hashR, 0664)
 	if err != nil {
-		return fmt.Errorf("failed to create the upload file %s: %v", dstPath, err)
+		return nil, fmt.Errorf("failed to write the upload file %s: %w", dstPath, err)
+	}
+
+	md5Sum := md5Hash.Sum(nil)
+	if (sums.MD5 != nil && !bytes.Equal(sums.MD5, md5Sum)) ||
+		(sums.SHA256 != nil && !bytes.Equal(sums.SHA256, sha256Hash.Sum(nil))) {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("upload of %s: %w", key, common.ErrChecksumMismatch)
 	}
-	defer dstW.Close()
 
-	// copy from Body to dst file
-	dstSize, err := io.Copy(dstW, srcR)
+	s.keyLock.Lock(key)
+	defer s.keyLock.Unlock(key)
+
+	_, err = os.Stat(dstPath)
+	created := os.IsNotExist(err) && !s.Cache.Has(key)
+
+	// record the digest so later reads and the sync can tell if the file rots
+	tmpInfo, err := os.Stat(tmpPath)
+	if err == nil {
+		err = s.uploadMetaWrite(key, tmpInfo, md5Sum, sha256Hash.Sum(nil), contentType)
+	}
 	if err != nil {
-		return fmt.Errorf("filed to write to file %s: %v", dstPath, err)
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to record the checksum of %s: %v", key, err)
+	}
+
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to publish the upload file %s: %v", dstPath, err)
+	}
+
+	// the upload overwrites the object in S3, so a queued delete is moot
+	if err := os.Remove(s.deletePath(key)); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to cancel the delete of %s: %v", key, err)
+	}
+
+	if err := s.Cache.Delete(key); err != nil {
+		return nil, fmt.Errorf("failed to invalidate cache for %s: %v", key, err)
+	}
+	if err := s.variantsDelete(key); err != nil {
+		return nil, err
 	}
 
 	uploadCounter.Inc()
 	uploadSizeHistogram.Observe(float64(dstSize))
 	log.Printf("File uploaded successfully: %s", filePath)
+	return &UploadResult{
+		Created: created,
+		ETag:    common.ETagFromMD5(md5Sum),
+		Size:    dstSize,
+	}, nil
+}
+
+// Delete removes filePath from the cache, cancels any pending upload and
+// queues a durable S3 delete that the sync loop retries until it succeeds.
+func (s *Service) Delete(filePath string) error {
+	key, err := s.keyParse(filePath)
+	if err != nil {
+		return err
+	}
+
+	// registered before the key lock, so this runs after it is released
+	defer s.variantsDeleteForSibling(key)
+
+	s.keyLock.Lock(key)
+	defer s.keyLock.Unlock(key)
+
+	// write the tombstone first so a crash never leaves S3 as the only copy
+	if _, err := common.FileWriteAtomic(s.deletePath(key), bytes.NewReader(nil), 0664); err != nil {
+		return fmt.Errorf("failed to queue the delete of %s: %v", key, err)
+	}
+
+	if err := os.Remove(s.uploadPath(key)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to cancel the upload of %s: %v", key, err)
+	}
+	if err := s.uploadMetaRemove(key); err != nil {
+		return fmt.Errorf("failed to cancel the upload of %s: %v", key, err)
+	}
+
+	if err := s.Cache.Delete(key); err != nil {
+		return fmt.Errorf("failed to invalidate cache for %s: %v", key, err)
+	}
+	if err := s.variantsDelete(key); err != nil {
+		return err
+	}
+
+	deleteCounter.Inc()
+	log.Printf("File deleted successfully: %s", filePath)
 	return nil
 }
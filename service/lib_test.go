@@ -0,0 +1,1183 @@
+package service
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jkassis/edgie/common"
+	"github.com/spf13/viper"
+)
+
+// newTestService is a Service over temp dirs with no S3 sync running, so
+// pending uploads stay the source of truth.
+func newTestService(t *testing.T, cacheConf common.FileCacheConfig) *Service {
+	t.Helper()
+	dir := t.TempDir()
+	cacheConf.DirPath = filepath.Join(dir, "cache")
+	if cacheConf.EvictionTick == 0 {
+		cacheConf.EvictionTick = time.Hour
+	}
+	if cacheConf.DiskBytesMax == 0 {
+		cacheConf.DiskBytesMax = 1 << 30
+	}
+	if cacheConf.RAMBytesMax == 0 {
+		cacheConf.RAMBytesMax = 1 << 30
+	}
+	s := &Service{
+		Cache: common.NewFileCache(cacheConf),
+		Conf: Conf{
+			DeleteDir:      filepath.Join(dir, "delete"),
+			S3:             &common.S3Conf{},
+			SyncDelay:      time.Hour,
+			UploadBytesMax: 1 << 20,
+			UploadDir:      filepath.Join(dir, "upload"),
+		},
+	}
+	if err := s.Cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for _, dirPath := range []string{s.Conf.UploadDir, s.Conf.DeleteDir} {
+		if err := os.MkdirAll(dirPath, 0775); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+// versionBody is version n of an object: the version stamp repeated, with a
+// length that changes between versions so a mix of two is easy to spot.
+func versionBody(n int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("v%08d|", n)), 64*(n%5+1))
+}
+
+// versionCheck returns the version body holds, or an error if body is not
+// exactly one version.
+func versionCheck(body []byte) (int, error) {
+	stamp, _, ok := bytes.Cut(body, []byte("|"))
+	if !ok || len(stamp) != 9 || stamp[0] != 'v' {
+		return 0, fmt.Errorf("no version stamp in %.32q", body)
+	}
+	n, err := strconv.Atoi(string(stamp[1:]))
+	if err != nil {
+		return 0, fmt.Errorf("bad version stamp in %.32q", body)
+	}
+	if !bytes.Equal(body, versionBody(n)) {
+		return 0, fmt.Errorf("torn body: %d bytes starting with version %d", len(body), n)
+	}
+	return n, nil
+}
+
+func etagOf(body []byte) string {
+	sum := md5.Sum(body)
+	return common.ETagFromMD5(sum[:])
+}
+
+// readYourWritesRun uploads versions of one key in order while readers
+// download it. A download that starts after an upload returned must see that
+// version or a later one, whole, with its own ETag.
+func readYourWritesRun(t *testing.T, upload func(n int) string, download func() ([]byte, string, error)) {
+	const versions = 200
+	const readers = 8
+
+	if etag := upload(0); etag != etagOf(versionBody(0)) {
+		t.Fatalf("upload of version 0 has ETag %s", etag)
+	}
+	var latest atomic.Int64
+	var done atomic.Bool
+
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				floor := int(latest.Load())
+				body, etag, err := download()
+				if err != nil {
+					errs <- err
+					return
+				}
+				n, err := versionCheck(body)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if n < floor {
+					errs <- fmt.Errorf("read version %d after version %d was uploaded", n, floor)
+					return
+				}
+				if etag != etagOf(body) {
+					errs <- fmt.Errorf("version %d came with ETag %s, not %s", n, etag, etagOf(body))
+					return
+				}
+			}
+		}()
+	}
+
+	for n := 1; n <= versions; n++ {
+		if etag := upload(n); etag != etagOf(versionBody(n)) {
+			t.Errorf("upload of version %d has ETag %s", n, etag)
+		}
+		latest.Store(int64(n))
+	}
+	done.Store(true)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+var readYourWritesCaches = map[string]common.FileCacheConfig{
+	"ram":      {},
+	"disk":     {RAMBytesMax: 1},
+	"sendfile": {SendfileBytesMin: 1024},
+}
+
+func TestUploadDownloadReadYourWrites(t *testing.T) {
+	for name, cacheConf := range readYourWritesCaches {
+		t.Run(name, func(t *testing.T) {
+			s := newTestService(t, cacheConf)
+			upload := func(n int) string {
+				result, err := s.Upload("/ryw/obj.txt", bytes.NewReader(versionBody(n)), UploadChecksums{}, "")
+				if err != nil {
+					t.Fatalf("upload of version %d failed: %v", n, err)
+				}
+				return result.ETag
+			}
+			download := func() ([]byte, string, error) {
+				r, info, err := s.Download("/ryw/obj.txt")
+				if err != nil {
+					return nil, "", err
+				}
+				defer r.Close()
+				body, err := io.ReadAll(r)
+				if err == nil && int64(len(body)) != info.Size {
+					err = fmt.Errorf("read %d bytes of a %d byte object", len(body), info.Size)
+				}
+				return body, info.ETag, err
+			}
+			readYourWritesRun(t, upload, download)
+		})
+	}
+}
+
+func TestHTTPPostGetReadYourWrites(t *testing.T) {
+	for name, cacheConf := range readYourWritesCaches {
+		t.Run(name, func(t *testing.T) {
+			s := newTestService(t, cacheConf)
+			upload := func(n int) string {
+				w := httptest.NewRecorder()
+				s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ryw/obj.txt", bytes.NewReader(versionBody(n))))
+				if w.Code/100 != 2 {
+					t.Fatalf("POST of version %d returned %d: %s", n, w.Code, strings.TrimSpace(w.Body.String()))
+				}
+				return w.Header().Get("ETag")
+			}
+			download := func() ([]byte, string, error) {
+				w := httptest.NewRecorder()
+				s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ryw/obj.txt", nil))
+				if w.Code != http.StatusOK {
+					return nil, "", fmt.Errorf("GET returned %d: %s", w.Code, strings.TrimSpace(w.Body.String()))
+				}
+				return w.Body.Bytes(), w.Header().Get("ETag"), nil
+			}
+			readYourWritesRun(t, upload, download)
+		})
+	}
+}
+
+func TestKeyParse(t *testing.T) {
+	s := newTestService(t, common.FileCacheConfig{})
+	outside := t.TempDir()
+	for _, link := range []string{filepath.Join(s.Conf.UploadDir, "upout"), filepath.Join(s.Conf.DeleteDir, "delout")} {
+		if err := os.Symlink(outside, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		filePath string
+		key      string // "" when keyParse must refuse it
+	}{
+		{"/a/b.txt", "a/b.txt"},
+		{"a/./b.txt", "a/b.txt"},
+		{"/../../escape", "escape"},
+		{"/a/../../../escape", "escape"},
+		{"/a%2F..%2F..%2Fescape", "a%2F..%2F..%2Fescape"},
+		{"/", ""},
+		{"/upout/x", ""},
+		{"/delout/x", ""},
+		{"/upout", ""},
+		{"/a/.edgie-meta/b", ""},
+		{"/.edgie-tmp-1", ""},
+		{"/a\x00b", ""},
+		{"/a\\..\\..\\escape", ""},
+	}
+	for _, test := range tests {
+		key, err := s.keyParse(test.filePath)
+		if test.key == "" {
+			if !errors.Is(err, common.ErrKeyInvalid) {
+				t.Errorf("keyParse(%q) = %q, %v, want ErrKeyInvalid", test.filePath, key, err)
+			}
+			continue
+		}
+		if err != nil || key != test.key {
+			t.Errorf("keyParse(%q) = %q, %v, want %q", test.filePath, key, err, test.key)
+		}
+	}
+}
+
+// TestKeyEscape sends hostile paths through ServeHTTP and checks nothing
+// is written outside UPLOAD_DIR and DELETE_DIR.
+func TestKeyEscape(t *testing.T) {
+	s := newTestService(t, common.FileCacheConfig{})
+	outside := t.TempDir()
+	for _, link := range []string{filepath.Join(s.Conf.UploadDir, "upout"), filepath.Join(s.Conf.DeleteDir, "delout")} {
+		if err := os.Symlink(outside, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	targets := []string{
+		"/..%2F..%2Fescape",
+		"/a%2F..%2F..%2F..%2Fescape",
+		"/%2e%2e/%2e%2e/escape",
+		"/upout/escape",
+		"/delout/escape",
+		"/upout%2Fescape",
+		"/a%00b",
+		"/a%5C..%5C..%5Cescape",
+		"/.edgie-meta/escape",
+	}
+	for _, target := range targets {
+		for _, method := range []string{http.MethodPut, http.MethodDelete} {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader("x")))
+			if w.Code >= 500 {
+				t.Errorf("%s %s returned %d: %s", method, target, w.Code, strings.TrimSpace(w.Body.String()))
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("a request wrote %s outside the upload and delete dirs", entry.Name())
+	}
+}
+
+// TestWarmRequestAuth signs a warm request the way edgie warm does and sends
+// it to an admin listener that takes hmac.
+func TestWarmRequestAuth(t *testing.T) {
+	keysPath := filepath.Join(t.TempDir(), "hmac")
+	if err := os.WriteFile(keysPath, []byte("ops MDEyMzQ1Njc4OWFiY2RlZg== admin\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hmacAuth, err := authHMACLoad(keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService(t, common.FileCacheConfig{})
+	s.Conf.Auth.Admin = hmacAuth
+	if _, err := s.Upload("/warm/a", strings.NewReader("a"), UploadChecksums{}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set(OPT_AUTH_HMAC_FILE, keysPath)
+	viper.Set(OPT_WARM_HMAC_KEY, "ops")
+	t.Cleanup(func() {
+		viper.Set(OPT_AUTH_HMAC_FILE, "")
+		viper.Set(OPT_WARM_HMAC_KEY, "")
+	})
+
+	body := []byte(`{"keys":["warm/a"]}`)
+	tests := []struct {
+		name string
+		body []byte
+		sign bool
+		code int
+	}{
+		{"signed", body, true, http.StatusOK},
+		{"unsigned", body, false, http.StatusUnauthorized},
+		{"swapped body", []byte(`{"keys":["warm/b"]}`), true, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, WarmPath, bytes.NewReader(test.body))
+		if test.sign {
+			if err := warmRequestAuth(r, body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w := httptest.NewRecorder()
+		s.AdminHandler().ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s warm request returned %d, want %d: %s", test.name, w.Code, test.code, strings.TrimSpace(w.Body.String()))
+		}
+	}
+}
+
+func authTestFile(t *testing.T, content string) string {
+	t.Helper()
+	filePath := filepath.Join(t.TempDir(), "auth")
+	if err := os.WriteFile(filePath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+// authTestCheck runs auth on r and checks the error is want, or nil.
+func authTestCheck(t *testing.T, name string, auth Authenticator, r *http.Request, class string, want error) {
+	t.Helper()
+	err := auth.Authenticate(r, class)
+	if want == nil && err != nil {
+		t.Errorf("%s: %v, want nil", name, err)
+	} else if want != nil && !errors.Is(err, want) {
+		t.Errorf("%s: %v, want %v", name, err, want)
+	}
+}
+
+func TestAuthBearer(t *testing.T) {
+	auth, err := authBearerLoad(authTestFile(t, "# tokens\nall\nreader read\nops admin,metrics\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		header string
+		class  string
+		want   error
+	}{
+		{"any class", "Bearer all", AuthClassWrite, nil},
+		{"scoped", "Bearer reader", AuthClassRead, nil},
+		{"scheme case", "bearer reader", AuthClassRead, nil},
+		{"comma scopes", "Bearer ops", AuthClassMetrics, nil},
+		{"wrong scope", "Bearer reader", AuthClassWrite, ErrAuthForbidden},
+		{"unknown", "Bearer nope", AuthClassRead, ErrAuthInvalid},
+		{"no header", "", AuthClassRead, ErrAuthMissing},
+		{"other scheme", "Basic all", AuthClassRead, ErrAuthMissing},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/a", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		authTestCheck(t, test.name, auth, r, test.class, test.want)
+	}
+}
+
+func TestAuthHMAC(t *testing.T) {
+	auth, err := authHMACLoad(authTestFile(t, "rw MDEyMzQ1Njc4OWFiY2RlZg==\nro YWJjZGVmZ2hpamtsbW5vcA== read\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("0123456789abcdef")
+	now := time.Now()
+	tests := []struct {
+		name   string
+		method string
+		target string
+		keyID  string
+		signAt time.Time
+		tamper func(r *http.Request)
+		class  string
+		want   error
+	}{
+		{"good", http.MethodGet, "/a/b?stat", "rw", now, nil, AuthClassRead, nil},
+		{"inside skew", http.MethodGet, "/a/b", "rw", now.Add(-4 * time.Minute), nil, AuthClassRead, nil},
+		{"stale date", http.MethodGet, "/a/b", "rw", now.Add(-6 * time.Minute), nil, AuthClassRead, ErrAuthInvalid},
+		{"future date", http.MethodGet, "/a/b", "rw", now.Add(6 * time.Minute), nil, AuthClassRead, ErrAuthInvalid},
+		{"tampered path", http.MethodGet, "/a/b", "rw", now, func(r *http.Request) { r.URL.Path = "/a/c" }, AuthClassRead, ErrAuthInvalid},
+		{"tampered query", http.MethodGet, "/a/?list", "rw", now, func(r *http.Request) { r.URL.RawQuery = "list&delimiter=" }, AuthClassRead, ErrAuthInvalid},
+		{"tampered date", http.MethodGet, "/a/b", "rw", now, func(r *http.Request) {
+			r.Header.Set(HeaderDate, now.Add(time.Second).UTC().Format(time.RFC3339))
+		}, AuthClassRead, ErrAuthInvalid},
+		{"bad date", http.MethodGet, "/a/b", "rw", now, func(r *http.Request) { r.Header.Set(HeaderDate, "yesterday") }, AuthClassRead, ErrAuthInvalid},
+		{"tampered method", http.MethodGet, "/a/b", "rw", now, func(r *http.Request) { r.Method = http.MethodDelete }, AuthClassWrite, ErrAuthInvalid},
+		{"tampered checksum", http.MethodPut, "/a/b", "rw", now, func(r *http.Request) {
+			r.Header.Set(HeaderChecksumSHA256, "c3VtMg==")
+		}, AuthClassWrite, ErrAuthInvalid},
+		{"upload", http.MethodPut, "/a/b", "rw", now, nil, AuthClassWrite, nil},
+		{"upload without checksum", http.MethodPut, "/a/b", "rw", now, func(r *http.Request) {
+			r.Header.Del(HeaderChecksumSHA256)
+		}, AuthClassWrite, ErrAuthInvalid},
+		{"unknown key", http.MethodGet, "/a/b", "nope", now, nil, AuthClassRead, ErrAuthInvalid},
+		{"wrong secret", http.MethodGet, "/a/b", "ro", now, nil, AuthClassRead, ErrAuthInvalid},
+		{"malformed", http.MethodGet, "/a/b", "rw", now, func(r *http.Request) { r.Header.Set("Authorization", "HMAC rw") }, AuthClassRead, ErrAuthInvalid},
+		{"no header", http.MethodGet, "/a/b", "rw", now, func(r *http.Request) { r.Header.Del("Authorization") }, AuthClassRead, ErrAuthMissing},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		if test.method == http.MethodPut {
+			r.Header.Set(HeaderChecksumSHA256, "c3VtMQ==")
+		}
+		AuthHMACSign(r, test.keyID, secret, test.signAt)
+		if test.tamper != nil {
+			test.tamper(r)
+		}
+		authTestCheck(t, test.name, auth, r, test.class, test.want)
+	}
+
+	// a good signature by a key scoped to other classes
+	r := httptest.NewRequest(http.MethodGet, "/a/b", nil)
+	AuthHMACSign(r, "ro", []byte("abcdefghijklmnop"), now)
+	authTestCheck(t, "scoped key", auth, r, AuthClassRead, nil)
+	authTestCheck(t, "wrong scope", auth, r, AuthClassAdmin, ErrAuthForbidden)
+}
+
+// jwtTestKeys are signing keys with the JWKS that publishes them.
+type jwtTestKeys struct {
+	rsa  *rsa.PrivateKey
+	ec   *ecdsa.PrivateKey
+	ed   ed25519.PrivateKey
+	jwks string
+}
+
+func jwtTestKeysNew(t *testing.T) *jwtTestKeys {
+	t.Helper()
+	keys := &jwtTestKeys{}
+	var err error
+	if keys.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if keys.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.ed = edKey
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kid": "rsa", "kty": "RSA", "n": b64(keys.rsa.N.Bytes()), "e": b64(big.NewInt(int64(keys.rsa.E)).Bytes())},
+		{"kid": "ec", "kty": "EC", "crv": "P-256", "x": b64(keys.ec.X.Bytes()), "y": b64(keys.ec.Y.Bytes())},
+		{"kid": "ed", "kty": "OKP", "crv": "Ed25519", "x": b64(edPub)},
+		{"kid": "enc", "kty": "RSA", "use": "enc", "n": "AQ", "e": "AQ"},
+	}})
+	keys.jwks = string(jwks)
+	return keys
+}
+
+// mint signs claims with the key of kid using alg, whatever the key is for.
+func (keys *jwtTestKeys) mint(t *testing.T, alg string, kid string, claims map[string]any) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch kid {
+	case "rsa":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, keys.rsa, crypto.SHA256, digest[:])
+	case "ec":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, keys.ec, digest[:])
+		if err == nil {
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	case "ed":
+		sig = ed25519.Sign(keys.ed, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestAuthJWT(t *testing.T) {
+	keys := jwtTestKeysNew(t)
+	jwksKeys, err := authJWKSLoad(authTestFile(t, keys.jwks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := jwksKeys["enc"]; ok || len(jwksKeys) != 3 {
+		t.Fatalf("JWKS loaded %d keys, want the 3 signing keys", len(jwksKeys))
+	}
+	auth := &authJWT{audience: "edgie", issuer: "https://idp", keys: jwksKeys}
+
+	now := time.Now().Unix()
+	claims := func(edit func(c map[string]any)) map[string]any {
+		c := map[string]any{"aud": "edgie", "iss": "https://idp", "exp": now + 60, "scope": "read write"}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	tests := []struct {
+		name  string
+		token string
+		class string
+		want  error
+	}{
+		{"RS256", keys.mint(t, "RS256", "rsa", claims(nil)), AuthClassRead, nil},
+		{"ES256", keys.mint(t, "ES256", "ec", claims(nil)), AuthClassWrite, nil},
+		{"EdDSA", keys.mint(t, "EdDSA", "ed", claims(nil)), AuthClassRead, nil},
+		{"scp list", keys.mint(t, "EdDSA", "ed", claims(func(c map[string]any) {
+			delete(c, "scope")
+			c["scp"] = []string{"admin"}
+		})), AuthClassAdmin, nil},
+		{"aud list", keys.mint(t, "EdDSA", "ed", claims(func(c map[string]any) { c["aud"] = []string{"other", "edgie"} })), AuthClassRead, nil},
+		{"wrong scope", keys.mint(t, "RS256", "rsa", claims(nil)), AuthClassAdmin, ErrAuthForbidden},
+		{"no scope", keys.mint(t, "RS256", "rsa", claims(func(c map[string]any) { delete(c, "scope") })), AuthClassRead, ErrAuthForbidden},
+		{"missing exp", keys.mint(t, "RS256", "rsa", claims(func(c map[string]any) { delete(c, "exp") })), AuthClassRead, ErrAuthInvalid},
+		{"expired", keys.mint(t, "RS256", "rsa", claims(func(c map[string]any) { c["exp"] = now - 120 })), AuthClassRead, ErrAuthInvalid},
+		{"expired inside leeway", keys.mint(t, "RS256", "rsa", claims(func(c map[string]any) { c["exp"] = now - 30 })), AuthClassRead, nil},
+		{"not yet", keys.mint(t, "RS256", "rsa", claims(func(c map[string]any) { c["nbf"] = now + 120 })), AuthClassRead, ErrAuthInvalid},
+		{"nbf inside leeway", keys.mint(t, "RS256", "rsa", claims(func(c map[string]any) { c["nbf"] = now + 30 })), AuthClassRead, nil},
+		{"wrong issuer", keys.mint(t, "RS256", "rsa", claims(func(c map[string]any) { c["iss"] = "https://evil" })), AuthClassRead, ErrAuthInvalid},
+		{"wrong audience", keys.mint(t, "RS256", "rsa", claims(func(c map[string]any) { c["aud"] = "other" })), AuthClassRead, ErrAuthInvalid},
+		{"RS alg on EC key", keys.mint(t, "RS256", "ec", claims(nil)), AuthClassRead, ErrAuthInvalid},
+		{"ES alg on RSA key", keys.mint(t, "ES256", "rsa", claims(nil)), AuthClassRead, ErrAuthInvalid},
+		{"ES384 on P-256 key", keys.mint(t, "ES384", "ec", claims(nil)), AuthClassRead, ErrAuthInvalid},
+		{"RS alg on Ed25519 key", keys.mint(t, "RS256", "ed", claims(nil)), AuthClassRead, ErrAuthInvalid},
+		{"HS256", keys.mint(t, "HS256", "rsa", claims(nil)), AuthClassRead, ErrAuthInvalid},
+		{"none", keys.mint(t, "none", "rsa", claims(nil)), AuthClassRead, ErrAuthInvalid},
+		{"not a JWT", "abc.def", AuthClassRead, ErrAuthInvalid},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/a", nil)
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		authTestCheck(t, test.name, auth, r, test.class, test.want)
+	}
+
+	// a tampered payload fails the signature
+	token := keys.mint(t, "RS256", "rsa", claims(nil))
+	parts := strings.Split(token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d,"scope":"admin","aud":"edgie","iss":"https://idp"}`, now+60)))
+	r := httptest.NewRequest(http.MethodGet, "/a", nil)
+	r.Header.Set("Authorization", "Bearer "+strings.Join(parts, "."))
+	authTestCheck(t, "tampered claims", auth, r, AuthClassAdmin, ErrAuthInvalid)
+
+	// a good signature under a kid the JWKS does not have
+	parts = strings.Split(token, ".")
+	parts[0] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"gone"}`))
+	r.Header.Set("Authorization", "Bearer "+strings.Join(parts, "."))
+	authTestCheck(t, "unknown kid", auth, r, AuthClassRead, ErrAuthInvalid)
+	authTestCheck(t, "no token", auth, httptest.NewRequest(http.MethodGet, "/a", nil), AuthClassRead, ErrAuthMissing)
+}
+
+func TestAuthJWKSLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		jwks string
+	}{
+		{"not JSON", "keys"},
+		{"no keys", `{"keys":[]}`},
+		{"only enc keys", `{"keys":[{"kty":"RSA","use":"enc","n":"AQ","e":"AQ"}]}`},
+		{"bad RSA", `{"keys":[{"kid":"a","kty":"RSA","n":"","e":"AQ"}]}`},
+		{"unknown curve", `{"keys":[{"kid":"a","kty":"EC","crv":"P-192","x":"AQ","y":"AQ"}]}`},
+		{"off curve", `{"keys":[{"kid":"a","kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`},
+		{"short Ed25519", `{"keys":[{"kid":"a","kty":"OKP","crv":"Ed25519","x":"AQ"}]}`},
+	}
+	for _, test := range tests {
+		if _, err := authJWKSLoad(authTestFile(t, test.jwks)); err == nil {
+			t.Errorf("authJWKSLoad of %s succeeded", test.name)
+		}
+	}
+	if _, err := authJWKSLoad(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("authJWKSLoad of a missing file succeeded")
+	}
+}
+
+func TestAuthMTLS(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/a", nil)
+	authTestCheck(t, "plain HTTP", authMTLS{}, r, AuthClassRead, ErrAuthMissing)
+	r.TLS = &tls.ConnectionState{}
+	authTestCheck(t, "no client cert", authMTLS{}, r, AuthClassRead, ErrAuthMissing)
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{{Raw: []byte("leaf")}}}
+	authTestCheck(t, "verified cert", authMTLS{}, r, AuthClassRead, nil)
+}
+
+// TestAuthRefuse checks the status and challenge of each kind of failure,
+// with authAny reporting the most telling one.
+func TestAuthRefuse(t *testing.T) {
+	bearer, err := authBearerLoad(authTestFile(t, "reader read\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacAuth, err := authHMACLoad(authTestFile(t, "rw MDEyMzQ1Njc4OWFiY2RlZg==\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService(t, common.FileCacheConfig{})
+	s.Conf.Auth.Read = authAny{hmacAuth, bearer}
+	s.Conf.Auth.Write = authAny{hmacAuth, bearer}
+	if _, err := s.Upload("/obj", strings.NewReader("x"), UploadChecksums{}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		header string
+		code   int
+	}{
+		{"missing", http.MethodGet, "", http.StatusUnauthorized},
+		{"invalid", http.MethodGet, "Bearer nope", http.StatusUnauthorized},
+		{"forbidden", http.MethodDelete, "Bearer reader", http.StatusForbidden},
+		{"allowed", http.MethodGet, "Bearer reader", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/obj", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: %s returned %d, want %d", test.name, test.method, w.Code, test.code)
+		}
+		challenges := strings.Join(w.Header().Values("WWW-Authenticate"), ", ")
+		if w.Code == http.StatusUnauthorized && (!strings.Contains(challenges, "Bearer") || !strings.Contains(challenges, "HMAC")) {
+			t.Errorf("%s: WWW-Authenticate is %q, want Bearer and HMAC", test.name, challenges)
+		}
+	}
+}
+
+func TestLimiterTake(t *testing.T) {
+	l := limiterNew(LimitRule{By: LimitByIP, Rate: 2, Burst: 3})
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.take("a", now); !ok {
+			t.Fatalf("take %d of a burst of 3 was refused", i+1)
+		}
+	}
+	ok, wait := l.take("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("take past the burst = %v, %v, want false, 500ms", ok, wait)
+	}
+	// other ids have their own bucket
+	if ok, _ := l.take("b", now); !ok {
+		t.Errorf("take by another id was refused")
+	}
+	// half a token refills in 250ms, so a whole one is 250ms off
+	ok, wait = l.take("a", now.Add(250*time.Millisecond))
+	if ok || wait != 250*time.Millisecond {
+		t.Errorf("take after 250ms = %v, %v, want false, 250ms", ok, wait)
+	}
+	if ok, _ := l.take("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("take after a token refilled was refused")
+	}
+	// refills stop at the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.take("a", later); !ok {
+			t.Fatalf("take %d after an idle hour was refused", i+1)
+		}
+	}
+	if ok, _ := l.take("a", later); ok {
+		t.Errorf("an idle hour refilled past the burst")
+	}
+}
+
+func TestLimiterBucketsMax(t *testing.T) {
+	l := limiterNew(LimitRule{By: LimitByIP, Rate: 1, Burst: 1})
+	l.bucketsMax = 3
+	now := time.Unix(1000, 0)
+	for _, id := range []string{"a", "b", "c"} {
+		l.take(id, now)
+	}
+	// a is used again, so b is the least recently used
+	l.take("a", now)
+	// a new id at the cap is served, not refused
+	if ok, _ := l.take("d", now); !ok {
+		t.Fatalf("a new id was refused at the bucket cap")
+	}
+	if len(l.buckets) != 3 || l.recency.Len() != 3 {
+		t.Fatalf("limiter holds %d buckets and %d in recency, want 3", len(l.buckets), l.recency.Len())
+	}
+	if _, ok := l.buckets["b"]; ok {
+		t.Errorf("the cap dropped another bucket than the least recently used")
+	}
+	for _, id := range []string{"a", "c", "d"} {
+		if ok, _ := l.take(id, now); ok {
+			t.Errorf("%s lost its empty bucket to the cap", id)
+		}
+	}
+
+	// sweep drops buckets that filled back up, oldest first
+	l.take("c", now.Add(2*time.Second))
+	l.sweep(now.Add(2 * time.Second))
+	if _, ok := l.buckets["c"]; !ok || len(l.buckets) != 1 || l.recency.Len() != 1 {
+		t.Errorf("sweep left %d buckets, want just c", len(l.buckets))
+	}
+}
+
+func TestLimitRetryAfter(t *testing.T) {
+	s := newTestService(t, common.FileCacheConfig{})
+	s.Conf.LimitRules = []LimitRule{
+		{By: LimitByIP, Rate: 0.25, Burst: 1, Prefix: "slow/"},
+		{By: LimitByToken, Rate: 100, Burst: 1},
+	}
+	s.limitStart()
+
+	request := func(target string, remoteAddr string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+	if w := httptest.NewRecorder(); !s.limit(w, request("/slow/a", "10.0.0.1:1"), "", false) {
+		t.Fatalf("first request was refused: %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	if s.limit(w, request("/slow/a", "10.0.0.1:2"), "", false) {
+		t.Fatalf("second request inside the burst was allowed")
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "4" {
+		t.Errorf("refusal is %d with Retry-After %q, want 429 with 4", w.Code, w.Header().Get("Retry-After"))
+	}
+	if !s.limit(httptest.NewRecorder(), request("/slow/a", "10.0.0.2:1"), "", false) {
+		t.Errorf("another client shared the ip bucket")
+	}
+	if !s.limit(httptest.NewRecorder(), request("/fast/a", "10.0.0.1:3"), "", false) {
+		t.Errorf("a request outside the prefix was limited")
+	}
+
+	// token rules key by identity and only run when asked for
+	if !s.limit(httptest.NewRecorder(), request("/a", "10.0.0.3:1"), "bearer:x", true) {
+		t.Fatalf("first token request was refused")
+	}
+	w = httptest.NewRecorder()
+	if s.limit(w, request("/a", "10.0.0.4:1"), "bearer:x", true) {
+		t.Errorf("the same identity from another address got a new bucket")
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("a sub-second wait has Retry-After %q, want 1", w.Header().Get("Retry-After"))
+	}
+	if !s.limit(httptest.NewRecorder(), request("/a", "10.0.0.3:1"), "bearer:y", true) {
+		t.Errorf("another identity shared the token bucket")
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	_, keys, err := signKeysLoad(authTestFile(t, "new MDEyMzQ1Njc4OWFiY2RlZg==\nold YWJjZGVmZ2hpamtsbW5vcA==\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &authURL{keys: keys}
+	later := time.Now().Add(time.Hour)
+
+	sign := func(target string, method string, prefix string, expires time.Time, keyID string) string {
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		SignURL(u, method, prefix, expires, keyID, keys[keyID])
+		return u.String()
+	}
+	// with swaps the path or adds params to a signed URL
+	with := func(signed string, path string, params ...string) string {
+		u, _ := url.Parse(signed)
+		if path != "" {
+			u.Path = path
+		}
+		query := u.Query()
+		for _, param := range params {
+			query.Set(param, "")
+		}
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	get := sign("/a/b", http.MethodGet, "", later, "new")
+	list := sign("/a/b/?list", http.MethodGet, "", later, "new")
+	dir := sign("/a/b/c", http.MethodGet, "a/b/", later, "new")
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		class  string
+		want   error
+	}{
+		{"get", http.MethodGet, get, AuthClassRead, nil},
+		{"head of get", http.MethodHead, get, AuthClassRead, nil},
+		{"put of get", http.MethodPut, get, AuthClassWrite, ErrAuthForbidden},
+		{"get as admin", http.MethodGet, get, AuthClassAdmin, ErrAuthForbidden},
+		{"other key", http.MethodGet, with(get, "/a/bc"), AuthClassRead, ErrAuthInvalid},
+		{"get as list", http.MethodGet, with(get, "", SignedURLOpList), AuthClassRead, ErrAuthInvalid},
+		{"get as stat", http.MethodGet, with(get, "", SignedURLOpStat), AuthClassRead, ErrAuthInvalid},
+		{"list", http.MethodGet, list, AuthClassRead, nil},
+		{"list as get", http.MethodGet, with(sign("/a/b", http.MethodGet, "", later, "new"), "", SignedURLOpList), AuthClassRead, ErrAuthInvalid},
+		{"old key", http.MethodGet, sign("/a/b", http.MethodGet, "", later, "old"), AuthClassRead, nil},
+		{"expired", http.MethodGet, sign("/a/b", http.MethodGet, "", time.Now().Add(-time.Second), "new"), AuthClassRead, ErrAuthInvalid},
+		{"prefix", http.MethodGet, dir, AuthClassRead, nil},
+		{"under prefix", http.MethodGet, with(dir, "/a/b/d/e"), AuthClassRead, nil},
+		{"sibling of prefix", http.MethodGet, with(dir, "/a/bc"), AuthClassRead, ErrAuthForbidden},
+		{"prefix as list", http.MethodGet, with(dir, "/a/b/", SignedURLOpList), AuthClassRead, ErrAuthInvalid},
+		{"no signature", http.MethodGet, "/a/b", AuthClassRead, ErrAuthMissing},
+	}
+	for _, test := range tests {
+		authTestCheck(t, test.name, auth, httptest.NewRequest(test.method, test.target, nil), test.class, test.want)
+	}
+
+	// once old is rotated out, the URLs it signed stop working
+	rotated := &authURL{keys: map[string][]byte{"new": keys["new"]}}
+	authTestCheck(t, "rotated out key", rotated, httptest.NewRequest(http.MethodGet, sign("/a/b", http.MethodGet, "", later, "old"), nil), AuthClassRead, ErrAuthInvalid)
+	authTestCheck(t, "rotated in key", rotated, httptest.NewRequest(http.MethodGet, get, nil), AuthClassRead, nil)
+
+	// a later expiry or a wider prefix is a different signature
+	u, _ := url.Parse(dir)
+	query := u.Query()
+	query.Set(SignedURLExpires, strconv.FormatInt(later.Add(time.Hour).Unix(), 10))
+	u.RawQuery = query.Encode()
+	authTestCheck(t, "extended expiry", auth, httptest.NewRequest(http.MethodGet, u.String(), nil), AuthClassRead, ErrAuthInvalid)
+	query.Set(SignedURLExpires, strconv.FormatInt(later.Unix(), 10))
+	query.Set(SignedURLPrefix, "a/")
+	u.RawQuery = query.Encode()
+	authTestCheck(t, "widened prefix", auth, httptest.NewRequest(http.MethodGet, u.String(), nil), AuthClassRead, ErrAuthInvalid)
+}
+
+func TestAuthIdentity(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	auth := &authURL{keys: map[string][]byte{"k": secret}}
+	later := time.Now().Add(time.Hour)
+	identity := func(target string) string {
+		u, _ := url.Parse(target)
+		SignURL(u, http.MethodGet, "", later, "k", secret)
+		r := httptest.NewRequest(http.MethodGet, u.String(), nil)
+		if err := auth.Authenticate(r, AuthClassRead); err != nil {
+			t.Fatal(err)
+		}
+		return authIdentity(auth, r)
+	}
+	// a hot shared link must not throttle the other links of its key
+	if a, b := identity("/a"), identity("/b"); a == b || a != identity("/a") {
+		t.Errorf("URLs signed with one key have identities %q and %q", a, b)
+	}
+}
+
+func TestVariantBytesMax(t *testing.T) {
+	tests := []struct {
+		name      string
+		cacheConf common.FileCacheConfig
+		size      int
+		encoding  string
+	}{
+		{"small", common.FileCacheConfig{}, 2048, common.EncodingGzip},
+		{"over max", common.FileCacheConfig{}, 8192, ""},
+		{"sendfile", common.FileCacheConfig{RAMBytesMax: 1, SendfileBytesMin: 1024}, 2048, ""},
+	}
+	for _, test := range tests {
+		s := newTestService(t, test.cacheConf)
+		s.Conf.CompressEncodings = []string{common.EncodingGzip}
+		s.Conf.CompressBytesMin = 1
+		s.Conf.CompressBytesMax = 4096
+		body := bytes.Repeat([]byte("compressible "), test.size/13+1)[:test.size]
+		if _, err := s.Upload("/v/a.txt", bytes.NewReader(body), UploadChecksums{}, ""); err != nil {
+			t.Fatal(err)
+		}
+		// the second GET is a cache hit, which is when sendfile applies
+		for i := 0; i < 2; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/v/a.txt", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: GET returned %d", test.name, w.Code)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != test.encoding {
+				t.Errorf("%s: GET %d has Content-Encoding %q, want %q", test.name, i+1, got, test.encoding)
+			}
+			if test.encoding == "" && !bytes.Equal(w.Body.Bytes(), body) {
+				t.Errorf("%s: GET %d did not serve the identity bytes", test.name, i+1)
+			}
+		}
+	}
+}
+
+func TestStatUploadETag(t *testing.T) {
+	s := newTestService(t, common.FileCacheConfig{})
+	body := []byte("pending upload")
+	if _, err := s.Upload("/st/a", bytes.NewReader(body), UploadChecksums{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.Stat("/st/a")
+	if err != nil || info.Tier != TierUpload || info.ETag != etagOf(body) {
+		t.Fatalf("Stat = %+v, %v, want the upload with ETag %s", info, err, etagOf(body))
+	}
+
+	// same size and mtime... the sidecar still vouches for it, so Stat must
+	// not have hashed the file to get the ETag
+	uploadPath := s.uploadPath("st/a")
+	fileInfo, err := os.Stat(uploadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(uploadPath, []byte("rewritten byte"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(uploadPath, fileInfo.ModTime(), fileInfo.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := s.Stat("/st/a"); err != nil || info.ETag != etagOf(body) {
+		t.Errorf("Stat = %+v, %v, want the ETag from the sidecar", info, err)
+	}
+
+	// a sidecar from before MD5 was recorded falls back to hashing
+	if err := s.uploadMetaWrite("st/a", fileInfo, nil, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := s.Stat("/st/a"); err != nil || info.ETag != etagOf([]byte("rewritten byte")) {
+		t.Errorf("Stat = %+v, %v, want the ETag of the file", info, err)
+	}
+}
+
+func TestPrefetchRef(t *testing.T) {
+	for _, tc := range []struct {
+		key, ref, want string
+	}{
+		{"v/index.m3u8", "seg1.ts", "v/seg1.ts"},
+		{"v/index.m3u8", "hi/seg1.ts?token=x#t", "v/hi/seg1.ts"},
+		{"v/page.html", "../css/site.css", "css/site.css"},
+		{"v/page.html", "/js/app.js", "js/app.js"},
+		{"page.html", "img/a.png", "img/a.png"},
+		{"v/page.html", "../../etc/passwd", ""},
+		{"page.html", "../a.png", ""},
+		{"v/page.html", "//cdn.example.com/a.js", ""},
+		{"v/page.html", "https://example.com/a.js", ""},
+		{"v/page.html", "data:image/png;base64,AAAA", ""},
+		{"v/page.html", ".edgie-meta/a", ""},
+		{"v/page.html", "/x/.edgie-variant/a", ""},
+		{"v/page.html", "#top", ""},
+		{"v/page.html", "?q=1", ""},
+	} {
+		got, ok := prefetchRef(tc.key, tc.ref)
+		if ok != (tc.want != "") || got != tc.want {
+			t.Errorf("prefetchRef(%q, %q) = %q, %v, want %q", tc.key, tc.ref, got, ok, tc.want)
+		}
+	}
+}
+
+func TestPrefetchM3U8Refs(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:6\n\n#EXTINF:6.0,\nseg0.ts\n#EXTINF:6.0,\n  seg1.ts  \r\n#EXTINF:6.0,\nhttps://other.example.com/seg2.ts\n#EXTINF:6.0,\n/live/seg3.ts\n#EXT-X-ENDLIST\n"
+	got := prefetchM3U8Refs("live/index.m3u8", []byte(playlist))
+	want := []string{"live/seg0.ts", "live/seg1.ts", "live/seg3.ts"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("prefetchM3U8Refs = %q, want %q", got, want)
+	}
+}
+
+func TestPrefetchHTMLRefs(t *testing.T) {
+	page := `<html><head>
+<link rel="stylesheet" href="site.css">
+<SCRIPT type="module" SRC='/js/app.js?v=2'></SCRIPT>
+<script src="//cdn.example.com/lib.js"></script>
+</head><body>
+<a href="other.html">not an asset</a>
+<img alt="x" src="img/a.png"><img src="img/a.png">
+<video controls><source src="../media/clip.mp4" type="video/mp4"></video>
+</body></html>`
+	got := prefetchHTMLRefs("site/index.html", []byte(page))
+	want := []string{"site/site.css", "js/app.js", "site/img/a.png", "media/clip.mp4"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("prefetchHTMLRefs = %q, want %q", got, want)
+	}
+}
+
+func TestPrefetchRulesParse(t *testing.T) {
+	rules, err := prefetchRulesParse(" m3u8:3:live/, html:10:site/,learn:2:, ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PrefetchRule{
+		{Kind: PrefetchKindM3U8, Count: 3, Prefix: "live/"},
+		{Kind: PrefetchKindHTML, Count: 10, Prefix: "site/"},
+		{Kind: PrefetchKindLearn, Count: 2, Prefix: ""},
+	}
+	if fmt.Sprint(rules) != fmt.Sprint(want) {
+		t.Errorf("prefetchRulesParse = %v, want %v", rules, want)
+	}
+	if rules, err := prefetchRulesParse(""); rules != nil || err != nil {
+		t.Errorf("prefetchRulesParse of nothing = %v, %v, want nil, nil", rules, err)
+	}
+	for _, rulesOpt := range []string{"m3u8:3", "zip:3:a/", "html:0:a/", "html:-1:a/", "html:x:a/"} {
+		if _, err := prefetchRulesParse(rulesOpt); err == nil {
+			t.Errorf("prefetchRulesParse(%q) did not fail", rulesOpt)
+		}
+	}
+}
+
+func TestPrefetchLowPriority(t *testing.T) {
+	s := newTestService(t, common.FileCacheConfig{})
+	s.prefetch = newPrefetcher([]PrefetchRule{{Kind: PrefetchKindM3U8, Count: 3}})
+	rule := &s.prefetch.rules[0]
+
+	// a playlist past the parse cap is not read
+	big := bytes.Repeat([]byte("seg.ts\n"), prefetchParseBytesMax/7+1)
+	h, err := s.Cache.Put("big.m3u8", bytes.NewReader(big), common.FileCacheMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	s.prefetchParse(prefetchJob{rule: rule, key: "big.m3u8", parse: true})
+	if len(s.prefetch.positions) != 0 || len(s.prefetch.queue) != 0 {
+		t.Errorf("a %d byte playlist was parsed", len(big))
+	}
+
+	// with every origin slot taken a prefetch is dropped, not queued
+	s.originSlots = make(chan struct{}, 1)
+	s.originSlots <- struct{}{}
+	done := make(chan struct{})
+	go func() {
+		s.prefetchFetch(prefetchJob{rule: rule, key: "seg.ts"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("prefetch waited for an origin slot")
+	}
+	if s.Cache.Has("seg.ts") {
+		t.Errorf("a prefetch without an origin slot cached seg.ts")
+	}
+}
+
+// listTestOrigin serves pages of pageSize keys from sorted keys, like S3 without a delimiter.
+func listTestOrigin(keys []string, pageSize int, calls *int) func(startAfter string) (*s3.ListObjectsV2Output, error) {
+	return func(startAfter string) (*s3.ListObjectsV2Output, error) {
+		*calls++
+		page := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+		for _, key := range keys {
+			if key <= startAfter {
+				continue
+			}
+			if len(page.Contents) == pageSize {
+				page.IsTruncated = aws.Bool(true)
+				break
+			}
+			page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key)})
+		}
+		return page, nil
+	}
+}
+
+func TestListPages(t *testing.T) {
+	var keys []string
+	for i := 0; i < 10; i++ {
+		keys = append(keys, "k"+strconv.Itoa(i))
+	}
+	deleted := map[string]bool{"k0": true, "k1": true, "k2": true, "k3": true, "k4": true, "k6": true}
+	live := func(entry ListEntry) (bool, error) { return !deleted[entry.Key], nil }
+	listKeys := func(entries []ListEntry) string {
+		var keys []string
+		for _, entry := range entries {
+			keys = append(keys, entry.Key)
+		}
+		return strings.Join(keys, ",")
+	}
+
+	// deletes are skipped before the page is cut, so it still fills up
+	calls := 0
+	pending := []ListEntry{{Key: "k45", Tier: TierUpload}}
+	entries, next, err := listPages(pending, "", 3, listTestOrigin(keys, 3, &calls), live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := listKeys(entries); got != "k45,k5,k7" || next == nil || next.Key != "k7" || calls != 3 {
+		t.Fatalf("first page is %s resuming after %v in %d calls, want k45,k5,k7 after k7 in 3", got, next, calls)
+	}
+	entries, next, err = listPages(nil, listStartAfter(*next), 3, listTestOrigin(keys, 3, &calls), live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := listKeys(entries); got != "k8,k9" || next != nil {
+		t.Fatalf("last page is %s resuming after %v, want k8,k9 and no more", got, next)
+	}
+
+	// a page of nothing but deletes stops after listOriginPagesMax pages and says where to resume
+	keys = nil
+	for i := 0; i < 2*listOriginPagesMax; i++ {
+		key := fmt.Sprintf("z%02d", i)
+		keys = append(keys, key)
+		deleted[key] = true
+	}
+	calls = 0
+	entries, next, err = listPages(nil, "", 1, listTestOrigin(keys, 1, &calls), live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 || next == nil || next.Key != keys[listOriginPagesMax-1] || calls != listOriginPagesMax {
+		t.Fatalf("deleted keys gave %d entries resuming after %v in %d calls, want none after %s in %d",
+			len(entries), next, calls, keys[listOriginPagesMax-1], listOriginPagesMax)
+	}
+}
+
+func TestListLive(t *testing.T) {
+	s := newTestService(t, common.FileCacheConfig{})
+	if err := s.Delete("d/gone"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		entry ListEntry
+		live  bool
+	}{
+		{ListEntry{Key: "d/gone"}, false},
+		{ListEntry{Key: "d/kept"}, true},
+		// no deletes under it, so S3 is not asked
+		{ListEntry{Key: "e/", Dir: true}, true},
+	} {
+		live, err := s.listLive(nil, tc.entry)
+		if err != nil || live != tc.live {
+			t.Errorf("listLive(%s) = %v, %v, want %v", tc.entry.Key, live, err, tc.live)
+		}
+	}
+	for prefix, want := range map[string]bool{"d/": true, "d/g": true, "": true, "d/k": false, "e/": false} {
+		if found, err := s.listPendingDeletes(prefix); err != nil || found != want {
+			t.Errorf("listPendingDeletes(%q) = %v, %v, want %v", prefix, found, err, want)
+		}
+	}
+}
+
+func TestWarmKeySkipsDirMarkers(t *testing.T) {
+	s := newTestService(t, common.FileCacheConfig{})
+	if _, err := s.Upload("/warm/a", strings.NewReader("a"), UploadChecksums{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	w := &warm{}
+	for _, key := range []string{"warm/", "warm/a", "warm/sub/"} {
+		s.warmKey(key, w)
+	}
+	p := w.snapshot()
+	if p.Skipped != 2 || p.Cached != 1 || p.Failed != 0 {
+		t.Errorf("warm of two directory markers and a key: %+v", p)
+	}
+}
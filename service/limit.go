@@ -0,0 +1,270 @@
+package service
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// What a rate limit rule keys its buckets by. IP rules give each client
+// address a bucket. Token rules give each verified bearer token, HMAC key,
+// signed URL or client cert a bucket, and fall back to the address for requests
+// without one. Prefix rules share one bucket among every request under the prefix.
+const (
+	LimitByIP     = "ip"
+	LimitByPrefix = "prefix"
+	LimitByToken  = "token"
+)
+
+const (
+	// a busy server asks clients to come back after this long
+	limitBusyRetryAfter = time.Second
+	// idle buckets are dropped this often
+	limitSweepInterval = time.Minute
+	// a rule with this many buckets drops its least recently used one for a new id
+	limitBucketsMax = 1 << 16
+)
+
+// ErrBusy means every origin fetch or upload slot is taken. It maps to 429.
+var ErrBusy = errors.New("too many requests in flight")
+
+var (
+	limitRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgie_rate_limited_total",
+		Help: "Total number of requests refused by a rate limit, by what the limit is keyed by.",
+	}, []string{"by"})
+
+	limitBusy = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgie_busy_total",
+		Help: "Total number of requests refused because every slot was taken, by slot: origin or upload.",
+	}, []string{"slot"})
+)
+
+// LimitRule is a token bucket for requests for keys under Prefix: Rate
+// requests a second, with bursts of up to Burst.
+type LimitRule struct {
+	By     string
+	Rate   float64
+	Burst  int
+	Prefix string
+}
+
+type limitBucket struct {
+	id     string
+	tokens float64
+	at     time.Time
+}
+
+// limiter holds the buckets of a rule, least recently used first in recency.
+// A dropped bucket starts over full, so under a flood of new ids the ones
+// that went quiet longest lose their debt first and busy ids keep theirs.
+type limiter struct {
+	LimitRule
+	mutex      sync.Mutex
+	buckets    map[string]*list.Element
+	recency    *list.List
+	bucketsMax int
+}
+
+func limiterNew(rule LimitRule) *limiter {
+	return &limiter{
+		LimitRule:  rule,
+		buckets:    make(map[string]*list.Element),
+		recency:    list.New(),
+		bucketsMax: limitBucketsMax,
+	}
+}
+
+// take spends a token from the bucket of id. When there is none it returns
+// how long until there will be.
+func (l *limiter) take(id string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var bucket *limitBucket
+	if element, ok := l.buckets[id]; ok {
+		bucket = element.Value.(*limitBucket)
+		l.recency.MoveToBack(element)
+	} else {
+		if len(l.buckets) >= l.bucketsMax {
+			oldest := l.recency.Front()
+			delete(l.buckets, oldest.Value.(*limitBucket).id)
+			l.recency.Remove(oldest)
+		}
+		bucket = &limitBucket{id: id, tokens: float64(l.Burst), at: now}
+		l.buckets[id] = l.recency.PushBack(bucket)
+	}
+	bucket.tokens = math.Min(float64(l.Burst), bucket.tokens+now.Sub(bucket.at).Seconds()*l.Rate)
+	bucket.at = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / l.Rate * float64(time.Second))
+}
+
+// sweepForever sweeps every limitSweepInterval.
+func (l *limiter) sweepForever() {
+	for now := range time.Tick(limitSweepInterval) {
+		l.mutex.Lock()
+		l.sweep(now)
+		l.mutex.Unlock()
+	}
+}
+
+// sweep drops the buckets that have filled back up, which are the same as
+// no bucket. They are the least recently used, so it stops at the first
+// that has not. Callers hold the mutex.
+func (l *limiter) sweep(now time.Time) {
+	full := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	for element := l.recency.Front(); element != nil; element = l.recency.Front() {
+		bucket := element.Value.(*limitBucket)
+		if now.Sub(bucket.at) < full {
+			return
+		}
+		delete(l.buckets, bucket.id)
+		l.recency.Remove(element)
+	}
+}
+
+func (s *Service) limitStart() {
+	for _, rule := range s.Conf.LimitRules {
+		l := limiterNew(rule)
+		s.limiters = append(s.limiters, l)
+		go l.sweepForever()
+	}
+	if s.Conf.OriginFetchesMax > 0 {
+		s.originSlots = make(chan struct{}, s.Conf.OriginFetchesMax)
+	}
+	if s.Conf.UploadsMax > 0 {
+		s.uploadSlots = make(chan struct{}, s.Conf.UploadsMax)
+	}
+}
+
+// limit spends a token from each rule that covers r: the token rules when
+// tokens is set, the others when not. Token rules key by identity, a
+// credential auth verified, and by the client address when it is empty. It
+// writes the 429 response when a rule has none left.
+func (s *Service) limit(w http.ResponseWriter, r *http.Request, identity string, tokens bool) bool {
+	if len(s.limiters) == 0 {
+		return true
+	}
+	key := keyClean(r.URL.Path)
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	now := time.Now()
+	for _, l := range s.limiters {
+		if (l.By == LimitByToken) != tokens || !strings.HasPrefix(key, l.Prefix) {
+			continue
+		}
+		id := client
+		switch l.By {
+		case LimitByPrefix:
+			id = l.Prefix
+		case LimitByToken:
+			if identity != "" {
+				id = identity
+			}
+		}
+		if ok, wait := l.take(id, now); !ok {
+			limitRejected.WithLabelValues(l.By).Inc()
+			limitRetryAfter(w, wait)
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return false
+		}
+	}
+	return true
+}
+
+// limitRetryAfter sets Retry-After to wait in whole seconds, at least one.
+func limitRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+// slotAcquire takes a slot, waiting for one if wait is set. A nil slots is unlimited.
+func slotAcquire(slots chan struct{}, slot string, wait bool) error {
+	if slots == nil {
+		return nil
+	}
+	if wait {
+		slots <- struct{}{}
+		return nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+		limitBusy.WithLabelValues(slot).Inc()
+		return ErrBusy
+	}
+}
+
+func slotRelease(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// slotReadCloser holds a slot until it is closed.
+type slotReadCloser struct {
+	io.ReadCloser
+	slots    chan struct{}
+	released sync.Once
+}
+
+func (r *slotReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.released.Do(func() { slotRelease(r.slots) })
+	return err
+}
+
+// limitRulesParse reads RATE_LIMITS: by:rate:burst[:prefix],...
+func limitRulesParse(rulesOpt string) ([]LimitRule, error) {
+	var rules []LimitRule
+	for _, ruleOpt := range strings.Split(rulesOpt, ",") {
+		ruleOpt = strings.TrimSpace(ruleOpt)
+		if ruleOpt == "" {
+			continue
+		}
+		parts := strings.SplitN(ruleOpt, ":", 4)
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("RATE_LIMITS entry %q is not by:rate:burst[:prefix]", ruleOpt)
+		}
+		rule := LimitRule{By: parts[0]}
+		if len(parts) == 4 {
+			rule.Prefix = parts[3]
+		}
+		switch rule.By {
+		case LimitByIP, LimitByToken:
+		case LimitByPrefix:
+			if rule.Prefix == "" {
+				return nil, fmt.Errorf("RATE_LIMITS entry %q needs a prefix", ruleOpt)
+			}
+		default:
+			return nil, fmt.Errorf("RATE_LIMITS entry %q has unknown by %s", ruleOpt, rule.By)
+		}
+		var err error
+		if rule.Rate, err = strconv.ParseFloat(parts[1], 64); err != nil || rule.Rate <= 0 {
+			return nil, fmt.Errorf("RATE_LIMITS entry %q has a bad rate", ruleOpt)
+		}
+		if rule.Burst, err = strconv.Atoi(parts[2]); err != nil || rule.Burst <= 0 {
+			return nil, fmt.Errorf("RATE_LIMITS entry %q has a bad burst", ruleOpt)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,309 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jkassis/edgie/common"
+)
+
+const ListLimitMax = 1000
+
+// listOriginPagesMax bounds the S3 pages one List reads looking past pending deletes.
+const listOriginPagesMax = 10
+
+// ErrListToken means a list continuation token could not be decoded.
+var ErrListToken = errors.New("invalid continuation token")
+
+// ListEntry is one object or, when listing with a delimiter, one common prefix.
+type ListEntry struct {
+	Dir          bool       `json:"dir,omitempty"`
+	ETag         string     `json:"etag,omitempty"`
+	Key          string     `json:"key"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Size         int64      `json:"size,omitempty"`
+	Tier         string     `json:"tier,omitempty"`
+}
+
+// Listing is one page of a List. NextToken is empty on the last page.
+type Listing struct {
+	Delimiter string      `json:"delimiter,omitempty"`
+	Entries   []ListEntry `json:"entries"`
+	NextToken string      `json:"nextToken,omitempty"`
+	Prefix    string      `json:"prefix"`
+}
+
+// List returns up to limit entries under prefix, merging S3 ListObjectsV2
+// results with pending uploads and hiding pending deletes. Pages of S3 results
+// are fetched until the page is full, up to listOriginPagesMax of them, so a
+// page can come back short when most of what S3 holds was deleted.
+// token is the NextToken of the previous page.
+func (s *Service) List(prefix string, delimiter string, token string, limit int) (*Listing, error) {
+	if limit <= 0 || limit > ListLimitMax {
+		limit = ListLimitMax
+	}
+
+	startAfter, err := listTokenDecode(token)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := s.listPending(prefix, delimiter, startAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, _ := common.AWSSessionGet(s.Conf.S3.Region)
+	s3Client := s3.New(sess, aws.NewConfig().WithRegion(s.Conf.S3.Region))
+	originPage := func(startAfter string) (*s3.ListObjectsV2Output, error) {
+		return common.S3FileList(s3Client, s.Conf.S3.Bucket, prefix, delimiter, startAfter, int64(limit))
+	}
+	live := func(entry ListEntry) (bool, error) {
+		return s.listLive(s3Client, entry)
+	}
+	entries, next, err := listPages(pending, startAfter, limit, originPage, live)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &Listing{Delimiter: delimiter, Prefix: prefix, Entries: entries}
+	if next != nil {
+		listing.NextToken = listTokenEncode(*next)
+	}
+	return listing, nil
+}
+
+// listPages merges pending with the live entries of S3 pages from originPage
+// until there are limit entries or S3 has no more. It returns the entries and,
+// when there may be more, the entry the next page resumes after.
+func listPages(pending []ListEntry, startAfter string, limit int, originPage func(startAfter string) (*s3.ListObjectsV2Output, error), live func(ListEntry) (bool, error)) ([]ListEntry, *ListEntry, error) {
+	var origin []ListEntry
+	for pages := 1; ; pages++ {
+		page, err := originPage(startAfter)
+		if err != nil {
+			return nil, nil, err
+		}
+		pageEntries := listOrigin(page)
+		for _, entry := range pageEntries {
+			ok, err := live(entry)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ok {
+				origin = append(origin, entry)
+			}
+		}
+		entries := listMerge(pending, origin)
+
+		if !aws.BoolValue(page.IsTruncated) || len(pageEntries) == 0 {
+			if len(entries) > limit {
+				return entries[:limit], &entries[limit-1], nil
+			}
+			return entries, nil, nil
+		}
+
+		// S3 has more keys past its page... hold back pending keys beyond it for a later page
+		bound := pageEntries[len(pageEntries)-1]
+		cut := sort.Search(len(entries), func(i int) bool { return entries[i].Key > bound.Key })
+		entries = entries[:cut]
+		if len(entries) > limit {
+			return entries[:limit], &entries[limit-1], nil
+		}
+		if len(entries) == limit || pages == listOriginPagesMax {
+			return entries, &bound, nil
+		}
+		startAfter = listStartAfter(bound)
+	}
+}
+
+// listLive reports whether entry from S3 still holds something no pending
+// delete hides. A common prefix with pending deletes under it is listed in S3
+// until a key without one turns up.
+func (s *Service) listLive(s3Client *s3.S3, entry ListEntry) (bool, error) {
+	if !entry.Dir {
+		_, err := os.Stat(s.deletePath(entry.Key))
+		return err != nil, nil
+	}
+
+	deletes, err := s.listPendingDeletes(entry.Key)
+	if err != nil || !deletes {
+		return true, err
+	}
+	startAfter := ""
+	for {
+		page, err := common.S3FileList(s3Client, s.Conf.S3.Bucket, entry.Key, "", startAfter, ListLimitMax)
+		if err != nil {
+			return false, err
+		}
+		for _, obj := range page.Contents {
+			key := aws.StringValue(obj.Key)
+			if _, err := os.Stat(s.deletePath(key)); err != nil {
+				return true, nil
+			}
+			startAfter = key
+		}
+		if !aws.BoolValue(page.IsTruncated) || len(page.Contents) == 0 {
+			return false, nil
+		}
+	}
+}
+
+// listPendingDeletes reports whether any pending delete is under prefix.
+func (s *Service) listPendingDeletes(prefix string) (bool, error) {
+	walkRoot := filepath.Join(s.Conf.DeleteDir, filepath.FromSlash(path.Dir("/"+prefix+"x")))
+	found := false
+	err := filepath.WalkDir(walkRoot, func(deletePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || common.FileIsTmp(deletePath) {
+			return nil
+		}
+		key, err := filepath.Rel(s.Conf.DeleteDir, deletePath)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(filepath.ToSlash(key), prefix) {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found, err
+}
+
+// listPending returns the sorted pending uploads under prefix that sort after startAfter.
+func (s *Service) listPending(prefix string, delimiter string, startAfter string) ([]ListEntry, error) {
+	// only walk the deepest directory that can hold matching keys
+	walkRoot := filepath.Join(s.Conf.UploadDir, filepath.FromSlash(path.Dir("/"+prefix+"x")))
+
+	dirs := make(map[string]bool)
+	var entries []ListEntry
+	err := filepath.WalkDir(walkRoot, func(srcPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() && srcPath == s.uploadMetaDir() {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || common.FileIsTmp(srcPath) {
+			return nil
+		}
+
+		key, err := filepath.Rel(s.Conf.UploadDir, srcPath)
+		if err != nil {
+			return err
+		}
+		key = filepath.ToSlash(key)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				dir := key[:len(prefix)+i+len(delimiter)]
+				if dir > startAfter && !dirs[dir] {
+					dirs[dir] = true
+					entries = append(entries, ListEntry{Dir: true, Key: dir})
+				}
+				return nil
+			}
+		}
+
+		if key <= startAfter {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		modTime := info.ModTime()
+		entries = append(entries, ListEntry{Key: key, LastModified: &modTime, Size: info.Size(), Tier: TierUpload})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+// listOrigin flattens an S3 page into entries sorted by key.
+func listOrigin(page *s3.ListObjectsV2Output) []ListEntry {
+	entries := make([]ListEntry, 0, len(page.Contents)+len(page.CommonPrefixes))
+	for _, obj := range page.Contents {
+		entries = append(entries, ListEntry{
+			ETag:         aws.StringValue(obj.ETag),
+			Key:          aws.StringValue(obj.Key),
+			LastModified: obj.LastModified,
+			Size:         aws.Int64Value(obj.Size),
+			Tier:         TierOrigin,
+		})
+	}
+	for _, cp := range page.CommonPrefixes {
+		entries = append(entries, ListEntry{Dir: true, Key: aws.StringValue(cp.Prefix)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// listMerge merges two sorted entry lists. Pending entries win ties because they are newer.
+func listMerge(pending []ListEntry, origin []ListEntry) []ListEntry {
+	merged := make([]ListEntry, 0, len(pending)+len(origin))
+	i, j := 0, 0
+	for i < len(pending) && j < len(origin) {
+		switch {
+		case pending[i].Key < origin[j].Key:
+			merged = append(merged, pending[i])
+			i++
+		case pending[i].Key > origin[j].Key:
+			merged = append(merged, origin[j])
+			j++
+		default:
+			merged = append(merged, pending[i])
+			i++
+			j++
+		}
+	}
+	merged = append(merged, pending[i:]...)
+	return append(merged, origin[j:]...)
+}
+
+// listTokenEncode returns a token that resumes the listing after entry.
+func listTokenEncode(entry ListEntry) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(listStartAfter(entry)))
+}
+
+// listStartAfter is the S3 StartAfter that resumes a listing after entry.
+func listStartAfter(entry ListEntry) string {
+	if entry.Dir {
+		// skip every key rolled up under the common prefix
+		return entry.Key + string(utf8.MaxRune)
+	}
+	return entry.Key
+}
+
+func listTokenDecode(token string) (string, error) {
+	startAfter, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", ErrListToken
+	}
+	return string(startAfter), nil
+}
@@ -0,0 +1,463 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jkassis/edgie/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// Prefetch rule kinds. M3U8 rules read playlists and prefetch the segments
+// that come next. HTML rules read pages and prefetch their scripts, styles
+// and media. Learn rules prefetch what clients most often asked for next.
+const (
+	PrefetchKindHTML  = "html"
+	PrefetchKindLearn = "learn"
+	PrefetchKindM3U8  = "m3u8"
+)
+
+const (
+	PrefetchWorkersDefault = 2
+
+	// prefetches wait here... when it is full new ones are dropped
+	prefetchQueueLen = 1024
+	// the playlist positions, learned successors and clients tracked, each
+	prefetchTrackedMax = 65536
+	// a learned successor is only prefetched after it followed this often
+	prefetchLearnCountMin = 2
+	// successors kept per key
+	prefetchLearnSuccessorsMax = 16
+	// a request follows the previous one from the same client within this
+	prefetchLearnWindow = 10 * time.Second
+	// a prefetched object not downloaded within this counts as unused
+	prefetchUnusedAfter = 5 * time.Minute
+	// playlists and pages bigger than this are not read for references
+	prefetchParseBytesMax = 1 << 20
+)
+
+// PrefetchRule prefetches up to Count objects related to downloads under Prefix.
+type PrefetchRule struct {
+	Kind   string
+	Count  int
+	Prefix string
+}
+
+var (
+	prefetchQueued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgie_prefetch_queued_total",
+		Help: "Total number of prefetches queued, by rule kind.",
+	}, []string{"kind"})
+	prefetchDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgie_prefetch_dropped_total",
+		Help: "Total number of prefetches dropped because the queue was full, by rule kind.",
+	}, []string{"kind"})
+	prefetchFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgie_prefetch_fetches_total",
+		Help: "Total number of prefetches run, by rule kind and result: cached, present, missing, busy or failed.",
+	}, []string{"kind", "result"})
+	prefetchUsed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgie_prefetch_used_total",
+		Help: "Total number of prefetched objects downloaded before they went unused, by rule kind.",
+	}, []string{"kind"})
+	prefetchUnused = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgie_prefetch_unused_total",
+		Help: "Total number of prefetched objects not downloaded within 5m, by rule kind.",
+	}, []string{"kind"})
+)
+
+// prefetchJob either reads a cached playlist or page for the objects it
+// references, or fills the cache with key.
+type prefetchJob struct {
+	rule  *PrefetchRule
+	key   string
+	parse bool
+}
+
+// prefetchPosition is where a segment sits in the last playlist that listed it.
+type prefetchPosition struct {
+	keys  []string
+	index int
+}
+
+type prefetchVisit struct {
+	key string
+	at  time.Time
+}
+
+type prefetchUse struct {
+	kind string
+	at   time.Time
+}
+
+// prefetcher runs prefetches on a few workers, behind the downloads that trigger them.
+type prefetcher struct {
+	rules []PrefetchRule
+	queue chan prefetchJob
+
+	mutex      sync.Mutex
+	clients    map[string]prefetchVisit
+	positions  map[string]prefetchPosition
+	prefetched map[string]prefetchUse
+	queued     map[string]bool
+	successors map[string]map[string]int
+}
+
+func newPrefetcher(rules []PrefetchRule) *prefetcher {
+	return &prefetcher{
+		rules:      rules,
+		queue:      make(chan prefetchJob, prefetchQueueLen),
+		clients:    make(map[string]prefetchVisit),
+		positions:  make(map[string]prefetchPosition),
+		prefetched: make(map[string]prefetchUse),
+		queued:     make(map[string]bool),
+		successors: make(map[string]map[string]int),
+	}
+}
+
+// prefetchStart starts the workers when there are rules.
+func (s *Service) prefetchStart() {
+	if len(s.Conf.PrefetchRules) == 0 {
+		return
+	}
+	s.prefetch = newPrefetcher(s.Conf.PrefetchRules)
+	workers := s.Conf.PrefetchWorkers
+	if workers <= 0 {
+		workers = PrefetchWorkersDefault
+	}
+	for i := 0; i < workers; i++ {
+		go s.prefetchForever()
+	}
+	go s.prefetch.sweepForever()
+}
+
+// prefetchObserve notes a download of key by client, which may be empty, and
+// queues what the rules say comes next. It never blocks on a fetch.
+func (s *Service) prefetchObserve(client string, key string) {
+	p := s.prefetch
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if use, ok := p.prefetched[key]; ok {
+		delete(p.prefetched, key)
+		prefetchUsed.WithLabelValues(use.kind).Inc()
+	}
+
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if !strings.HasPrefix(key, rule.Prefix) {
+			continue
+		}
+		switch rule.Kind {
+		case PrefetchKindM3U8:
+			if strings.HasSuffix(key, ".m3u8") {
+				p.enqueue(prefetchJob{rule: rule, key: key, parse: true})
+			} else if pos, ok := p.positions[key]; ok {
+				for _, next := range prefetchAfter(pos.keys, pos.index, rule.Count) {
+					p.enqueue(prefetchJob{rule: rule, key: next})
+				}
+			}
+		case PrefetchKindHTML:
+			if ext := path.Ext(key); ext == ".html" || ext == ".htm" {
+				p.enqueue(prefetchJob{rule: rule, key: key, parse: true})
+			}
+		case PrefetchKindLearn:
+			p.learn(rule, client, key)
+		}
+	}
+}
+
+// learn counts key as the successor of the previous download by client and
+// queues the successors of key that followed it often enough.
+func (p *prefetcher) learn(rule *PrefetchRule, client string, key string) {
+	if client != "" {
+		now := time.Now()
+		if last, ok := p.clients[client]; ok && last.key != key && now.Sub(last.at) < prefetchLearnWindow {
+			next := p.successors[last.key]
+			if next == nil {
+				if len(p.successors) >= prefetchTrackedMax {
+					// start over rather than track the whole keyspace
+					p.successors = make(map[string]map[string]int)
+				}
+				next = make(map[string]int)
+				p.successors[last.key] = next
+			}
+			if _, ok := next[key]; !ok && len(next) >= prefetchLearnSuccessorsMax {
+				delete(next, prefetchLeast(next))
+			}
+			next[key]++
+		}
+		if len(p.clients) >= prefetchTrackedMax {
+			p.clients = make(map[string]prefetchVisit)
+		}
+		p.clients[client] = prefetchVisit{key: key, at: now}
+	}
+
+	next := p.successors[key]
+	candidates := make([]string, 0, len(next))
+	for candidate, count := range next {
+		if count >= prefetchLearnCountMin {
+			candidates = append(candidates, candidate)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if next[candidates[i]] != next[candidates[j]] {
+			return next[candidates[i]] > next[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+	if len(candidates) > rule.Count {
+		candidates = candidates[:rule.Count]
+	}
+	for _, candidate := range candidates {
+		p.enqueue(prefetchJob{rule: rule, key: candidate})
+	}
+}
+
+// enqueue queues job unless the same key is already waiting. Call with the mutex held.
+func (p *prefetcher) enqueue(job prefetchJob) {
+	id := job.key
+	if job.parse {
+		id += "\x00parse"
+	}
+	if p.queued[id] {
+		return
+	}
+	select {
+	case p.queue <- job:
+		p.queued[id] = true
+		prefetchQueued.WithLabelValues(job.rule.Kind).Inc()
+	default:
+		prefetchDropped.WithLabelValues(job.rule.Kind).Inc()
+	}
+}
+
+// prefetchForever runs queued jobs.
+func (s *Service) prefetchForever() {
+	p := s.prefetch
+	for job := range p.queue {
+		p.mutex.Lock()
+		if job.parse {
+			delete(p.queued, job.key+"\x00parse")
+		} else {
+			delete(p.queued, job.key)
+		}
+		p.mutex.Unlock()
+
+		if job.parse {
+			s.prefetchParse(job)
+		} else {
+			s.prefetchFetch(job)
+		}
+	}
+}
+
+// prefetchFetch fills the cache with the key of job. It is dropped rather than
+// wait when every origin slot is taken, so it never queues ahead of a client.
+func (s *Service) prefetchFetch(job prefetchJob) {
+	kind := job.rule.Kind
+	if s.Cache.Has(job.key) {
+		prefetchFetches.WithLabelValues(kind, "present").Inc()
+		return
+	}
+
+	fce, err := s.cacheFill(job.key, false)
+	if errors.Is(err, os.ErrNotExist) {
+		prefetchFetches.WithLabelValues(kind, "missing").Inc()
+		return
+	} else if errors.Is(err, ErrBusy) {
+		prefetchFetches.WithLabelValues(kind, "busy").Inc()
+		return
+	} else if err != nil {
+		log.Warnf("prefetch of %s failed: %v", job.key, err)
+		prefetchFetches.WithLabelValues(kind, "failed").Inc()
+		return
+	}
+	fce.Close()
+	prefetchFetches.WithLabelValues(kind, "cached").Inc()
+
+	p := s.prefetch
+	p.mutex.Lock()
+	if len(p.prefetched) < prefetchTrackedMax {
+		p.prefetched[job.key] = prefetchUse{kind: kind, at: time.Now()}
+	}
+	p.mutex.Unlock()
+}
+
+// prefetchParse reads the cached playlist or page of job and queues the objects it references.
+func (s *Service) prefetchParse(job prefetchJob) {
+	fce, err := s.Cache.Get(job.key)
+	if err != nil {
+		// evicted already... the next download parses it
+		return
+	}
+	if fce.Size > prefetchParseBytesMax {
+		fce.Close()
+		return
+	}
+	data, err := fce.Bytes()
+	fce.Close()
+	if err != nil {
+		log.Warnf("prefetch could not read %s: %v", job.key, err)
+		return
+	}
+
+	p := s.prefetch
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	switch job.rule.Kind {
+	case PrefetchKindM3U8:
+		keys := prefetchM3U8Refs(job.key, data)
+		if len(p.positions)+len(keys) > prefetchTrackedMax {
+			p.positions = make(map[string]prefetchPosition)
+		}
+		for i, key := range keys {
+			p.positions[key] = prefetchPosition{keys: keys, index: i}
+		}
+		for _, key := range prefetchAfter(keys, -1, job.rule.Count) {
+			p.enqueue(prefetchJob{rule: job.rule, key: key})
+		}
+	case PrefetchKindHTML:
+		keys := prefetchHTMLRefs(job.key, data)
+		if len(keys) > job.rule.Count {
+			keys = keys[:job.rule.Count]
+		}
+		for _, key := range keys {
+			p.enqueue(prefetchJob{rule: job.rule, key: key})
+		}
+	}
+}
+
+// sweepForever counts prefetched objects nobody downloaded in time as unused.
+func (p *prefetcher) sweepForever() {
+	for range time.Tick(prefetchUnusedAfter) {
+		p.mutex.Lock()
+		for key, use := range p.prefetched {
+			if time.Since(use.at) >= prefetchUnusedAfter {
+				delete(p.prefetched, key)
+				prefetchUnused.WithLabelValues(use.kind).Inc()
+			}
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// prefetchAfter returns up to count keys that follow index.
+func prefetchAfter(keys []string, index int, count int) []string {
+	start := index + 1
+	end := start + count
+	if end > len(keys) {
+		end = len(keys)
+	}
+	if start >= end {
+		return nil
+	}
+	return keys[start:end]
+}
+
+// prefetchLeast is the successor seen the fewest times.
+func prefetchLeast(next map[string]int) string {
+	least, leastCount := "", 0
+	for key, count := range next {
+		if least == "" || count < leastCount {
+			least, leastCount = key, count
+		}
+	}
+	return least
+}
+
+// prefetchRef resolves a reference in the object at key to a key. It returns
+// false for references to other hosts, relative references that climb out of
+// the bucket, and keys a client couldn't ask for.
+func prefetchRef(key string, ref string) (string, bool) {
+	if i := strings.IndexAny(ref, "?#"); i >= 0 {
+		ref = ref[:i]
+	}
+	if ref == "" || strings.HasPrefix(ref, "//") || strings.Contains(ref, ":") {
+		return "", false
+	}
+	if !strings.HasPrefix(ref, "/") {
+		ref = path.Join(path.Dir(key), ref)
+		if ref == ".." || strings.HasPrefix(ref, "../") {
+			return "", false
+		}
+	}
+	ref = keyClean(ref)
+	if common.KeyValidate(ref) != nil || common.KeyReserved(ref) {
+		return "", false
+	}
+	return ref, true
+}
+
+// prefetchM3U8Refs returns the keys of the variant playlists or segments of a playlist, in order.
+func prefetchM3U8Refs(key string, data []byte) []string {
+	var keys []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if ref, ok := prefetchRef(key, line); ok {
+			keys = append(keys, ref)
+		}
+	}
+	return keys
+}
+
+var prefetchHTMLAsset = regexp.MustCompile(`(?is)<(?:audio|img|link|script|source|video)\b[^>]*?\b(?:href|src)\s*=\s*["']([^"']+)["']`)
+
+// prefetchHTMLRefs returns the keys of the scripts, styles and media of a page, in order.
+func prefetchHTMLRefs(key string, data []byte) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, match := range prefetchHTMLAsset.FindAllSubmatch(data, -1) {
+		if ref, ok := prefetchRef(key, string(match[1])); ok && !seen[ref] {
+			seen[ref] = true
+			keys = append(keys, ref)
+		}
+	}
+	return keys
+}
+
+// prefetchRulesParse parses PREFETCH_RULES. It returns nil when the option is empty.
+func prefetchRulesParse(rulesOpt string) ([]PrefetchRule, error) {
+	var rules []PrefetchRule
+	for _, ruleOpt := range strings.Split(rulesOpt, ",") {
+		ruleOpt = strings.TrimSpace(ruleOpt)
+		if ruleOpt == "" {
+			continue
+		}
+		parts := strings.SplitN(ruleOpt, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("PREFETCH_RULES entry %q is not kind:count:prefix", ruleOpt)
+		}
+		switch parts[0] {
+		case PrefetchKindHTML, PrefetchKindLearn, PrefetchKindM3U8:
+		default:
+			return nil, fmt.Errorf("PREFETCH_RULES entry %q has unknown kind %s", ruleOpt, parts[0])
+		}
+		count, err := strconv.Atoi(parts[1])
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("PREFETCH_RULES entry %q has a bad count", ruleOpt)
+		}
+		rules = append(rules, PrefetchRule{Kind: parts[0], Count: count, Prefix: parts[2]})
+	}
+	return rules, nil
+}
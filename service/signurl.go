@@ -0,0 +1,240 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jkassis/edgie/common"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	OPT_SIGN_BASE_URL = "SIGN_BASE_URL"
+	OPT_SIGN_EXPIRES  = "SIGN_EXPIRES"
+	OPT_SIGN_KEY      = "SIGN_KEY"
+	OPT_SIGN_METHOD   = "SIGN_METHOD"
+	OPT_SIGN_OP       = "SIGN_OP"
+	OPT_SIGN_PREFIX   = "SIGN_PREFIX"
+)
+
+// Query params of a signed URL.
+const (
+	SignedURLExpires   = "X-Edgie-Expires"
+	SignedURLKey       = "X-Edgie-Key"
+	SignedURLMethod    = "X-Edgie-Method"
+	SignedURLPrefix    = "X-Edgie-Prefix"
+	SignedURLSignature = "X-Edgie-Signature"
+)
+
+// Operations a signed URL can be for besides the object itself, by the query
+// param that asks for them.
+const (
+	SignedURLOpList = "list"
+	SignedURLOpStat = "stat"
+)
+
+// signedURLOp is the operation query asks for, or "" for the object itself.
+func signedURLOp(query url.Values) string {
+	switch {
+	case query.Has(SignedURLOpList):
+		return SignedURLOpList
+	case query.Has(SignedURLOpStat):
+		return SignedURLOpStat
+	}
+	return ""
+}
+
+// signedURLPayload is what a signed URL signs. A URL scoped to a prefix
+// works for every key under it. The operation is signed too, so a URL for
+// an object can't list the keys that start with its name.
+func signedURLPayload(method string, expires string, op string, key string, prefix string) []byte {
+	scope := "key:" + key
+	if prefix != "" {
+		scope = "prefix:" + prefix
+	}
+	return []byte(strings.Join([]string{method, expires, "op:" + op, scope}, "\n"))
+}
+
+// SignURL adds the params that let u be used with method until expires, for
+// the operation its query asks for. A non-empty prefix lets the signature
+// work for any key under it... end it with / to stop at a directory.
+func SignURL(u *url.URL, method string, prefix string, expires time.Time, keyID string, secret []byte) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	expiresUnix := strconv.FormatInt(expires.Unix(), 10)
+	query := u.Query()
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signedURLPayload(method, expiresUnix, signedURLOp(query), keyClean(u.Path), prefix))
+
+	query.Set(SignedURLExpires, expiresUnix)
+	query.Set(SignedURLKey, keyID)
+	query.Set(SignedURLMethod, method)
+	if prefix != "" {
+		query.Set(SignedURLPrefix, prefix)
+	} else {
+		query.Del(SignedURLPrefix)
+	}
+	query.Set(SignedURLSignature, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+	u.RawQuery = query.Encode()
+}
+
+// authURL takes signed URLs. Every key in the file verifies, so keys rotate
+// by adding the new one, signing with it, and removing the old one once the
+// URLs it signed have expired.
+type authURL struct {
+	keys map[string][]byte
+}
+
+func (a *authURL) Authenticate(r *http.Request, class string) error {
+	query := r.URL.Query()
+	if !query.Has(SignedURLSignature) {
+		return ErrAuthMissing
+	}
+	secret, ok := a.keys[query.Get(SignedURLKey)]
+	if !ok {
+		return fmt.Errorf("%w: unknown URL key %q", ErrAuthInvalid, query.Get(SignedURLKey))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(query.Get(SignedURLSignature))
+	if err != nil {
+		return fmt.Errorf("%w: malformed URL signature", ErrAuthInvalid)
+	}
+
+	expiresUnix := query.Get(SignedURLExpires)
+	expires, err := strconv.ParseInt(expiresUnix, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: bad %s", ErrAuthInvalid, SignedURLExpires)
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return fmt.Errorf("%w: URL expired", ErrAuthInvalid)
+	}
+
+	method := query.Get(SignedURLMethod)
+	key := keyClean(r.URL.Path)
+	prefix := query.Get(SignedURLPrefix)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signedURLPayload(method, expiresUnix, signedURLOp(query), key, prefix))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return fmt.Errorf("%w: bad URL signature", ErrAuthInvalid)
+	}
+
+	// a good signature for something else
+	if (class != AuthClassRead && class != AuthClassWrite) || !strings.HasPrefix(key, prefix) {
+		return ErrAuthForbidden
+	}
+	if r.Method != method && !(r.Method == http.MethodHead && method == http.MethodGet) {
+		return ErrAuthForbidden
+	}
+	return nil
+}
+
+// signKeysLoad reads a file of "keyID base64secret" lines like AUTH_HMAC_FILE.
+// ids are in file order.
+func signKeysLoad(keysPath string) (ids []string, keys map[string][]byte, err error) {
+	keys = make(map[string][]byte)
+	err = authFileScan(keysPath, func(fields []string) error {
+		if len(fields) < 2 {
+			return fmt.Errorf("URL key %s has no secret", fields[0])
+		}
+		secret, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(secret) < 16 {
+			return fmt.Errorf("URL key %s needs a base64 secret of at least 16 bytes", fields[0])
+		}
+		ids = append(ids, fields[0])
+		keys[fields[0]] = secret
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil, errors.New("no keys")
+	}
+	return ids, keys, nil
+}
+
+// SignCmdInit adds the options for the sign subcommand. AUTH_URL_KEYS_FILE comes from the parent.
+func SignCmdInit(cmd *cobra.Command) {
+	cmd.Flags().String(OPT_SIGN_BASE_URL, "", "scheme and host of the signed URL (default http://localhost:PORT, or https with TLS_CERT_FILE)")
+	viper.BindPFlag(OPT_SIGN_BASE_URL, cmd.Flags().Lookup(OPT_SIGN_BASE_URL))
+
+	cmd.Flags().Duration(OPT_SIGN_EXPIRES, time.Hour, "how long the URL works")
+	viper.BindPFlag(OPT_SIGN_EXPIRES, cmd.Flags().Lookup(OPT_SIGN_EXPIRES))
+
+	cmd.Flags().String(OPT_SIGN_KEY, "", "ID of the key to sign with (default the first in AUTH_URL_KEYS_FILE)")
+	viper.BindPFlag(OPT_SIGN_KEY, cmd.Flags().Lookup(OPT_SIGN_KEY))
+
+	cmd.Flags().String(OPT_SIGN_METHOD, http.MethodGet, "HTTP method the URL allows (GET also allows HEAD)")
+	viper.BindPFlag(OPT_SIGN_METHOD, cmd.Flags().Lookup(OPT_SIGN_METHOD))
+
+	cmd.Flags().String(OPT_SIGN_OP, "", "operation the URL is for: list, stat, or empty for the object itself")
+	viper.BindPFlag(OPT_SIGN_OP, cmd.Flags().Lookup(OPT_SIGN_OP))
+
+	cmd.Flags().String(OPT_SIGN_PREFIX, "", "key prefix the signature covers instead of just the path")
+	viper.BindPFlag(OPT_SIGN_PREFIX, cmd.Flags().Lookup(OPT_SIGN_PREFIX))
+}
+
+// SignCmdExecute mints a signed URL for the object path in args.
+func SignCmdExecute(cmd *cobra.Command, args []string) (string, error) {
+	common.CmdExecute(cmd, args)
+
+	keysPath := viper.GetString(OPT_AUTH_URL_KEYS_FILE)
+	if keysPath == "" {
+		return "", errors.New("AUTH_URL_KEYS_FILE not specified")
+	}
+	ids, keys, err := signKeysLoad(keysPath)
+	if err != nil {
+		return "", fmt.Errorf("could not load AUTH_URL_KEYS_FILE: %v", err)
+	}
+	keyID := viper.GetString(OPT_SIGN_KEY)
+	if keyID == "" {
+		keyID = ids[0]
+	}
+	secret, ok := keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("AUTH_URL_KEYS_FILE has no key %s", keyID)
+	}
+
+	expires := viper.GetDuration(OPT_SIGN_EXPIRES)
+	if expires <= 0 {
+		return "", errors.New("SIGN_EXPIRES must be positive")
+	}
+
+	prefix := strings.TrimPrefix(viper.GetString(OPT_SIGN_PREFIX), "/")
+	key := keyClean(args[0])
+	if !strings.HasPrefix(key, prefix) {
+		return "", fmt.Errorf("%s is not under SIGN_PREFIX %s", key, prefix)
+	}
+
+	baseURL := viper.GetString(OPT_SIGN_BASE_URL)
+	if baseURL == "" {
+		baseURL = "http://localhost:" + viper.GetString(common.OPT_PORT)
+		if viper.GetString(common.OPT_TLS_CERT_FILE) != "" {
+			baseURL = "https://localhost:" + viper.GetString(common.OPT_PORT)
+		}
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("bad SIGN_BASE_URL: %v", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	switch op := viper.GetString(OPT_SIGN_OP); op {
+	case "":
+	case SignedURLOpList, SignedURLOpStat:
+		u.RawQuery = op
+		if op == SignedURLOpList && key != "" {
+			u.Path += "/"
+		}
+	default:
+		return "", fmt.Errorf("unknown SIGN_OP %s", op)
+	}
+	SignURL(u, strings.ToUpper(viper.GetString(OPT_SIGN_METHOD)), prefix, time.Now().Add(expires), keyID, secret)
+	return u.String(), nil
+}
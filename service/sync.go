@@ -0,0 +1,156 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jkassis/edgie/common"
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *Service) S3SyncForever() error {
+	for {
+		time.Sleep(s.Conf.SyncDelay)
+		err := s.S3SyncOnce()
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// S3SyncOnce pushes pending uploads and deletes to S3. Failed files stay
+// queued on disk and are retried on the next pass.
+func (s *Service) S3SyncOnce() error {
+	sess, _ := common.AWSSessionGet(s.Conf.S3.Region)
+	s3Client := s3.New(sess, aws.NewConfig().WithRegion(s.Conf.S3.Region))
+
+	return errors.Join(
+		s.s3SyncDir(s.Conf.UploadDir, func(srcPath string, key string) error {
+			return s.s3SyncFile(s3Client, srcPath, key)
+		}),
+		s.s3SyncDir(s.Conf.DeleteDir, func(srcPath string, key string) error {
+			return s.s3SyncDelete(s3Client, srcPath, key)
+		}))
+}
+
+// s3SyncDir calls syncFn for every queued file under dir. A file that fails
+// stays queued for the next pass and doesn't hold up the rest, so its error
+// is logged and returned with the others once the pass is done.
+func (s *Service) s3SyncDir(dir string, syncFn func(srcPath string, key string) error) error {
+	var srcPaths []string
+	err := filepath.WalkDir(dir, func(srcPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && srcPath == s.uploadMetaDir() {
+			return filepath.SkipDir
+		}
+		if d.Type().IsRegular() && !common.FileIsTmp(srcPath) {
+			srcPaths = append(srcPaths, srcPath)
+		}
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("could not read directory %s: %v", dir, err)
+		return err
+	}
+
+	var errs []error
+	for _, srcPath := range srcPaths {
+		key, err := filepath.Rel(dir, srcPath)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not get relative path for queued file: %s", srcPath))
+			continue
+		}
+		key = filepath.ToSlash(key)
+
+		// only push what a client could have named
+		if err := common.KeyValidate(key); err != nil || common.KeyReserved(key) {
+			log.Warnf("not syncing %s: not a valid key", srcPath)
+			continue
+		}
+
+		if err = syncFn(srcPath, key); err != nil {
+			log.Errorf("sync of %s failed, will retry: %v", key, err)
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// s3SyncFile uploads one pending file and removes it from the upload dir,
+// unless a newer upload replaced it while the transfer was in flight.
+func (s *Service) s3SyncFile(s3Client *s3.S3, srcPath string, key string) error {
+	// don't push rotted bytes over the good copy in S3
+	srcSum, srcInfo, err := s.uploadVerify(key, srcPath)
+	if errors.Is(err, common.ErrChecksumMismatch) {
+		s.keyLock.Lock(key)
+		dropErr := s.uploadDrop(key, srcInfo)
+		s.keyLock.Unlock(key)
+		return errors.Join(err, dropErr)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read upload file %s: %v", srcPath, err)
+	}
+
+	// type it the way we serve it so the bucket agrees with the edge
+	contentType, err := s.uploadContentType(key, srcPath, srcInfo)
+	if err != nil {
+		return fmt.Errorf("could not type upload file %s: %v", srcPath, err)
+	}
+
+	// Upload file to S3
+	if err = common.S3FileUpload(s3Client, srcPath, s.Conf.S3.Bucket, key, contentType, srcSum); err != nil {
+		return fmt.Errorf("s3 upload failed: %v", err)
+	}
+
+	// remove from uploads
+	if err = s.s3SyncDone(srcPath, key, srcInfo); err != nil {
+		return fmt.Errorf("failed to remove file from uploads: %v", err)
+	}
+	return nil
+}
+
+// s3SyncDelete deletes one object from S3 and clears its tombstone,
+// unless a newer delete replaced the tombstone while the request was in flight.
+func (s *Service) s3SyncDelete(s3Client *s3.S3, srcPath string, key string) error {
+	srcInfo, err := os.Stat(srcPath)
+	if err != nil {
+		return fmt.Errorf("could not stat delete file %s: %v", srcPath, err)
+	}
+
+	if err = common.S3FileDelete(s3Client, s.Conf.S3.Bucket, key); err != nil {
+		return fmt.Errorf("s3 delete failed: %v", err)
+	}
+
+	if err = s.s3SyncDone(srcPath, key, srcInfo); err != nil {
+		return fmt.Errorf("failed to remove file from deletes: %v", err)
+	}
+	return nil
+}
+
+// s3SyncDone dequeues srcPath if it is still the file that was synced.
+func (s *Service) s3SyncDone(srcPath string, key string, srcInfo os.FileInfo) error {
+	s.keyLock.Lock(key)
+	defer s.keyLock.Unlock(key)
+
+	// a newer version landed during the sync... leave it for the next pass
+	if curInfo, err := os.Stat(srcPath); err != nil || !os.SameFile(srcInfo, curInfo) || !curInfo.ModTime().Equal(srcInfo.ModTime()) {
+		return nil
+	}
+
+	if err := os.Remove(srcPath); err != nil {
+		return err
+	}
+	if srcPath == s.uploadPath(key) {
+		return s.uploadMetaRemove(key)
+	}
+	return nil
+}
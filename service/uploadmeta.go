@@ -0,0 +1,158 @@
+package service
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jkassis/edgie/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// uploadMetaDirName holds sidecars recording the digests and content type of each pending upload.
+const uploadMetaDirName = ".edgie-meta"
+
+var uploadCorruptions = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "edgie_upload_corruptions_total",
+	Help: "Pending uploads dropped because their bytes no longer matched the recorded digest",
+})
+
+// uploadMeta is the sidecar for a pending upload. It only vouches for the
+// file it was written for, so a file with a different size or mtime is not checked.
+type uploadMeta struct {
+	ContentType string `json:"contentType,omitempty"` // what the client sent, if anything
+	MD5         []byte `json:"md5,omitempty"`         // for the ETag
+	SHA256      []byte `json:"sha256"`
+	Size        int64  `json:"size"`
+	ModTime     int64  `json:"modTime"`
+}
+
+func (s *Service) uploadMetaDir() string {
+	return filepath.Join(s.Conf.UploadDir, uploadMetaDirName)
+}
+
+func (s *Service) uploadMetaPath(key string) string {
+	return filepath.Join(s.uploadMetaDir(), filepath.FromSlash(key))
+}
+
+// uploadMetaWrite records the digests and the client's contentType, which may
+// be empty, for the upload file described by info. Call with the key lock held.
+func (s *Service) uploadMetaWrite(key string, info os.FileInfo, md5Sum []byte, sha256Sum []byte, contentType string) error {
+	metaJSON, err := json.Marshal(uploadMeta{
+		ContentType: contentType,
+		MD5:         md5Sum,
+		SHA256:      sha256Sum,
+		Size:        info.Size(),
+		ModTime:     info.ModTime().UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := common.FileWriteAtomic(s.uploadMetaPath(key), bytes.NewReader(metaJSON), 0664); err != nil {
+		return fmt.Errorf("failed to write the upload sidecar for %s: %v", key, err)
+	}
+	return nil
+}
+
+// uploadMetaLoad returns the sidecar of the upload file described by info,
+// or nil if there is none for that exact file.
+func (s *Service) uploadMetaLoad(key string, info os.FileInfo) *uploadMeta {
+	metaJSON, err := os.ReadFile(s.uploadMetaPath(key))
+	if err != nil {
+		return nil
+	}
+	var meta uploadMeta
+	if err := json.Unmarshal(metaJSON, &meta); err != nil {
+		log.Warnf("ignoring bad upload sidecar for %s: %v", key, err)
+		return nil
+	}
+	if meta.Size != info.Size() || meta.ModTime != info.ModTime().UnixNano() {
+		return nil
+	}
+	return &meta
+}
+
+// uploadMetaSum returns the recorded digest of the upload file described by
+// info, or nil if there is no sidecar for that exact file.
+func (s *Service) uploadMetaSum(key string, info os.FileInfo) []byte {
+	if meta := s.uploadMetaLoad(key, info); meta != nil && len(meta.SHA256) == sha256.Size {
+		return meta.SHA256
+	}
+	return nil
+}
+
+// uploadETag returns the ETag of the upload file at srcPath described by info,
+// from its sidecar when there is one so it is not hashed again.
+func (s *Service) uploadETag(key string, srcPath string, info os.FileInfo) (string, error) {
+	if meta := s.uploadMetaLoad(key, info); meta != nil && len(meta.MD5) == md5.Size {
+		return common.ETagFromMD5(meta.MD5), nil
+	}
+	return common.FileETag(srcPath)
+}
+
+// uploadContentType types the upload file at srcPath described by info. The
+// type the client sent wins over detection.
+func (s *Service) uploadContentType(key string, srcPath string, info os.FileInfo) (string, error) {
+	if meta := s.uploadMetaLoad(key, info); meta != nil && meta.ContentType != "" {
+		return meta.ContentType, nil
+	}
+	return s.Mime.FileContentType(key, srcPath)
+}
+
+// uploadMetaRemove removes the sidecar for key. Call with the key lock held.
+func (s *Service) uploadMetaRemove(key string) error {
+	if err := os.Remove(s.uploadMetaPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// uploadVerify hashes the pending upload at srcPath and checks it against its
+// sidecar. It returns the digest, or common.ErrChecksumMismatch if the file rotted.
+func (s *Service) uploadVerify(key string, srcPath string) (sum []byte, info os.FileInfo, err error) {
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer srcFile.Close()
+
+	info, err = srcFile.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, srcFile); err != nil {
+		return nil, nil, err
+	}
+	sum = hash.Sum(nil)
+
+	if want := s.uploadMetaSum(key, info); want != nil && !bytes.Equal(want, sum) {
+		return nil, info, fmt.Errorf("pending upload %s: %w", key, common.ErrChecksumMismatch)
+	}
+	return sum, info, nil
+}
+
+// uploadDrop discards a corrupt pending upload so reads fall back to S3.
+// Call with the key lock held. A file that changed since info was taken is left alone.
+func (s *Service) uploadDrop(key string, info os.FileInfo) error {
+	srcPath := s.uploadPath(key)
+	if curInfo, err := os.Stat(srcPath); err != nil || !os.SameFile(info, curInfo) || !curInfo.ModTime().Equal(info.ModTime()) {
+		return nil
+	}
+
+	uploadCorruptions.Inc()
+	log.Errorf("dropping corrupt pending upload %s", key)
+	if err := os.Remove(srcPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return s.uploadMetaRemove(key)
+}
@@ -0,0 +1,515 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/jkassis/edgie/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	OPT_WARM_ADDR        = "WARM_ADDR"
+	OPT_WARM_CONCURRENCY = "WARM_CONCURRENCY"
+	OPT_WARM_HMAC_KEY    = "WARM_HMAC_KEY"
+	OPT_WARM_MANIFEST    = "WARM_MANIFEST"
+	OPT_WARM_PATTERNS    = "WARM_PATTERNS"
+	OPT_WARM_PREFIXES    = "WARM_PREFIXES"
+	OPT_WARM_RATE        = "WARM_RATE"
+	OPT_WARM_TOKEN       = "WARM_TOKEN"
+)
+
+const (
+	WarmConcurrencyDefault = 8
+	WarmConcurrencyMax     = 256
+
+	// WarmPath is where the admin listener of a running edgie takes warm requests
+	WarmPath = "/admin/warm"
+
+	// a warm reports its progress this often
+	warmProgressInterval = time.Second
+)
+
+// ErrWarmRequest means a warm request names nothing to warm or has a bad pattern.
+var ErrWarmRequest = errors.New("invalid warm request")
+
+var warmCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "edgie_warm_objects_total",
+	Help: "Total number of objects visited by cache warmups, by result: cached, present, missing, skipped or failed.",
+}, []string{"result"})
+
+// WarmRequest names the objects to prefetch into the cache. Keys, Prefixes and Patterns add up.
+type WarmRequest struct {
+	Keys        []string `json:"keys,omitempty"`
+	Prefixes    []string `json:"prefixes,omitempty"` // every S3 object under each prefix
+	Patterns    []string `json:"patterns,omitempty"` // doublestar patterns matched against S3 keys
+	Concurrency int      `json:"concurrency,omitempty"`
+	Rate        float64  `json:"rate,omitempty"` // fetches started per second, unlimited if 0
+}
+
+// WarmProgress counts what a warm has done so far. Listed grows while the S3
+// listings run, so it is only the total once Done.
+type WarmProgress struct {
+	Listed  int64  `json:"listed"`
+	Cached  int64  `json:"cached"`
+	Present int64  `json:"present"` // already in the cache
+	Missing int64  `json:"missing"` // gone since it was listed
+	Skipped int64  `json:"skipped"` // directory markers
+	Failed  int64  `json:"failed"`
+	Bytes   int64  `json:"bytes"`
+	Done    bool   `json:"done,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// warm is one running warm.
+type warm struct {
+	mutex    sync.Mutex
+	progress WarmProgress
+}
+
+func (w *warm) update(fn func(p *WarmProgress)) {
+	w.mutex.Lock()
+	fn(&w.progress)
+	w.mutex.Unlock()
+}
+
+func (w *warm) snapshot() WarmProgress {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.progress
+}
+
+// Warm prefetches the objects named by req into the cache through the same
+// fill path as Download, so pending uploads and deletes win over S3. It calls
+// progress every warmProgressInterval and once more when done, and stops
+// early when ctx is done.
+func (s *Service) Warm(ctx context.Context, req WarmRequest, progress func(WarmProgress)) (WarmProgress, error) {
+	if len(req.Keys) == 0 && len(req.Prefixes) == 0 && len(req.Patterns) == 0 {
+		return WarmProgress{}, fmt.Errorf("%w: no keys, prefixes or patterns", ErrWarmRequest)
+	}
+	for _, pattern := range req.Patterns {
+		if !doublestar.ValidatePattern(pattern) {
+			return WarmProgress{}, fmt.Errorf("%w: bad pattern %s", ErrWarmRequest, pattern)
+		}
+	}
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = WarmConcurrencyDefault
+	} else if concurrency > WarmConcurrencyMax {
+		concurrency = WarmConcurrencyMax
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := &warm{}
+
+	// list in the background so fetches start with the first page
+	keys := make(chan string, concurrency)
+	var listErr error
+	listed := make(chan struct{})
+	go func() {
+		defer close(listed)
+		defer close(keys)
+		listErr = s.warmList(ctx, req, w, keys)
+	}()
+
+	// space out the fetches when rate limited
+	var tick <-chan time.Time
+	if req.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / req.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for key := range keys {
+				if tick != nil {
+					select {
+					case <-tick:
+					case <-ctx.Done():
+						return
+					}
+				}
+				s.warmKey(key, w)
+			}
+		}()
+	}
+
+	// report while the workers run
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		ticker := time.NewTicker(warmProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if progress != nil {
+					progress(w.snapshot())
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// the listing ends when its keys run out, or on ctx if the workers stopped early
+	workers.Wait()
+	<-listed
+	err := listErr
+	if err == nil {
+		err = ctx.Err()
+	}
+	cancel()
+	<-reported
+
+	w.update(func(p *WarmProgress) {
+		p.Done = true
+		if err != nil {
+			p.Error = err.Error()
+		}
+	})
+	final := w.snapshot()
+	if progress != nil {
+		progress(final)
+	}
+	return final, err
+}
+
+// warmList sends the keys of req to keys, listing S3 for its prefixes and patterns.
+func (s *Service) warmList(ctx context.Context, req WarmRequest, w *warm, keys chan<- string) error {
+	send := func(key string) error {
+		select {
+		case keys <- key:
+			w.update(func(p *WarmProgress) { p.Listed++ })
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for _, key := range req.Keys {
+		if err := send(key); err != nil {
+			return err
+		}
+	}
+	for _, prefix := range req.Prefixes {
+		if err := s.warmListPrefix(ctx, prefix, "", send); err != nil {
+			return err
+		}
+	}
+	for _, pattern := range req.Patterns {
+		if err := s.warmListPrefix(ctx, warmPatternPrefix(pattern), pattern, send); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warmListPrefix pages through the S3 objects under prefix and sends the ones
+// that match pattern, or all of them when pattern is empty.
+func (s *Service) warmListPrefix(ctx context.Context, prefix string, pattern string, send func(key string) error) error {
+	sess, _ := common.AWSSessionGet(s.Conf.S3.Region)
+	s3Client := s3.New(sess, aws.NewConfig().WithRegion(s.Conf.S3.Region))
+
+	startAfter := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		page, err := common.S3FileList(s3Client, s.Conf.S3.Bucket, prefix, "", startAfter, ListLimitMax)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			startAfter = key
+			if pattern != "" {
+				if match, _ := doublestar.Match(pattern, key); !match {
+					continue
+				}
+			}
+			if err := send(key); err != nil {
+				return err
+			}
+		}
+		if !aws.BoolValue(page.IsTruncated) || len(page.Contents) == 0 {
+			return nil
+		}
+	}
+}
+
+// warmPatternPrefix is the literal start of pattern, which bounds the S3 listing.
+func warmPatternPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[{\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// warmKey fills the cache with key unless it is there already. Directory
+// markers, the empty keys ending in / that the S3 console creates, are skipped.
+func (s *Service) warmKey(key string, w *warm) {
+	if strings.HasSuffix(key, "/") {
+		warmCounter.WithLabelValues("skipped").Inc()
+		w.update(func(p *WarmProgress) { p.Skipped++ })
+		return
+	}
+	key, err := s.keyParse(key)
+	if err != nil {
+		log.Warnf("not warming %s: %v", key, err)
+		warmCounter.WithLabelValues("failed").Inc()
+		w.update(func(p *WarmProgress) { p.Failed++ })
+		return
+	}
+	if s.Cache.Has(key) {
+		warmCounter.WithLabelValues("present").Inc()
+		w.update(func(p *WarmProgress) { p.Present++ })
+		return
+	}
+
+	fce, err := s.cacheFill(key, true)
+	if errors.Is(err, os.ErrNotExist) {
+		warmCounter.WithLabelValues("missing").Inc()
+		w.update(func(p *WarmProgress) { p.Missing++ })
+		return
+	} else if err != nil {
+		log.Errorf("warm of %s failed: %v", key, err)
+		warmCounter.WithLabelValues("failed").Inc()
+		w.update(func(p *WarmProgress) { p.Failed++ })
+		return
+	}
+	size := fce.Size
+	fce.Close()
+	warmCounter.WithLabelValues("cached").Inc()
+	w.update(func(p *WarmProgress) {
+		p.Cached++
+		p.Bytes += size
+	})
+}
+
+// ServeWarm runs the WarmRequest in a POST body and streams its progress back
+// as one JSON WarmProgress per line. The warm stops if the client goes away.
+func (s *Service) ServeWarm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, r, AuthClassAdmin) {
+		return
+	}
+
+	var req WarmRequest
+	if err := adminBodyDecode(r, &req); err != nil {
+		http.Error(w, "Invalid warm request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	started := false
+	_, err := s.Warm(r.Context(), req, func(p WarmProgress) {
+		started = true
+		enc.Encode(p)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if errors.Is(err, ErrWarmRequest) && !started {
+		w.Header().Del("Content-Type")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Errorf("warm failed: %v", err)
+	}
+}
+
+// WarmCmdInit adds the options for the warm subcommand.
+func WarmCmdInit(cmd *cobra.Command) {
+	cmd.Flags().String(OPT_WARM_ADDR, "", "base URL of the admin listener of the edgie to warm (default from ADMIN_ADDR)")
+	viper.BindPFlag(OPT_WARM_ADDR, cmd.Flags().Lookup(OPT_WARM_ADDR))
+
+	cmd.Flags().Int(OPT_WARM_CONCURRENCY, WarmConcurrencyDefault, "max objects fetched at once")
+	viper.BindPFlag(OPT_WARM_CONCURRENCY, cmd.Flags().Lookup(OPT_WARM_CONCURRENCY))
+
+	cmd.Flags().String(OPT_WARM_HMAC_KEY, "", "ID of the AUTH_HMAC_FILE key that signs the warm request, for AUTH_ADMIN=hmac")
+	viper.BindPFlag(OPT_WARM_HMAC_KEY, cmd.Flags().Lookup(OPT_WARM_HMAC_KEY))
+
+	cmd.Flags().String(OPT_WARM_MANIFEST, "", "file with one key per line to warm (- for stdin, # starts a comment)")
+	viper.BindPFlag(OPT_WARM_MANIFEST, cmd.Flags().Lookup(OPT_WARM_MANIFEST))
+
+	cmd.Flags().String(OPT_WARM_PATTERNS, "", "comma separated doublestar patterns of S3 keys to warm")
+	viper.BindPFlag(OPT_WARM_PATTERNS, cmd.Flags().Lookup(OPT_WARM_PATTERNS))
+
+	cmd.Flags().String(OPT_WARM_PREFIXES, "", "comma separated S3 prefixes to warm")
+	viper.BindPFlag(OPT_WARM_PREFIXES, cmd.Flags().Lookup(OPT_WARM_PREFIXES))
+
+	cmd.Flags().Float64(OPT_WARM_RATE, 0, "max fetches started per second (0 is unlimited)")
+	viper.BindPFlag(OPT_WARM_RATE, cmd.Flags().Lookup(OPT_WARM_RATE))
+
+	cmd.Flags().String(OPT_WARM_TOKEN, "", "bearer token or JWT sent with the warm request, for AUTH_ADMIN=bearer or jwt")
+	viper.BindPFlag(OPT_WARM_TOKEN, cmd.Flags().Lookup(OPT_WARM_TOKEN))
+}
+
+// WarmCmdExecute asks a running edgie to warm its cache and passes each
+// progress report it streams back to progress.
+func WarmCmdExecute(cmd *cobra.Command, args []string, progress func(WarmProgress)) (WarmProgress, error) {
+	common.CmdExecute(cmd, args)
+
+	req := WarmRequest{
+		Concurrency: viper.GetInt(OPT_WARM_CONCURRENCY),
+		Rate:        viper.GetFloat64(OPT_WARM_RATE),
+		Patterns:    patternsSplit(viper.GetString(OPT_WARM_PATTERNS)),
+	}
+	for _, prefix := range strings.Split(viper.GetString(OPT_WARM_PREFIXES), ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			req.Prefixes = append(req.Prefixes, prefix)
+		}
+	}
+	if manifest := viper.GetString(OPT_WARM_MANIFEST); manifest != "" {
+		keys, err := warmManifestRead(manifest)
+		if err != nil {
+			return WarmProgress{}, err
+		}
+		req.Keys = keys
+	}
+
+	addr := viper.GetString(OPT_WARM_ADDR)
+	if addr == "" {
+		addr = adminURL()
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return WarmProgress{}, err
+	}
+	// presents our cert, so AUTH_ADMIN=mtls lets peers warm each other
+	tlsConfig, err := common.TLSClientConfig()
+	if err != nil {
+		return WarmProgress{}, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client := &http.Client{Transport: transport}
+	httpReq, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(addr, "/")+WarmPath, bytes.NewReader(body))
+	if err != nil {
+		return WarmProgress{}, fmt.Errorf("bad WARM_ADDR: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if err := warmRequestAuth(httpReq, body); err != nil {
+		return WarmProgress{}, err
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return WarmProgress{}, fmt.Errorf("could not reach edgie at %s: %v", addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return WarmProgress{}, fmt.Errorf("warm refused: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var last WarmProgress
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var p WarmProgress
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return last, fmt.Errorf("bad warm progress from edgie: %v", err)
+		}
+		last = p
+		if progress != nil {
+			progress(p)
+		}
+	}
+	if !last.Done {
+		return last, errors.New("edgie stopped reporting before the warm was done")
+	}
+	if last.Error != "" {
+		return last, errors.New(last.Error)
+	}
+	return last, nil
+}
+
+// warmRequestAuth adds the credentials of WARM_TOKEN or WARM_HMAC_KEY to r.
+// The body checksum goes in either way, so an HMAC signature covers the body.
+func warmRequestAuth(r *http.Request, body []byte) error {
+	sum := sha256.Sum256(body)
+	r.Header.Set(HeaderChecksumSHA256, base64.StdEncoding.EncodeToString(sum[:]))
+
+	if token := viper.GetString(OPT_WARM_TOKEN); token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+	keyID := viper.GetString(OPT_WARM_HMAC_KEY)
+	if keyID == "" {
+		return nil
+	}
+	keysPath := viper.GetString(OPT_AUTH_HMAC_FILE)
+	if keysPath == "" {
+		return errors.New("WARM_HMAC_KEY needs AUTH_HMAC_FILE")
+	}
+	hmacAuth, err := authHMACLoad(keysPath)
+	if err != nil {
+		return fmt.Errorf("could not load AUTH_HMAC_FILE: %v", err)
+	}
+	key, ok := hmacAuth.keys[keyID]
+	if !ok {
+		return fmt.Errorf("AUTH_HMAC_FILE has no key %s", keyID)
+	}
+	AuthHMACSign(r, keyID, key.secret, time.Now())
+	return nil
+}
+
+// warmManifestRead reads the keys of a manifest file, or of stdin for "-".
+func warmManifestRead(manifest string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if manifest != "-" {
+		f, err := os.Open(manifest)
+		if err != nil {
+			return nil, fmt.Errorf("could not read WARM_MANIFEST: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var keys []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key := strings.TrimSpace(scanner.Text())
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read WARM_MANIFEST: %v", err)
+	}
+	return keys, nil
+}